@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/status"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/throttle"
+)
+
+// how long an API request waits for the dispatcher loop
+const apiTimeout = 10 * time.Second
+
+// apiRequest is a request of the HTTP API to the dispatcher. The requests are processed
+// by the dispatcher loop, like the messages of the workers, since only the loop accesses
+// the state of the dispatcher.
+type apiRequest struct {
+	action  string // workers, tasks, throttle, pause, resume, concurrency, abort or release
+	shardID uint32 // shard of an abort or a release
+	value   int    // concurrency to set, negative to remove the override
+	reply   chan apiReply
+}
+
+// apiReply is the answer of the dispatcher to an apiRequest
+type apiReply struct {
+	status int
+	body   interface{}
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type workerView struct {
+	WorkerID int    `json:"workerId"`
+	Retiring bool   `json:"retiring"`
+	ShardID  uint32 `json:"shardId,omitempty"` // shard of its running task
+	Version  uint32 `json:"version,omitempty"`
+}
+
+type taskView struct {
+	ShardID    uint32 `json:"shardId"`
+	SchemaName string `json:"schemaName"`
+	Version    uint32 `json:"version"`
+	CmdType    string `json:"cmdType"`
+	WorkerID   int    `json:"workerId,omitempty"` // 0 until a worker picks the task up
+	Throttled  bool   `json:"throttled"`
+	Aborting   bool   `json:"aborting"`
+}
+
+type throttleView struct {
+	TaskLimit        int                  `json:"taskLimit"`
+	MaxConcurrentDDL int                  `json:"maxConcurrentDDL"`
+	Paused           bool                 `json:"paused"`
+	Concurrency      *int                 `json:"concurrency,omitempty"` // set through the API
+	Window           string               `json:"window,omitempty"`      // open maintenance window
+	ThrottledTasks   []uint32             `json:"throttledTasks"`
+	Hosts            []throttle.HostState `json:"hosts"`
+}
+
+// handleAPIRequest processes a request of the HTTP API, from the dispatcher loop
+func (d *dispatcher) handleAPIRequest(req apiRequest) {
+	req.reply <- d.apiAction(req)
+}
+
+func (d *dispatcher) apiAction(req apiRequest) apiReply {
+	switch req.action {
+	case "workers":
+		running := map[int]taskKey{}
+		for key, w := range d.runningOn {
+			running[w] = key
+		}
+
+		workers := []workerView{}
+		for id := range d.ctlMsgs {
+			w := workerView{WorkerID: id, Retiring: d.retiring[id]}
+			if key, ok := running[id]; ok {
+				w.ShardID = key.shardID
+				w.Version = key.version
+			}
+			workers = append(workers, w)
+		}
+		sort.Slice(workers, func(i, j int) bool { return workers[i].WorkerID < workers[j].WorkerID })
+		return apiReply{status: http.StatusOK, body: workers}
+
+	case "tasks":
+		tasks := []taskView{}
+		for e := d.onGoing.Back(); e != nil; e = e.Prev() {
+			tasks = append(tasks, d.newTaskView(e.Value.(Task)))
+		}
+		return apiReply{status: http.StatusOK, body: tasks}
+
+	case "throttle":
+		return apiReply{status: http.StatusOK, body: d.throttleView()}
+
+	case "pause", "resume":
+		d.paused = req.action == "pause"
+		Logger.Info("pause changed through the API", "paused", d.paused)
+		d.readThrottling()
+		return apiReply{status: http.StatusOK, body: d.throttleView()}
+
+	case "concurrency":
+		if req.value < 0 {
+			d.concurrency = nil
+			Logger.Info("concurrency override removed through the API")
+		} else {
+			value := req.value
+			d.concurrency = &value
+			Logger.Info("concurrency set through the API", "concurrency", value)
+		}
+		d.readThrottling()
+		return apiReply{status: http.StatusOK, body: d.throttleView()}
+
+	case "abort":
+		for e := d.onGoing.Front(); e != nil; e = e.Next() {
+			if e.Value.(Task).shard.ShardId != req.shardID {
+				continue
+			}
+			// the abort flag makes the dispatcher send the abort again if the worker is busy
+			if err := d.db.RequestAbort(req.shardID); err != nil {
+				return apiReply{status: http.StatusInternalServerError, body: apiError{err.Error()}}
+			}
+			d.abortTask(req.shardID)
+			return apiReply{status: http.StatusAccepted, body: d.taskView(req.shardID)}
+		}
+		return apiReply{status: http.StatusNotFound,
+			body: apiError{fmt.Sprintf("shard %d has no task running in this dispatcher", req.shardID)}}
+
+	case "release":
+		for e := d.onGoing.Front(); e != nil; e = e.Next() {
+			if e.Value.(Task).shard.ShardId == req.shardID {
+				return apiReply{status: http.StatusConflict,
+					body: apiError{fmt.Sprintf("shard %d has a running task, abort it instead", req.shardID)}}
+			}
+		}
+		shard, err := d.db.GetShard(req.shardID)
+		if err != nil {
+			return apiReply{status: http.StatusNotFound,
+				body: apiError{fmt.Sprintf("cannot get shard %d: %s", req.shardID, err)}}
+		}
+		if !shard.TaskName.Valid {
+			return apiReply{status: http.StatusConflict,
+				body: apiError{fmt.Sprintf("shard %d is not claimed by a task", req.shardID)}}
+		}
+		// the task of another dispatcher may still be running on the shard
+		if shard.TaskName.String != d.taskName {
+			stale, err := staleClaim(d.db, req.shardID, d.cfg.StaleTaskTimeout, d.taskName)
+			if err != nil {
+				return apiReply{status: http.StatusInternalServerError, body: apiError{err.Error()}}
+			}
+			if !stale {
+				return apiReply{status: http.StatusConflict,
+					body: apiError{fmt.Sprintf("shard %d is claimed by the live task %s, abort it instead",
+						req.shardID, shard.TaskName.String)}}
+			}
+		}
+		if err = d.db.ReleaseShard(req.shardID, shard.TaskName.String); err != nil {
+			return apiReply{status: http.StatusInternalServerError, body: apiError{err.Error()}}
+		}
+		d.db.AddOpLogRun(req.shardID, shard.Version, shard.Attempts, shard.TaskName.String,
+			"released by an operator")
+		Logger.Info("shard released through the API", "shardId", req.shardID)
+		return apiReply{status: http.StatusOK, body: newShardView(shard)}
+	}
+
+	return apiReply{status: http.StatusNotFound, body: apiError{"unknown action " + req.action}}
+}
+
+func (d *dispatcher) throttleView() throttleView {
+	v := throttleView{
+		TaskLimit:        d.taskLimit,
+		MaxConcurrentDDL: d.cfg.MaxConcurrentDDL,
+		Paused:           d.paused,
+		Concurrency:      d.concurrency,
+		Window:           d.window,
+		ThrottledTasks:   []uint32{},
+		Hosts:            d.monitor.Hosts(),
+	}
+	// the shards of the throttled tasks
+	seen := map[uint32]bool{}
+	for key, throttled := range d.throttled {
+		if throttled && !seen[key.shardID] {
+			seen[key.shardID] = true
+			v.ThrottledTasks = append(v.ThrottledTasks, key.shardID)
+		}
+	}
+	sort.Slice(v.ThrottledTasks, func(i, j int) bool { return v.ThrottledTasks[i] < v.ThrottledTasks[j] })
+	return v
+}
+
+// taskView returns the view of the oldest task of a shard
+func (d *dispatcher) taskView(shardID uint32) taskView {
+	for e := d.onGoing.Back(); e != nil; e = e.Prev() {
+		task := e.Value.(Task)
+		if task.shard.ShardId == shardID {
+			return d.newTaskView(task)
+		}
+	}
+	return taskView{ShardID: shardID}
+}
+
+func (d *dispatcher) newTaskView(task Task) taskView {
+	key := task.key()
+	return taskView{ShardID: key.shardID, SchemaName: task.shard.SchemaName, Version: key.version,
+		CmdType: task.version.CmdType, WorkerID: d.runningOn[key], Throttled: d.throttled[key],
+		Aborting: d.aborting[key]}
+}
+
+// apiServer serves the HTTP API, the requests about the dispatcher are sent to its loop
+type apiServer struct {
+	token        string
+	requests     chan<- apiRequest
+	db           database.Store
+	staleTimeout time.Duration
+	metrics      http.Handler
+}
+
+// newAPIHandler returns the handler of the HTTP API of d. All the endpoints require the
+// token as a bearer token:
+//
+//	GET  /workers                 the workers and their running task
+//	GET  /tasks                   the onGoing list
+//	GET  /throttle                the task limit, the throttled tasks and the load of the hosts
+//	GET  /versions                the progress of each version over the shards
+//	GET  /metrics                 the metrics, in the Prometheus format
+//	POST /pause                   stops claiming shards and throttles the running tasks
+//	POST /resume                  undoes a pause
+//	POST /concurrency             sets the concurrency, {"concurrency": n}, a negative n removes it
+//	POST /tasks/{shardId}/abort   aborts the running tasks of a shard
+//	POST /shards/{shardId}/release releases a shard claimed by a task that is not running here
+func newAPIHandler(d *dispatcher, token string) http.Handler {
+	return &apiServer{token: token, requests: d.apiReqs, db: d.db, staleTimeout: d.cfg.StaleTaskTimeout,
+		metrics: promhttp.HandlerFor(d.metrics.registry, promhttp.HandlerOpts{})}
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, apiError{"invalid or missing bearer token"})
+		return
+	}
+
+	if r.URL.Path == "/metrics" {
+		s.metrics.ServeHTTP(w, r)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	req := apiRequest{action: parts[0]}
+	method := http.MethodPost
+
+	switch {
+	case len(parts) == 1 && (parts[0] == "workers" || parts[0] == "tasks" || parts[0] == "throttle" ||
+		parts[0] == "versions"):
+		method = http.MethodGet
+	case len(parts) == 1 && (parts[0] == "pause" || parts[0] == "resume"):
+	case len(parts) == 1 && parts[0] == "concurrency":
+		var body struct {
+			Concurrency *int `json:"concurrency"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Concurrency == nil {
+			writeJSON(w, http.StatusBadRequest, apiError{`expecting {"concurrency": n}`})
+			return
+		}
+		req.value = *body.Concurrency
+	case len(parts) == 3 && ((parts[0] == "tasks" && parts[2] == "abort") ||
+		(parts[0] == "shards" && parts[2] == "release")):
+		shardID, err := parseID("shardId", parts[1])
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		req.action = parts[2]
+		req.shardID = shardID
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{"unknown endpoint " + r.URL.Path})
+		return
+	}
+
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"expecting " + method})
+		return
+	}
+
+	if req.action == "versions" {
+		s.versions(w)
+		return
+	}
+
+	reply, err := s.send(req)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{err.Error()})
+		return
+	}
+	writeJSON(w, reply.status, reply.body)
+}
+
+// versions writes the progress of the versions, it only reads the database
+func (s *apiServer) versions(w http.ResponseWriter) {
+	// the task limit is the concurrency of the estimation
+	reply, err := s.send(apiRequest{action: "throttle"})
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{err.Error()})
+		return
+	}
+	report, err := status.Build(s.db, s.staleTimeout, reply.body.(throttleView).TaskLimit)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// send sends a request to the dispatcher loop and waits for its reply
+func (s *apiServer) send(req apiRequest) (apiReply, error) {
+	req.reply = make(chan apiReply, 1)
+	timeout := time.NewTimer(apiTimeout)
+	defer timeout.Stop()
+
+	select {
+	case s.requests <- req:
+	case <-timeout.C:
+		return apiReply{}, fmt.Errorf("the dispatcher is busy, try again later")
+	}
+	select {
+	case reply := <-req.reply:
+		return reply, nil
+	case <-timeout.C:
+		return apiReply{}, fmt.Errorf("the dispatcher did not reply in time")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(body); err != nil {
+		Logger.Warn("cannot write the API response", "error", err)
+	}
+}
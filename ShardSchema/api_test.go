@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/config"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestAPI(t *testing.T) {
+	cfg := &config.Config{MaxConcurrentDDL: 4, ThrottlingFile: "/nonexistent/ShardSchema_throttle"}
+	d := newDispatcher("", cfg, nil, nil, "host:000001")
+	d.ctlMsgs[1] = make(chan MsgToWorker, 1)
+	d.ctlMsgs[2] = make(chan MsgToWorker, 1)
+	d.onGoing.PushFront(Task{name: d.taskName, shard: &models.Shard{ShardId: 7, SchemaName: "shard_7"},
+		version: &models.Version{Version: 3, CmdType: "gh-ost"}})
+	d.runningOn[taskKey{shardID: 7, version: 3}] = 2
+
+	// stands for the dispatcher loop
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case req := <-d.apiReqs:
+				d.handleAPIRequest(req)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	srv := httptest.NewServer(newAPIHandler(d, "secret"))
+	defer srv.Close()
+
+	call := func(method string, path string, token string, body string, v interface{}) int {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		tu.Ok(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		tu.Ok(t, err)
+		defer resp.Body.Close()
+		if v != nil {
+			tu.Ok(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	tu.Equals(t, http.StatusUnauthorized, call("GET", "/tasks", "", "", nil))
+	tu.Equals(t, http.StatusUnauthorized, call("GET", "/tasks", "wrong", "", nil))
+	tu.Equals(t, http.StatusNotFound, call("GET", "/unknown", "secret", "", nil))
+	tu.Equals(t, http.StatusMethodNotAllowed, call("GET", "/pause", "secret", "", nil))
+
+	var workers []workerView
+	tu.Equals(t, http.StatusOK, call("GET", "/workers", "secret", "", &workers))
+	tu.Equals(t, []workerView{{WorkerID: 1}, {WorkerID: 2, ShardID: 7, Version: 3}}, workers)
+
+	var tasks []taskView
+	tu.Equals(t, http.StatusOK, call("GET", "/tasks", "secret", "", &tasks))
+	tu.Equals(t, []taskView{{ShardID: 7, SchemaName: "shard_7", Version: 3, CmdType: "gh-ost", WorkerID: 2}}, tasks)
+
+	var th throttleView
+	tu.Equals(t, http.StatusOK, call("POST", "/concurrency", "secret", `{"concurrency": 2}`, &th))
+	tu.Equals(t, 2, th.TaskLimit)
+	tu.Equals(t, http.StatusOK, call("POST", "/pause", "secret", "", &th))
+	tu.Assert(t, th.Paused, "the dispatcher is paused")
+	tu.Equals(t, 0, th.TaskLimit)
+	tu.Equals(t, http.StatusOK, call("POST", "/resume", "secret", "", &th))
+	tu.Equals(t, 2, th.TaskLimit)
+	tu.Equals(t, http.StatusOK, call("POST", "/concurrency", "secret", `{"concurrency": -1}`, &th))
+	tu.Equals(t, 4, th.TaskLimit)
+	tu.Equals(t, http.StatusBadRequest, call("POST", "/concurrency", "secret", `{}`, nil))
+
+	tu.Equals(t, http.StatusNotFound, call("POST", "/tasks/8/abort", "secret", "", nil))
+	tu.Equals(t, http.StatusBadRequest, call("POST", "/tasks/x/abort", "secret", "", nil))
+	tu.Equals(t, http.StatusConflict, call("POST", "/shards/7/release", "secret", "", nil))
+
+	// the metrics are set by the dispatcher loop
+	d.metrics.tasks.Set(1)
+	d.metrics.failures.WithLabelValues("deadlock").Inc()
+	req, err := http.NewRequest("GET", srv.URL+"/metrics", nil)
+	tu.Ok(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	tu.Ok(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	tu.Ok(t, err)
+	tu.Assert(t, strings.Contains(string(body), "shardschema_tasks_in_flight 1\n"), "tasks in flight: %s", body)
+	tu.Assert(t, strings.Contains(string(body), `shardschema_task_failures_total{error_class="deadlock"} 1`),
+		"failures: %s", body)
+}
+
+func TestAPIRelease(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	store := database.NewMemoryStore()
+	store.Now = func() time.Time { return now }
+	_, err := store.AddVersion(&models.Version{Command: "ADD c2 INT", TableName: "t1", CmdType: "sql"})
+	tu.Ok(t, err)
+	_, err = store.AddShard("shard_1", "user:pass@tcp(10.2.2.1:3306)/", 0)
+	tu.Ok(t, err)
+	_, err = store.ClaimShards(1, "other:000002", 1, nil)
+	tu.Ok(t, err)
+
+	cfg := &config.Config{MaxConcurrentDDL: 4, StaleTaskTimeout: 10 * time.Minute}
+	d := newDispatcher("", cfg, store, nil, "host:000001")
+	release := func() int {
+		return d.apiAction(apiRequest{action: "release", shardID: 1}).status
+	}
+
+	// the task of the other dispatcher may still be running
+	now = now.Add(5 * time.Minute)
+	tu.Equals(t, http.StatusConflict, release())
+	shard, err := store.GetShard(1)
+	tu.Ok(t, err)
+	tu.Equals(t, "other:000002", shard.TaskName.String)
+
+	now = now.Add(10 * time.Minute)
+	tu.Equals(t, http.StatusOK, release())
+	shard, err = store.GetShard(1)
+	tu.Ok(t, err)
+	tu.Assert(t, !shard.TaskName.Valid, "shard 1 is released")
+}
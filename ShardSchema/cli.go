@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/config"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+)
+
+const defaultConfigFile = "/etc/ShardSchema.cnf"
+
+const usage = `Usage: shardSchema [-config file] [-output table|json] <command> [arguments]
+
+Commands:
+  run                                      run the dispatcher
+  run -plan                                print the commands the dispatcher would run on each shard,
+                                           in the order of the claims, without claiming or changing
+                                           anything, ignoring the host limits and the load thresholds
+  version add -table t -command c [-type sql|pt-osc|gh-ost] [-version n]
+              [-options o] [-validate query -answer result] [-depends v1,v2|none]
+              [-target expression]         the shard groups it applies to, ex "eu & !archive"
+  version list
+  version show <version>
+  shard add -schema name -dsn dsn [-version n] [-groups g1,g2]
+  shard list
+  shard show <shardId>
+  shard release <shardId>                  release a shard claimed by a task, its version is unchanged
+  shard retry <shardId>                    clear the failed state and the attempts of a shard
+  shard set-version <shardId> <version>    set the version of a shard without applying anything
+  shard set-groups <shardId> <g1,g2>       set the groups of a shard, the versions it skipped stay skipped
+  shard abort <shardId>                    ask the dispatcher to abort the tasks running on the shard
+  log <shardId> [version]                  show the oplog of a shard
+  status                                   show the rollout progress of the versions over the shards,
+                                           the stuck shards and the estimated time to completion
+  migrate [-status]                        create or upgrade the tables of the ShardSchema database,
+                                           with -status only list the migrations
+
+For backward compatibility, "shardSchema <config file>" runs the dispatcher.
+`
+
+// cli holds the global options of the command line
+type cli struct {
+	configFile string
+	output     string
+	out        io.Writer
+	cfg        *config.Config
+	db         database.Store
+}
+
+// runCLI parses the command line and runs the command, it returns the exit status
+func runCLI(args []string, out io.Writer) int {
+	c := &cli{out: out}
+
+	fs := flag.NewFlagSet("shardSchema", flag.ContinueOnError)
+	fs.StringVar(&c.configFile, "config", defaultConfigFile, "configuration file")
+	fs.StringVar(&c.output, "output", "table", "output format, table or json")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	args = fs.Args()
+
+	if len(args) == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	// backward compatibility, a single argument is the config file of the dispatcher
+	if len(args) == 1 && !isCommand(args[0]) {
+		c.configFile = args[0]
+		args = []string{"run"}
+	}
+
+	if c.output != "table" && c.output != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format %q\n", c.output)
+		return 1
+	}
+
+	if args[0] == "run" {
+		plan, err := parseRunArgs(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !plan {
+			return runDispatcher(c.configFile)
+		}
+	}
+
+	// migrate may have to create the database first
+	if args[0] == "migrate" {
+		if err := c.migrateCmd(args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	var err error
+	c.cfg, c.db, err = openDatabase(c.configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer c.db.Close()
+
+	switch args[0] {
+	case "run":
+		err = c.planCmd()
+	case "version":
+		err = c.versionCmd(args[1:])
+	case "shard":
+		err = c.shardCmd(args[1:])
+	case "log":
+		err = c.logCmd(args[1:])
+	case "status":
+		err = c.statusCmd(args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func isCommand(name string) bool {
+	switch name {
+	case "run", "version", "shard", "log", "status", "migrate":
+		return true
+	}
+	return false
+}
+
+// print writes v as JSON or the rows as a table, depending on the output format
+func (c *cli) print(v interface{}, headers []string, rows [][]string) error {
+	if c.output == "json" {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// parseID parses a shardId or a version argument
+func parseID(name string, arg string) (uint32, error) {
+	id, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, arg)
+	}
+	return uint32(id), nil
+}
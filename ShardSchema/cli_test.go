@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestRedactDSN(t *testing.T) {
+	tu.Equals(t, "user:xxx@tcp(10.2.2.1:3306)", redactDSN("user:pass@tcp(10.2.2.1:3306)"))
+	tu.Equals(t, "user:xxx@tcp(10.2.2.1:3306)", redactDSN("user:p@ss@tcp(10.2.2.1:3306)"))
+	tu.Equals(t, "user@tcp(10.2.2.1:3306)", redactDSN("user@tcp(10.2.2.1:3306)"))
+	tu.Equals(t, "tcp(10.2.2.1:3306)", redactDSN("tcp(10.2.2.1:3306)"))
+}
+
+func TestPrint(t *testing.T) {
+	var out bytes.Buffer
+	c := &cli{output: "table", out: &out}
+	v := struct {
+		Name string `json:"name"`
+	}{Name: "t1"}
+
+	tu.Ok(t, c.print(v, []string{"NAME", "VALUE"}, [][]string{{"t1", "1"}, {"table2", "2"}}))
+	tu.Equals(t, "NAME    VALUE\nt1      1\ntable2  2\n", out.String())
+
+	out.Reset()
+	c.output = "json"
+	tu.Ok(t, c.print(v, nil, nil))
+	tu.Equals(t, "{\n  \"name\": \"t1\"\n}\n", out.String())
+}
+
+func TestInvalidCommandLine(t *testing.T) {
+	var out bytes.Buffer
+	tu.Assert(t, runCLI([]string{}, &out) == 1, "no command should fail")
+	tu.Assert(t, runCLI([]string{"-output", "yaml", "status"}, &out) == 1, "invalid output format should fail")
+	tu.Assert(t, runCLI([]string{"run", "-plan", "now"}, &out) == 1, "unexpected run argument should fail")
+}
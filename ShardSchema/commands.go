@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/config"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/depgraph"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/groups"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/migrate"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/ptosc"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/status"
+)
+
+// versionCmd implements version add|list|show
+func (c *cli) versionCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("version: missing sub-command, add, list or show")
+	}
+
+	switch args[0] {
+	case "add":
+		v := &models.Version{}
+		var version uint
+		var validationQuery, validationAnswer, options, dependsOn, target string
+		fs := flag.NewFlagSet("version add", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		fs.StringVar(&v.TableName, "table", "", "affected table")
+		fs.StringVar(&v.Command, "command", "", "alter command, in the format of the --alter option of pt-osc")
+		fs.StringVar(&v.CmdType, "type", "sql", "type of command, sql, pt-osc or gh-ost")
+		fs.UintVar(&version, "version", 0, "version number, the next one if not set")
+		fs.StringVar(&options, "options", "", "extra options of pt-osc, ex \"--max-load Threads_running=50\"")
+		fs.StringVar(&validationQuery, "validate", "", "query run on the shard once the command succeeded")
+		fs.StringVar(&validationAnswer, "answer", "", "expected result of the validation query, one line per "+
+			"row and the columns separated by spaces")
+		fs.StringVar(&dependsOn, "depends", "", "versions it depends on, comma separated, \"none\" for no "+
+			"dependency, besides the previous version on the same table it always depends on")
+		fs.StringVar(&target, "target", "", "expression of the shard groups it applies to, ex \"eu & !archive\", "+
+			"all the shards if not set")
+		if err := fs.Parse(args[1:]); err != nil {
+			return fmt.Errorf("version add: %s", err)
+		}
+		if v.TableName == "" || v.Command == "" {
+			return fmt.Errorf("version add: -table and -command are required")
+		}
+		if v.CmdType != "sql" && v.CmdType != "pt-osc" && v.CmdType != "gh-ost" {
+			return fmt.Errorf("version add: invalid type %q", v.CmdType)
+		}
+		if options != "" {
+			if v.CmdType != "pt-osc" {
+				return fmt.Errorf("version add: -options is only supported with pt-osc")
+			}
+			if _, err := ptosc.ParseOptions(options); err != nil {
+				return fmt.Errorf("version add: %s", err)
+			}
+			v.Options = sql.NullString{String: options, Valid: true}
+		}
+		if validationQuery == "" && validationAnswer != "" {
+			return fmt.Errorf("version add: -answer requires -validate")
+		}
+		v.Version = uint32(version)
+		if validationQuery != "" {
+			v.ValidationQuery = sql.NullString{String: validationQuery, Valid: true}
+			v.ValidationAnswer = sql.NullString{String: validationAnswer, Valid: true}
+		}
+		if target != "" {
+			if _, err := groups.Parse(target); err != nil {
+				return fmt.Errorf("version add: %s", err)
+			}
+			v.Target = sql.NullString{String: target, Valid: true}
+		}
+		if dependsOn != "" {
+			if err := c.checkDependsOn(v, dependsOn); err != nil {
+				return fmt.Errorf("version add: %s", err)
+			}
+		}
+
+		id, err := c.db.AddVersion(v)
+		if err != nil {
+			return err
+		}
+		return c.showVersion(id)
+
+	case "list":
+		versions, err := c.db.ListVersions()
+		if err != nil {
+			return err
+		}
+		graph, err := depgraph.New(versions)
+		if err != nil {
+			return err
+		}
+		views := make([]versionView, 0, len(versions))
+		rows := make([][]string, 0, len(versions))
+		for _, v := range versions {
+			view := newVersionView(v, graph.Deps(v.Version))
+			views = append(views, view)
+			rows = append(rows, view.row())
+		}
+		return c.print(views, versionHeaders, rows)
+
+	case "show":
+		if len(args) != 2 {
+			return fmt.Errorf("version show: expecting a version")
+		}
+		version, err := parseID("version", args[1])
+		if err != nil {
+			return err
+		}
+		return c.showVersion(version)
+	}
+
+	return fmt.Errorf("version: unknown sub-command %q", args[0])
+}
+
+func (c *cli) showVersion(version uint32) error {
+	v, err := c.db.GetVersion(version)
+	if err != nil {
+		return err
+	}
+	versions, err := c.db.ListVersions()
+	if err != nil {
+		return err
+	}
+	graph, err := depgraph.New(versions)
+	if err != nil {
+		return err
+	}
+	view := newVersionView(v, graph.Deps(v.Version))
+	return c.print(view, versionHeaders, [][]string{view.row()})
+}
+
+// checkDependsOn sets the dependencies of a new version, from the -depends flag, once checked
+// against the existing versions
+func (c *cli) checkDependsOn(v *models.Version, dependsOn string) error {
+	deps := []uint32{}
+	if dependsOn != "none" {
+		var err error
+		if deps, err = depgraph.ParseDependsOn(dependsOn); err != nil {
+			return err
+		}
+	}
+	v.DependsOn = sql.NullString{String: depgraph.FormatDependsOn(deps), Valid: true}
+
+	versions, err := c.db.ListVersions()
+	if err != nil {
+		return err
+	}
+	// the number of a new version is the next one
+	added := *v
+	if added.Version == 0 {
+		for _, existing := range versions {
+			if existing.Version > added.Version {
+				added.Version = existing.Version
+			}
+		}
+		added.Version++
+	}
+	_, err = depgraph.New(append(versions, &added))
+	return err
+}
+
+// shardCmd implements shard add|list|show|release|retry|set-version|set-groups|abort
+func (c *cli) shardCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("shard: missing sub-command, add, list, show, release, retry, set-version, " +
+			"set-groups or abort")
+	}
+
+	switch args[0] {
+	case "add":
+		var schemaName, shardDSN, groupList string
+		var version uint
+		fs := flag.NewFlagSet("shard add", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		fs.StringVar(&schemaName, "schema", "", "name of the schema, ex shard_1234")
+		fs.StringVar(&shardDSN, "dsn", "", "DSN of the shard server, ex user:pass@tcp(10.0.0.1:3306)")
+		fs.UintVar(&version, "version", 0, "current schema version of the shard")
+		fs.StringVar(&groupList, "groups", "", "groups of the shard, comma separated, ex eu,premium")
+		if err := fs.Parse(args[1:]); err != nil {
+			return fmt.Errorf("shard add: %s", err)
+		}
+		if schemaName == "" || shardDSN == "" {
+			return fmt.Errorf("shard add: -schema and -dsn are required")
+		}
+		shardGroups, err := groups.ParseGroups(groupList)
+		if err != nil {
+			return fmt.Errorf("shard add: %s", err)
+		}
+
+		shardID, err := c.db.AddShard(schemaName, shardDSN, uint32(version))
+		if err != nil {
+			return err
+		}
+		if len(shardGroups) > 0 {
+			if err = c.db.SetShardGroups(shardID, shardGroups); err != nil {
+				return err
+			}
+		}
+		return c.showShard(shardID)
+
+	case "list":
+		shards, err := c.db.ListShards()
+		if err != nil {
+			return err
+		}
+		views := make([]shardView, 0, len(shards))
+		rows := make([][]string, 0, len(shards))
+		for _, s := range shards {
+			view := newShardView(s)
+			views = append(views, view)
+			rows = append(rows, view.row())
+		}
+		return c.print(views, shardHeaders, rows)
+
+	case "show", "release", "retry", "abort":
+		if len(args) != 2 {
+			return fmt.Errorf("shard %s: expecting a shardId", args[0])
+		}
+		shardID, err := parseID("shardId", args[1])
+		if err != nil {
+			return err
+		}
+
+		switch args[0] {
+		case "release":
+			shard, err := c.db.GetShard(shardID)
+			if err != nil {
+				return fmt.Errorf("cannot get shard %d: %s", shardID, err)
+			}
+			if !shard.TaskName.Valid {
+				return fmt.Errorf("shard %d is not claimed by a task", shardID)
+			}
+			stale, err := staleClaim(c.db, shardID, c.cfg.StaleTaskTimeout, "")
+			if err != nil {
+				return err
+			}
+			if !stale {
+				return fmt.Errorf("shard %d is claimed by the live task %s, abort it instead",
+					shardID, shard.TaskName.String)
+			}
+			if err = c.db.ReleaseShard(shardID, shard.TaskName.String); err != nil {
+				return err
+			}
+			c.db.AddOpLogRun(shardID, shard.Version, shard.Attempts, shard.TaskName.String,
+				"released by an operator")
+		case "retry":
+			shard, err := c.db.GetShard(shardID)
+			if err != nil {
+				return fmt.Errorf("cannot get shard %d: %s", shardID, err)
+			}
+			if err = c.db.ResetShardFailure(shardID); err != nil {
+				return err
+			}
+			c.db.AddOpLog(shardID, shard.Version, "", "failure reset by an operator", "", "")
+		case "abort":
+			if err := c.db.RequestAbort(shardID); err != nil {
+				return err
+			}
+		}
+		return c.showShard(shardID)
+
+	case "set-version":
+		if len(args) != 3 {
+			return fmt.Errorf("shard set-version: expecting a shardId and a version")
+		}
+		shardID, err := parseID("shardId", args[1])
+		if err != nil {
+			return err
+		}
+		version, err := parseID("version", args[2])
+		if err != nil {
+			return err
+		}
+		if err = c.db.SetShardVersion(shardID, version); err != nil {
+			return err
+		}
+		c.db.AddOpLog(shardID, version, "", "version set by an operator", "", "")
+		return c.showShard(shardID)
+
+	case "set-groups":
+		if len(args) != 3 {
+			return fmt.Errorf("shard set-groups: expecting a shardId and a comma separated list of groups")
+		}
+		shardID, err := parseID("shardId", args[1])
+		if err != nil {
+			return err
+		}
+		shardGroups, err := groups.ParseGroups(args[2])
+		if err != nil {
+			return fmt.Errorf("shard set-groups: %s", err)
+		}
+		if err = c.db.SetShardGroups(shardID, shardGroups); err != nil {
+			return err
+		}
+		return c.showShard(shardID)
+	}
+
+	return fmt.Errorf("shard: unknown sub-command %q", args[0])
+}
+
+func (c *cli) showShard(shardID uint32) error {
+	s, err := c.db.GetShard(shardID)
+	if err != nil {
+		return fmt.Errorf("cannot get shard %d: %s", shardID, err)
+	}
+	view := newShardView(s)
+	return c.print(view, shardHeaders, [][]string{view.row()})
+}
+
+// logCmd shows the oplog entries of a shard, optionally for a single version
+func (c *cli) logCmd(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("log: expecting a shardId and optionally a version")
+	}
+	shardID, err := parseID("shardId", args[0])
+	if err != nil {
+		return err
+	}
+
+	var version uint32
+	allVersions := true
+	if len(args) == 2 {
+		if version, err = parseID("version", args[1]); err != nil {
+			return err
+		}
+		allVersions = false
+	}
+
+	entries, err := c.db.GetOpLog(shardID, version, allVersions)
+	if err != nil {
+		return err
+	}
+	views := make([]opLogView, 0, len(entries))
+	rows := make([][]string, 0, len(entries))
+	for _, o := range entries {
+		view := newOpLogView(o)
+		views = append(views, view)
+		rows = append(rows, view.row())
+	}
+	return c.print(views, opLogHeaders, rows)
+}
+
+// statusCmd shows the rollout progress of the versions over the shards
+func (c *cli) statusCmd(args []string) error {
+	report, err := status.Build(c.db, c.cfg.StaleTaskTimeout, c.cfg.MaxConcurrentDDL)
+	if err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return c.print(report, nil, nil)
+	}
+	return report.WriteText(c.out)
+}
+
+// migrateCmd creates the metadata database if needed and applies the pending migrations,
+// with -status it only lists them
+func (c *cli) migrateCmd(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	statusOnly := fs.Bool("status", false, "only list the migrations and when they were applied")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("migrate: %s", err)
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("migrate: unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg, err := config.LoadConfig(c.configFile)
+	if err != nil {
+		return errors.Wrap(err, "cannot load config")
+	}
+	if !*statusOnly {
+		if err = createDatabase(cfg); err != nil {
+			return err
+		}
+	}
+	conn, err := getDBConnection(cfg)
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to the db")
+	}
+	defer conn.Close()
+
+	if !*statusOnly {
+		if _, err = migrate.Up(conn); err != nil {
+			return err
+		}
+	}
+
+	statuses, err := migrate.List(conn)
+	if err != nil {
+		return err
+	}
+	views := make([]migrationView, 0, len(statuses))
+	rows := make([][]string, 0, len(statuses))
+	for _, s := range statuses {
+		view := newMigrationView(s)
+		views = append(views, view)
+		rows = append(rows, view.row())
+	}
+	return c.print(views, migrationHeaders, rows)
+}
@@ -0,0 +1,817 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/config"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/depgraph"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/groups"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/retry"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/shardconn"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/throttle"
+)
+
+// how long to wait for the aborted tasks to report before exiting anyway
+const abortTimeout = 2 * time.Minute
+
+// exit statuses of the dispatcher
+const (
+	exitDrained = 0 // all the tasks completed before exiting
+	exitAborted = 2 // running tasks were aborted and their shards released
+)
+
+// dispatcher hands the tasks to the workers and tracks their progress. Its state is
+// only accessed from the dispatcher loop, the workers only talk to it through messages.
+type dispatcher struct {
+	configFile string
+	cfg        *config.Config
+	db         database.Store
+	pool       *shardconn.Pool
+	policy     *retry.Policy
+	monitor    *throttle.Monitor // load of the shard servers
+	taskName   string
+
+	// list of ongoing tasks
+	onGoing *list.List
+
+	// channels to and from the workers, each worker also has its own channel, by worker id,
+	// for the messages about its running task
+	submitMsg chan MsgToWorker
+	replyMsg  chan MsgFromWorker
+	ctlMsgs   map[int]chan MsgToWorker
+
+	// workers asked to stop when the pool shrinks, they exit once their task completes
+	retiring     map[int]bool
+	lastWorkerID int
+
+	// the worker running each ongoing task, and the aborts and throttles sent to them
+	runningOn map[taskKey]int
+	aborting  map[taskKey]bool
+	throttled map[taskKey]bool
+	// when each ongoing task was submitted
+	started map[taskKey]time.Time
+
+	// the first failure and the cancellations of the tasks of a shard, by shardId. The shard is
+	// released once its last task ends.
+	failures  map[uint32]taskFailure
+	cancelled map[uint32]bool
+
+	metrics *metrics
+
+	taskLimit int
+	// last limit read from the throttling file, it is kept once the file is removed
+	fileLimit int
+	// name of the open maintenance window setting taskLimit, if any
+	window string
+
+	// requests of the HTTP API, and the pause and the concurrency they set
+	apiReqs     chan apiRequest
+	paused      bool
+	concurrency *int
+}
+
+func newDispatcher(configFile string, cfg *config.Config, db database.Store, pool *shardconn.Pool,
+	taskName string) *dispatcher {
+
+	return &dispatcher{
+		configFile: configFile,
+		cfg:        cfg,
+		db:         db,
+		pool:       pool,
+		policy:     newRetryPolicy(cfg),
+		monitor:    throttle.NewMonitor(newThresholds(cfg), cfg.ThrottleCheckInterval, Logger),
+		taskName:   taskName,
+		onGoing:    list.New(),
+		submitMsg:  make(chan MsgToWorker, 5),   // do we need buffering?
+		replyMsg:   make(chan MsgFromWorker, 5), // do we need buffering?
+		ctlMsgs:    make(map[int]chan MsgToWorker),
+		retiring:   make(map[int]bool),
+		runningOn:  make(map[taskKey]int),
+		aborting:   make(map[taskKey]bool),
+		throttled:  make(map[taskKey]bool),
+		started:    make(map[taskKey]time.Time),
+		failures:   make(map[uint32]taskFailure),
+		cancelled:  make(map[uint32]bool),
+		metrics:    newMetrics(),
+		taskLimit:  cfg.MaxConcurrentDDL,
+		fileLimit:  cfg.MaxConcurrentDDL,
+		apiReqs:    make(chan apiRequest),
+	}
+}
+
+// taskFailure is a failed task and the class of its error
+type taskFailure struct {
+	task     Task
+	errClass string
+}
+
+// newRetryPolicy creates the retry policy of the failed tasks from the config
+func newRetryPolicy(cfg *config.Config) *retry.Policy {
+	return retry.NewPolicy(cfg.MaxAttempts, cfg.RetryBackoff, cfg.RetryMaxBackoff, cfg.RetryableErrors)
+}
+
+// newThresholds returns the load thresholds of the shard servers from the config
+func newThresholds(cfg *config.Config) throttle.Thresholds {
+	return throttle.Thresholds{
+		ThreadsRunning: cfg.ThrottleThreadsRunning,
+		ReplicationLag: cfg.ThrottleReplicationLag,
+		HistoryLength:  cfg.ThrottleHistoryLength,
+		HeartbeatTable: cfg.ThrottleHeartbeatTable,
+	}
+}
+
+// resizeWorkers starts or stops workers to have numWorkers of them. Stopped workers
+// complete their running task before exiting.
+// Inspired from: https://gobyexample.com/worker-pools
+func (d *dispatcher) resizeWorkers(numWorkers int) {
+	active := []int{}
+	for id := range d.ctlMsgs {
+		if !d.retiring[id] {
+			active = append(active, id)
+		}
+	}
+	// retire the most recent workers first
+	sort.Sort(sort.Reverse(sort.IntSlice(active)))
+
+	for n := len(active); n < numWorkers; n++ {
+		d.lastWorkerID++
+		d.ctlMsgs[d.lastWorkerID] = make(chan MsgToWorker, 1)
+		go worker(d.db, d.pool, d.lastWorkerID, d.cfg.HeartbeatInterval, d.submitMsg,
+			d.ctlMsgs[d.lastWorkerID], d.replyMsg)
+	}
+
+	for i := 0; i < len(active)-numWorkers; i++ {
+		id := active[i]
+		Logger.Info("stopping worker", "workerId", id)
+		d.retiring[id] = true
+		// the worker may be busy reporting, don't block the dispatcher
+		go func(ch chan<- MsgToWorker) {
+			ch <- MsgToWorker{msgType: 4}
+		}(d.ctlMsgs[id])
+	}
+}
+
+// run is the dispatcher loop. The first signal received stops the claiming of new shards
+// and waits up to ShutdownTimeout for the running tasks to complete, a second signal or
+// the timeout aborts them. Returns the exit status.
+func (d *dispatcher) run(sigs <-chan os.Signal, hups <-chan os.Signal) int {
+	// the load of the shard servers is checked in the background
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.monitor.Run(ctx)
+
+	iteration := 0
+	var lastReap time.Time
+	var drainDeadline time.Time
+	draining := false
+	for {
+		// just a generic loop counter
+		iteration++
+
+		if !draining {
+			// Reclaim the shards left behind by dead tasks
+			if time.Since(lastReap) >= reapInterval {
+				reapStaleShards(d.db, d.pool, d.taskName, d.cfg.StaleTaskTimeout, d.policy)
+				lastReap = time.Now()
+			}
+
+			d.readThrottling()
+			d.throttleTasks()
+		}
+
+		// Abort the tasks operators asked to stop
+		d.processAbortRequests()
+
+		d.updateMetrics()
+
+		if draining {
+			if d.onGoing.Len() == 0 {
+				Logger.Info("all tasks completed, exiting")
+				return exitDrained
+			}
+			if time.Now().After(drainDeadline) {
+				Logger.Warn("shutdown timeout reached", "runningTasks", d.onGoing.Len())
+				return d.abortAll()
+			}
+		} else {
+			d.submitTasks()
+		}
+
+		// listen and process messages until the poll interval elapses, the timer is not reset
+		// by every message or frequent heartbeats would starve the loop
+		pollTimeout := time.After(d.cfg.PollInterval)
+		gotTimeout := 0
+		for gotTimeout < 1 { // use gotTimeout to read all messages
+			select {
+			case rmsg := <-d.replyMsg:
+				d.handleMessage(rmsg)
+			case req := <-d.apiReqs:
+				d.handleAPIRequest(req)
+			case <-hups:
+				d.reload()
+			case sig := <-sigs:
+				{
+					if draining {
+						Logger.Warn("received a second signal, aborting the running tasks", "signal", sig.String())
+						return d.abortAll()
+					}
+					Logger.Info("received a signal, waiting for the running tasks", "signal", sig.String(),
+						"timeout", d.cfg.ShutdownTimeout, "runningTasks", d.onGoing.Len())
+					draining = true
+					drainDeadline = time.Now().Add(d.cfg.ShutdownTimeout)
+					gotTimeout = 1
+				}
+			case <-pollTimeout:
+				{
+					gotTimeout = 1
+				}
+			}
+		}
+	}
+}
+
+// readThrottling sets taskLimit from the open maintenance window, if any, then from the
+// throttling file, if present, and last from the concurrency and the pause set through the API
+func (d *dispatcher) readThrottling() {
+	numWorkers := d.cfg.MaxConcurrentDDL
+	newTaskLimit := d.fileLimit
+
+	if d.cfg.Windows.HasGlobal() {
+		newTaskLimit = d.windowTaskLimit(time.Now())
+	}
+
+	// Let's read if the throttling file is present
+	if _, err := os.Stat(d.cfg.ThrottlingFile); !os.IsNotExist(err) {
+		Logger.Debug("throttlingFile exists")
+
+		// Let's open it
+		file, err := os.Open(d.cfg.ThrottlingFile)
+		if err != nil {
+			Logger.Warn("cannot open the throttling file", "error", err)
+		} else {
+			Logger.Debug("throttling file opened")
+
+			// Let's read the first line and try to convert to int
+			scanner := bufio.NewScanner(file)
+			if scanner.Scan() {
+				if limit, err := strconv.Atoi(scanner.Text()); err == nil {
+					newTaskLimit = limit
+					d.fileLimit = limit
+				} else {
+					Logger.Warn("invalid throttling value, ignoring it", "value", scanner.Text())
+				}
+			}
+			file.Close()
+		}
+	}
+
+	if d.concurrency != nil {
+		newTaskLimit = *d.concurrency
+	}
+	// a pause throttles all the running tasks
+	if d.paused {
+		newTaskLimit = 0
+	}
+
+	if newTaskLimit > numWorkers {
+		Logger.Debug("taskLimit capped to numWorkers", "taskLimit", newTaskLimit, "numWorkers", numWorkers)
+		newTaskLimit = numWorkers
+	}
+
+	if newTaskLimit < 0 {
+		Logger.Warn("taskLimit can't be negative, setting it to 0")
+		newTaskLimit = 0
+	}
+
+	d.taskLimit = newTaskLimit
+}
+
+// windowTaskLimit returns the concurrency of the maintenance window open at now, or
+// MaxConcurrentDDL outside the windows
+func (d *dispatcher) windowTaskLimit(now time.Time) int {
+	w := d.cfg.Windows.Active(now, "", nil)
+	name := ""
+	if w != nil {
+		name = w.Name
+	}
+
+	if name != d.window {
+		if d.window != "" {
+			Logger.Info("maintenance window closed", "window", d.window)
+		}
+		if w != nil {
+			Logger.Info("maintenance window open", "window", w.Name, "concurrency", w.Concurrency)
+		}
+		d.window = name
+	}
+
+	if w == nil {
+		return d.cfg.MaxConcurrentDDL
+	}
+	return w.Concurrency
+}
+
+// throttleTasks throttles the running tasks beyond taskLimit, the oldest tasks keep running,
+// and the tasks on the shard servers above the load thresholds. A running sql ddl can't be
+// throttled, it completes anyway.
+func (d *dispatcher) throttleTasks() {
+	n := 0
+	for e := d.onGoing.Back(); e != nil; e = e.Prev() {
+		n++
+		task := e.Value.(Task)
+		key := task.key()
+		throttle, reason := n > d.taskLimit, "beyond the task limit"
+		if !throttle {
+			throttle, reason = d.monitor.Throttled(shardHost(task.shard), task.shard.ShardDSN)
+		}
+
+		if d.throttled[key] == throttle || d.aborting[key] {
+			continue
+		}
+		w, ok := d.runningOn[key]
+		if !ok {
+			// not yet picked up by a worker
+			continue
+		}
+
+		msgType := uint8(6)
+		if throttle {
+			msgType = 5
+		}
+		// never block the dispatcher, if the worker is busy reporting we'll try again later
+		select {
+		case d.ctlMsgs[w] <- MsgToWorker{msgType: msgType, task: task}:
+			task.logger().Info("task throttle changed", "workerId", w, "throttled", throttle, "reason", reason)
+			d.throttled[key] = throttle
+			message := "resumed"
+			if throttle {
+				message = "throttled: " + reason
+			}
+			d.db.AddOpLog(key.shardID, key.version, d.taskName, message, "", "")
+		default:
+		}
+	}
+}
+
+// submitTasks sends the ready versions of the shards already running a task to the workers,
+// then claims shards needing work and sends their ready versions, up to taskLimit. The ready
+// versions of a shard don't depend on each other, they run concurrently. The versions not
+// targeting a shard are skipped first.
+func (d *dispatcher) submitTasks() {
+	// Can we submit jobs?
+	if d.onGoing.Len() >= d.taskLimit {
+		return
+	}
+
+	//Yes, first we need the versions and their dependencies
+	versions, err := d.db.ListVersions()
+	if err != nil {
+		Logger.Error("cannot read the versions", "error", err)
+		return
+	}
+	graph, err := depgraph.New(versions)
+	if err != nil {
+		Logger.Error("invalid version dependencies", "error", err)
+		return
+	}
+	byVersion := make(map[uint32]*models.Version, len(versions))
+	for _, v := range versions {
+		byVersion[v.Version] = v
+	}
+
+	slots, err := d.runningSlots()
+	if err != nil {
+		Logger.Error("cannot count the DDLs running per host", "error", err)
+		return
+	}
+
+	// the shards with a failed or aborted task don't get new tasks, they are released once
+	// their last task ends
+	for _, shardID := range d.shardsRunning() {
+		if _, failed := d.failures[shardID]; failed || d.cancelled[shardID] {
+			continue
+		}
+		shard, err := d.db.GetShard(shardID)
+		if err != nil || shard.TaskName.String != d.taskName || shard.AbortRequested {
+			continue
+		}
+		d.skipVersions(shard, graph)
+		d.startTasks(shard, graph, byVersion, slots, d.taskLimit)
+	}
+	if d.onGoing.Len() >= d.taskLimit {
+		return
+	}
+
+	//then let's claim the shards needing work, in one round trip
+	shards, err := d.claimShards(graph.Max(), slots, d.taskLimit-d.onGoing.Len())
+	if err != nil {
+		Logger.Error("cannot claim shards", "error", err)
+		return
+	}
+
+	// every claimed shard gets a task before the others get their independent versions
+	for _, shardToUpgrade := range shards {
+		// we have a shard!!!
+		Logger.Info("found a shard needing work", "shardId", shardToUpgrade.ShardId)
+
+		if d.skipVersions(shardToUpgrade, graph) {
+			// no version targets the shard
+			continue
+		}
+		if d.startTasks(shardToUpgrade, graph, byVersion, slots, 1) == 0 {
+			Logger.Error("no version ready to apply", "shardId", shardToUpgrade.ShardId)
+			d.db.ReleaseShard(shardToUpgrade.ShardId, d.taskName)
+		}
+	}
+	for _, shardToUpgrade := range shards {
+		d.startTasks(shardToUpgrade, graph, byVersion, slots, d.taskLimit)
+	}
+}
+
+// skipVersions records the ready versions not targeting the shard as applied, and then the
+// versions they make ready, until none is left. The skipped versions are added to the
+// Applied of shard. Returns true if the shard was released: nothing else was ready and it
+// had no running task.
+func (d *dispatcher) skipVersions(shard *models.Shard, graph *depgraph.Graph) bool {
+	skipped := []uint32{}
+	for ready := graph.Skippable(shard); len(ready) > 0; ready = graph.Skippable(shard) {
+		skipped = append(skipped, ready...)
+		shard.Applied = append(shard.Applied, ready...)
+	}
+	if len(skipped) == 0 {
+		return false
+	}
+
+	release := len(graph.Ready(shard)) == 0 && !d.hasShardTasks(shard.ShardId)
+	for i, version := range skipped {
+		var err error
+		if release && i == len(skipped)-1 {
+			err = d.db.ShardUpgradeDone(shard.ShardId, version, d.taskName)
+		} else {
+			err = d.db.ShardVersionApplied(shard.ShardId, version, d.taskName)
+		}
+		if err != nil {
+			Logger.Error("cannot skip the version", "shardId", shard.ShardId, "version", version, "error", err)
+			return false
+		}
+		Logger.Info("version skipped", "shardId", shard.ShardId, "version", version)
+		d.db.AddOpLogRun(shard.ShardId, version, shard.Attempts, d.taskName,
+			fmt.Sprintf("skipped: the target %q doesn't match the groups of the shard %q",
+				graph.Target(version), groups.FormatGroups(shard.Groups)))
+	}
+	return release
+}
+
+// startTasks sends up to n ready versions of a shard, not already running, to the workers
+// without going beyond taskLimit or the limit of the shard server, and while the server is
+// below the load thresholds. Returns the number of tasks sent.
+func (d *dispatcher) startTasks(shard *models.Shard, graph *depgraph.Graph, versions map[uint32]*models.Version,
+	slots hostSlots, n int) int {
+
+	if throttled, _ := d.monitor.Throttled(shardHost(shard), shard.ShardDSN); throttled {
+		return 0
+	}
+	sent := 0
+	for _, version := range graph.Ready(shard) {
+		if sent >= n || d.onGoing.Len() >= d.taskLimit || !slots.free(shard) {
+			break
+		}
+		newTask := Task{name: d.taskName, shard: shard, version: versions[version]}
+		if d.hasTask(newTask.key()) {
+			continue
+		}
+
+		d.onGoing.PushFront(newTask)
+		d.started[newTask.key()] = time.Now()
+
+		// Now, build and send a message to the workers
+		// this should never block since we never go beyond taskLimit
+		d.submitMsg <- MsgToWorker{msgType: 1, task: newTask}
+		slots.take(shard)
+		sent++
+	}
+	return sent
+}
+
+// hasTask returns true if the task is in the onGoing list
+func (d *dispatcher) hasTask(key taskKey) bool {
+	for e := d.onGoing.Front(); e != nil; e = e.Next() {
+		task := e.Value.(Task)
+		if task.key() == key {
+			return true
+		}
+	}
+	return false
+}
+
+// shardsRunning returns the shards of the onGoing tasks, in the order of their oldest task
+func (d *dispatcher) shardsRunning() []uint32 {
+	seen := map[uint32]bool{}
+	shardIDs := []uint32{}
+	for e := d.onGoing.Back(); e != nil; e = e.Prev() {
+		shardID := e.Value.(Task).shard.ShardId
+		if !seen[shardID] {
+			seen[shardID] = true
+			shardIDs = append(shardIDs, shardID)
+		}
+	}
+	return shardIDs
+}
+
+// hasShardTasks returns true if the shard has a task in the onGoing list
+func (d *dispatcher) hasShardTasks(shardID uint32) bool {
+	for e := d.onGoing.Front(); e != nil; e = e.Next() {
+		if e.Value.(Task).shard.ShardId == shardID {
+			return true
+		}
+	}
+	return false
+}
+
+// runningSlots returns the DDLs running per host, against the host limits of now
+func (d *dispatcher) runningSlots() (hostSlots, error) {
+	slots := newHostSlots(newHostLimits(d.cfg, time.Now()))
+	return slots, d.countSlots(slots)
+}
+
+// countSlots counts again the DDLs running per host in slots
+func (d *dispatcher) countSlots(slots hostSlots) error {
+	if !slots.limits.enabled() {
+		return nil
+	}
+	claimed, err := d.db.GetClaimedShards()
+	if err != nil {
+		return err
+	}
+	tasks := make([]Task, 0, d.onGoing.Len())
+	for e := d.onGoing.Front(); e != nil; e = e.Next() {
+		tasks = append(tasks, e.Value.(Task))
+	}
+	slots.count(tasks, claimed, d.taskName)
+	return nil
+}
+
+// claimShards claims up to n shards below maxVersion, without exceeding the per-host limits
+// given the DDLs running in slots, and skipping the shard servers above the load thresholds
+func (d *dispatcher) claimShards(maxVersion uint32, slots hostSlots, n int) ([]*models.Shard, error) {
+	if !slots.limits.enabled() && !d.monitor.Enabled() {
+		return d.db.ClaimShards(maxVersion, d.taskName, n, nil)
+	}
+
+	if slots.limits.enabled() {
+		// the shards claimed by the other dispatchers don't change until the claim is done
+		unlock, err := d.db.LockClaims(claimLockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		if err = d.countSlots(slots); err != nil {
+			return nil, err
+		}
+	}
+
+	// the slots are taken by the tasks started on the claimed shards
+	selection := slots.clone()
+	shardIDs := []uint32{}
+	// the shards on the full or loaded servers are passed over, a window at a time
+	for offset := 0; len(shardIDs) < n; offset += claimWindow {
+		window, err := d.db.GetClaimableShards(maxVersion, offset, claimWindow)
+		if err != nil {
+			return nil, err
+		}
+		// the new work on a loaded server waits until it is back below the thresholds
+		candidates := []*models.Shard{}
+		for _, s := range window {
+			if throttled, _ := d.monitor.Throttled(shardHost(s), s.ShardDSN); !throttled {
+				candidates = append(candidates, s)
+			}
+		}
+		shardIDs = append(shardIDs, selection.selectShards(candidates, n-len(shardIDs))...)
+		if len(window) < claimWindow {
+			break
+		}
+	}
+	if len(shardIDs) == 0 {
+		return nil, nil
+	}
+	// a dispatcher without host limits may have claimed some of them meanwhile, they are skipped
+	return d.db.ClaimShards(maxVersion, d.taskName, n, shardIDs)
+}
+
+// handleMessage processes a message from a worker
+func (d *dispatcher) handleMessage(rmsg MsgFromWorker) {
+	switch rmsg.msgType {
+	case 0:
+		{ //idle  (no impleted yet)
+			Logger.Debug("received an idle message", "workerId", rmsg.workerID)
+		}
+	case 1:
+		{ // running, sent periodically by the workers as a heartbeat
+			// Update the Heartbeat and progress fields of shards
+			rmsg.task.logger().Debug("received a running message", "workerId", rmsg.workerID,
+				"progress", rmsg.progress)
+			d.runningOn[rmsg.task.key()] = rmsg.workerID
+			d.db.UpdateShardTaskHeartbeat(rmsg.task.shard.ShardId, d.taskName, rmsg.progress)
+		}
+	case 2:
+		{ // task done
+			// remove the task from the onGoing list
+			removeTask(d.onGoing, rmsg.task)
+
+			// the task is done, update the shards table. The shard is released with its last task.
+			shardID := rmsg.task.shard.ShardId
+			_, failed := d.failures[shardID]
+			if d.hasShardTasks(shardID) || failed || d.cancelled[shardID] {
+				d.db.ShardVersionApplied(shardID, rmsg.task.version.Version, d.taskName)
+			} else {
+				d.db.ShardUpgradeDone(shardID, rmsg.task.version.Version, d.taskName)
+			}
+
+			if started, ok := d.started[rmsg.task.key()]; ok {
+				d.metrics.ddlDuration.WithLabelValues(rmsg.task.version.CmdType).
+					Observe(time.Since(started).Seconds())
+			}
+		}
+	case 3:
+		{ // task failed
+			rmsg.task.logger().Warn("task failed, look at the oplog table for more details",
+				"workerId", rmsg.workerID, "errClass", rmsg.errClass)
+
+			// the shard is released for a retry, or marked as failed, once its last task ends
+			if _, ok := d.failures[rmsg.task.shard.ShardId]; !ok {
+				d.failures[rmsg.task.shard.ShardId] = taskFailure{task: rmsg.task, errClass: rmsg.errClass}
+			}
+			d.metrics.failures.WithLabelValues(rmsg.errClass).Inc()
+
+			// and remove the task from the onGoing list
+			removeTask(d.onGoing, rmsg.task)
+		}
+	case 4:
+		{ // task cancelled
+			rmsg.task.logger().Info("task cancelled", "workerId", rmsg.workerID)
+
+			// the shard is released once its last task ends, its version is unchanged
+			d.cancelled[rmsg.task.shard.ShardId] = true
+
+			// and remove the task from the onGoing list
+			removeTask(d.onGoing, rmsg.task)
+		}
+	case 5:
+		{ // worker stopped
+			Logger.Info("worker stopped", "workerId", rmsg.workerID)
+			delete(d.ctlMsgs, rmsg.workerID)
+			delete(d.retiring, rmsg.workerID)
+		}
+	}
+
+	if rmsg.msgType >= 2 && rmsg.msgType <= 4 {
+		delete(d.runningOn, rmsg.task.key())
+		delete(d.aborting, rmsg.task.key())
+		delete(d.throttled, rmsg.task.key())
+		delete(d.started, rmsg.task.key())
+		if !d.hasShardTasks(rmsg.task.shard.ShardId) {
+			d.settleShard(rmsg.task.shard.ShardId)
+		}
+	}
+}
+
+// settleShard releases a shard once its last task ended with a failure or a cancellation.
+// After a failure, the shard is released for a retry or marked as failed.
+func (d *dispatcher) settleShard(shardID uint32) {
+	if f, ok := d.failures[shardID]; ok {
+		d.retryOrFail(f.task, f.errClass)
+	} else if d.cancelled[shardID] {
+		d.db.ReleaseShard(shardID, d.taskName)
+	}
+	delete(d.failures, shardID)
+	delete(d.cancelled, shardID)
+}
+
+// retryOrFail releases the shard of a failed task for a later attempt if the error is
+// retryable and the shard has attempts left, otherwise the shard is marked as failed
+func (d *dispatcher) retryOrFail(task Task, errClass string) {
+	shardID := task.shard.ShardId
+	attempts := int(task.shard.Attempts)
+
+	if d.policy.ShouldRetry(errClass, attempts) {
+		delay := d.policy.Delay(attempts)
+		if err := d.db.ShardRetryLater(shardID, d.taskName, delay); err != nil {
+			task.logger().Error("cannot release the shard for a retry", "error", err)
+			return
+		}
+		d.db.AddOpLog(shardID, task.version.Version, d.taskName,
+			fmt.Sprintf("attempt %d of %d failed (%s), retrying in %s",
+				attempts, d.policy.MaxAttempts, errClass, delay), "", "")
+		return
+	}
+
+	if err := d.db.ShardFailed(shardID, d.taskName); err != nil {
+		task.logger().Error("cannot mark the shard as failed", "error", err)
+		return
+	}
+	d.db.AddOpLog(shardID, task.version.Version, d.taskName,
+		fmt.Sprintf("attempt %d of %d failed (%s), shard marked as failed, waiting for an operator",
+			attempts, d.policy.MaxAttempts, errClass), "", "")
+}
+
+// processAbortRequests sends an abort to the workers running the tasks flagged in the shards table
+func (d *dispatcher) processAbortRequests() {
+	abortRequests, err := d.db.GetAbortRequests(d.taskName)
+	if err != nil {
+		Logger.Error("cannot read the abort requests", "error", err)
+		return
+	}
+
+	for _, shardID := range abortRequests {
+		d.abortTask(shardID)
+	}
+}
+
+// abortTask sends an abort to the workers running the tasks of the shard. Returns false if
+// an abort couldn't be sent yet, in that case it must be sent again later.
+func (d *dispatcher) abortTask(shardID uint32) bool {
+	sent := true
+	for e := d.onGoing.Front(); e != nil; e = e.Next() {
+		task := e.Value.(Task)
+		if task.shard.ShardId != shardID || d.aborting[task.key()] {
+			continue
+		}
+
+		w, ok := d.runningOn[task.key()]
+		if !ok {
+			// not yet picked up by a worker
+			sent = false
+			continue
+		}
+		// never block the dispatcher, if the worker is busy reporting we'll try again later
+		select {
+		case d.ctlMsgs[w] <- MsgToWorker{msgType: 3, task: task}:
+			task.logger().Info("aborting the task", "workerId", w)
+			d.aborting[task.key()] = true
+		default:
+			sent = false
+		}
+	}
+	return sent
+}
+
+// abortAll aborts all the running tasks, waits up to abortTimeout for the workers to report
+// and then releases all the shards still claimed. Returns the exit status.
+func (d *dispatcher) abortAll() int {
+	// first, take back the tasks not yet picked up by a worker
+	for pending := true; pending; {
+		select {
+		case msg := <-d.submitMsg:
+			removeTask(d.onGoing, msg.task)
+			d.cancelled[msg.task.shard.ShardId] = true
+			if !d.hasShardTasks(msg.task.shard.ShardId) {
+				d.settleShard(msg.task.shard.ShardId)
+			}
+		default:
+			pending = false
+		}
+	}
+
+	deadline := time.Now().Add(abortTimeout)
+	for d.onGoing.Len() > 0 && time.Now().Before(deadline) {
+		for e := d.onGoing.Front(); e != nil; e = e.Next() {
+			d.abortTask(e.Value.(Task).shard.ShardId)
+		}
+
+		select {
+		case rmsg := <-d.replyMsg:
+			d.handleMessage(rmsg)
+		case <-time.After(time.Second * 1):
+		}
+	}
+
+	if d.onGoing.Len() > 0 {
+		Logger.Warn("tasks did not report after the abort", "runningTasks", d.onGoing.Len())
+	}
+
+	// whatever is left claimed by this process is released
+	if err := d.db.ReleaseTaskShards(d.taskName); err != nil {
+		Logger.Error("cannot release the shards of the task", "task", d.taskName, "error", err)
+	}
+
+	return exitAborted
+}
+
+// removeTask removes the task from the onGoing list
+func removeTask(onGoing *list.List, task Task) {
+	for e := onGoing.Front(); e != nil; e = e.Next() {
+		if t := e.Value.(Task); t.key() == task.key() {
+			onGoing.Remove(e)
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/config"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+// submitted returns the tasks sent to the workers by submitTasks
+func submitted(d *dispatcher) []Task {
+	tasks := []Task{}
+	for {
+		select {
+		case msg := <-d.submitMsg:
+			tasks = append(tasks, msg.task)
+		default:
+			return tasks
+		}
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	store := database.NewMemoryStore()
+	store.Now = func() time.Time { return now }
+
+	_, err := store.AddVersion(&models.Version{Command: "ALTER TABLE t1 ADD c2 INT", TableName: "t1", CmdType: "sql"})
+	tu.Ok(t, err)
+	for _, name := range []string{"shard_1", "shard_2", "shard_3"} {
+		_, err := store.AddShard(name, "user:pass@tcp(10.2.2.1:3306)/", 0)
+		tu.Ok(t, err)
+	}
+
+	cfg := &config.Config{MaxConcurrentDDL: 2, MaxAttempts: 2, RetryBackoff: time.Minute,
+		RetryMaxBackoff: time.Hour, RetryableErrors: []string{"deadlock"}}
+	d := newDispatcher("", cfg, store, nil, "host:000001")
+
+	// the task limit is respected
+	d.submitTasks()
+	tasks := submitted(d)
+	tu.Equals(t, 2, len(tasks))
+	tu.Equals(t, uint32(1), tasks[0].shard.ShardId)
+	tu.Equals(t, uint32(2), tasks[1].shard.ShardId)
+	tu.Equals(t, uint32(1), tasks[0].version.Version)
+
+	// done, the shard is at the new version
+	d.handleMessage(MsgFromWorker{msgType: 2, task: tasks[0], workerID: 1})
+	shard, err := store.GetShard(1)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(1), shard.Version)
+	tu.Assert(t, !shard.TaskName.Valid, "shard 1 is released")
+
+	// a retryable error, the shard waits for the backoff
+	d.handleMessage(MsgFromWorker{msgType: 3, task: tasks[1], workerID: 2, errClass: "deadlock"})
+	shard, err = store.GetShard(2)
+	tu.Ok(t, err)
+	tu.Equals(t, models.NullTime{Time: now.Add(time.Minute), Valid: true}, shard.RetryAfter)
+	entries, err := store.GetOpLog(2, 1, false)
+	tu.Ok(t, err)
+	tu.Equals(t, "attempt 1 of 2 failed (deadlock), retrying in 1m0s", entries[0].Message.String)
+	tu.Equals(t, 0, d.onGoing.Len())
+
+	d.submitTasks()
+	tasks = submitted(d)
+	tu.Equals(t, 1, len(tasks))
+	tu.Equals(t, uint32(3), tasks[0].shard.ShardId)
+
+	// an error not retried, the shard waits for an operator
+	d.handleMessage(MsgFromWorker{msgType: 3, task: tasks[0], workerID: 1, errClass: "syntax"})
+	shard, err = store.GetShard(3)
+	tu.Ok(t, err)
+	tu.Assert(t, shard.Failed, "shard 3 is marked as failed")
+
+	// after the backoff, shard 2 gets its last attempt
+	now = now.Add(time.Minute)
+	d.submitTasks()
+	tasks = submitted(d)
+	tu.Equals(t, 1, len(tasks))
+	tu.Equals(t, uint32(2), tasks[0].shard.ShardId)
+	tu.Equals(t, uint8(2), tasks[0].shard.Attempts)
+
+	d.handleMessage(MsgFromWorker{msgType: 3, task: tasks[0], workerID: 2, errClass: "deadlock"})
+	shard, err = store.GetShard(2)
+	tu.Ok(t, err)
+	tu.Assert(t, shard.Failed, "shard 2 is marked as failed after its last attempt")
+
+	d.submitTasks()
+	tu.Equals(t, 0, len(submitted(d)))
+}
+
+func TestDispatcherHostLimits(t *testing.T) {
+	store := database.NewMemoryStore()
+	for _, table := range []string{"t1", "t2"} {
+		_, err := store.AddVersion(&models.Version{Command: "ADD c2 INT", TableName: table, CmdType: "sql"})
+		tu.Ok(t, err)
+	}
+	for _, name := range []string{"shard_1", "shard_2"} {
+		_, err := store.AddShard(name, "user:pass@tcp(10.2.2.1:3306)/", 0)
+		tu.Ok(t, err)
+	}
+
+	cfg := &config.Config{MaxConcurrentDDL: 4, MaxConcurrentDDLPerHost: 2, MaxAttempts: 1}
+	d := newDispatcher("", cfg, store, nil, "host:000001")
+
+	// the independent versions of a shard count against the limit of the server
+	d.submitTasks()
+	tasks := submitted(d)
+	tu.Equals(t, 2, len(tasks))
+	tu.Equals(t, taskKey{shardID: 1, version: 1}, tasks[0].key())
+	tu.Equals(t, taskKey{shardID: 2, version: 1}, tasks[1].key())
+
+	// shard 1 is released with its last task, the free slot goes to the running shard 2
+	d.handleMessage(MsgFromWorker{msgType: 2, task: tasks[0], workerID: 1})
+	d.submitTasks()
+	tasks = submitted(d)
+	tu.Equals(t, 1, len(tasks))
+	tu.Equals(t, taskKey{shardID: 2, version: 2}, tasks[0].key())
+}
+
+func TestDispatcherClaimWindows(t *testing.T) {
+	store := database.NewMemoryStore()
+	_, err := store.AddVersion(&models.Version{Command: "ADD c2 INT", TableName: "t1", CmdType: "sql"})
+	tu.Ok(t, err)
+	for i := 0; i < claimWindow; i++ {
+		_, err := store.AddShard(fmt.Sprintf("shard_%d", i+1), "user:pass@tcp(10.2.2.1:3306)/", 0)
+		tu.Ok(t, err)
+	}
+	_, err = store.AddShard("shard_last", "user:pass@tcp(10.2.2.2:3306)/", 0)
+	tu.Ok(t, err)
+
+	cfg := &config.Config{MaxConcurrentDDL: 4, MaxConcurrentDDLPerHost: 1, MaxAttempts: 1}
+	d := newDispatcher("", cfg, store, nil, "host:000001")
+
+	// the shards of the full server fill the first window, the last shard is beyond it
+	d.submitTasks()
+	tasks := submitted(d)
+	tu.Equals(t, 2, len(tasks))
+	tu.Equals(t, uint32(1), tasks[0].shard.ShardId)
+	tu.Equals(t, uint32(claimWindow+1), tasks[1].shard.ShardId)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/config"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/migrate"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/shardconn"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/testutils/harness"
+)
+
+// how long a scenario may take
+const e2eTimeout = 30 * time.Second
+
+// e2eConfig returns a config with short intervals, the throttling file is in the harness dir
+func e2eConfig(h *harness.Harness) *config.Config {
+	return &config.Config{
+		ThrottlingFile:        filepath.Join(h.Dir, "throttle"),
+		MaxConcurrentDDL:      2,
+		StaleTaskTimeout:      time.Minute,
+		HeartbeatInterval:     100 * time.Millisecond,
+		ShutdownTimeout:       10 * time.Second,
+		PollInterval:          100 * time.Millisecond,
+		MaxAttempts:           3,
+		RetryBackoff:          time.Second,
+		RetryMaxBackoff:       time.Second,
+		RetryableErrors:       []string{"connection"},
+		ThrottleCheckInterval: time.Second,
+	}
+}
+
+// startDispatcher runs the dispatcher loop and its workers in the background. The returned
+// function stops the loop like a SIGTERM and returns its exit status, it is called at the
+// end of the test if the test doesn't.
+func startDispatcher(t *testing.T, cfg *config.Config, store database.Store) func() int {
+	pool := shardconn.NewPool(cfg.MaxConcurrentDDL + 1)
+	d := newDispatcher("", cfg, store, pool, "host:000001")
+	d.resizeWorkers(cfg.MaxConcurrentDDL)
+
+	sigs := make(chan os.Signal, 2)
+	status := make(chan int, 1)
+	go func() {
+		status <- d.run(sigs, make(chan os.Signal))
+	}()
+
+	stopped := false
+	stop := func() int {
+		if stopped {
+			return -1
+		}
+		stopped = true
+		defer pool.Close()
+		sigs <- syscall.SIGTERM
+		select {
+		case s := <-status:
+			return s
+		case <-time.After(e2eTimeout):
+			t.Fatal("the dispatcher did not stop")
+			return -1
+		}
+	}
+	t.Cleanup(func() { stop() })
+	return stop
+}
+
+// e2eStores runs a scenario against a MemoryStore and, when SHARDSCHEMA_TEST_DSN is set,
+// against a MySQL database created by the migrations
+func e2eStores(t *testing.T, scenario func(t *testing.T, store database.Store)) {
+	t.Run("memory", func(t *testing.T) {
+		scenario(t, database.NewMemoryStore())
+	})
+	if os.Getenv("SHARDSCHEMA_TEST_DSN") == "" {
+		return
+	}
+	t.Run("mysql", func(t *testing.T) {
+		conn := tu.OpenMySQLDatabase(t, "shardschema_e2e")
+		// closed once the dispatcher is stopped, by the cleanup of startDispatcher
+		t.Cleanup(func() { conn.Close() })
+		_, err := migrate.Up(conn)
+		tu.Ok(t, err)
+		scenario(t, database.NewDatabase(conn))
+	})
+}
+
+// executing returns true if an --execute run of the fake pt-osc started on schema
+func executing(h *harness.Harness, schema string) bool {
+	return h.HasCall(schema, "run: --execute")
+}
+
+func TestE2EApply(t *testing.T) {
+	e2eStores(t, testE2EApply)
+}
+
+func testE2EApply(t *testing.T, store database.Store) {
+	h := harness.New(t, store)
+	v1 := h.AddVersion("t1", "ADD COLUMN c2 INT")
+	v2 := h.AddVersion("t1", "ADD INDEX idx_c1 (c1)")
+	h.AddShards(3, 0)
+	h.Script("shard_1", "progress 50; progress 100")
+
+	stop := startDispatcher(t, e2eConfig(h), store)
+	h.WaitFor(e2eTimeout, "all the shards at version 2", func() bool { return h.AtVersion(v2) })
+	tu.Equals(t, exitDrained, stop())
+
+	h.AssertVersions(map[uint32]uint32{1: v2, 2: v2, 3: v2})
+	for _, version := range []uint32{v1, v2} {
+		h.AssertOpLog(1, version, "starting pt-osc command", "Dry run OK", "starting pt-osc command",
+			"DDL OK", "Completed OK")
+	}
+	calls := h.Calls("shard_1")
+	tu.Equals(t, 6, len(calls))
+	tu.Assert(t, strings.HasPrefix(calls[1], "run: --execute --alter ADD COLUMN c2 INT --pause-file "),
+		"unexpected run %q", calls[1])
+	tu.Equals(t, "completed", calls[2])
+}
+
+func TestE2EDependencies(t *testing.T) {
+	e2eStores(t, testE2EDependencies)
+}
+
+func testE2EDependencies(t *testing.T, store database.Store) {
+	h := harness.New(t, store)
+	v1 := h.AddVersion("t1", "ADD COLUMN c2 INT")
+	v2 := h.AddVersion("t2", "ADD COLUMN c2 INT")
+	// depends on version 1, the previous version on t1
+	v3 := h.AddVersion("t1", "ADD INDEX idx_c2 (c2)")
+	h.AddShards(1, 0)
+	h.Script("shard_1.t1", "copy 2")
+
+	stop := startDispatcher(t, e2eConfig(h), store)
+	// version 2 doesn't wait for version 1, version 3 does
+	h.WaitFor(e2eTimeout, "version 2 applied", func() bool { return h.Shard(1).HasApplied(v2) })
+	tu.Assert(t, !h.Shard(1).HasApplied(v1), "version 1 should still be running")
+	tu.Equals(t, []string{}, h.OpLog(1, v3))
+
+	h.WaitFor(e2eTimeout, "all the shards at version 3", func() bool { return h.AtVersion(v3) })
+	tu.Equals(t, exitDrained, stop())
+	tu.Equals(t, []uint32{}, h.Shard(1).Applied)
+	for _, version := range []uint32{v1, v2, v3} {
+		h.AssertOpLog(1, version, "starting pt-osc command", "Dry run OK", "starting pt-osc command",
+			"DDL OK", "Completed OK")
+	}
+}
+
+func TestE2ETargets(t *testing.T) {
+	e2eStores(t, testE2ETargets)
+}
+
+func testE2ETargets(t *testing.T, store database.Store) {
+	h := harness.New(t, store)
+	v1 := h.AddVersion("t1", "ADD COLUMN c2 INT")
+	v2 := h.AddTargetedVersion("t1", "ADD COLUMN c3 INT", "!archive")
+	// depends on version 2, skipped on the archive shards
+	v3 := h.AddVersion("t1", "ADD INDEX idx_c2 (c2)")
+	v4 := h.AddTargetedVersion("t2", "ADD COLUMN c2 INT", "archive")
+	h.AddShards(2, 0)
+	h.SetGroups(2, "archive", "eu")
+
+	stop := startDispatcher(t, e2eConfig(h), store)
+	h.WaitFor(e2eTimeout, "all the shards at version 4", func() bool { return h.AtVersion(v4) })
+	tu.Equals(t, exitDrained, stop())
+
+	tu.Equals(t, []uint32{}, h.Shard(2).Applied)
+	for _, version := range []uint32{v1, v2, v3} {
+		h.AssertOpLog(1, version, "starting pt-osc command", "Dry run OK", "starting pt-osc command",
+			"DDL OK", "Completed OK")
+	}
+	h.AssertOpLog(1, v4, `skipped: the target "archive" doesn't match the groups of the shard ""`)
+	h.AssertOpLog(2, v2, `skipped: the target "!archive" doesn't match the groups of the shard "archive,eu"`)
+	for _, version := range []uint32{v1, v3, v4} {
+		h.AssertOpLog(2, version, "starting pt-osc command", "Dry run OK", "starting pt-osc command",
+			"DDL OK", "Completed OK")
+	}
+	// a dry run and an execution per applied version
+	tu.Equals(t, 6, strings.Count(strings.Join(h.Calls("shard_1"), "\n"), "run: "))
+	tu.Equals(t, 6, strings.Count(strings.Join(h.Calls("shard_2"), "\n"), "run: "))
+}
+
+func TestE2ERetries(t *testing.T) {
+	e2eStores(t, testE2ERetries)
+}
+
+func testE2ERetries(t *testing.T, store database.Store) {
+	h := harness.New(t, store)
+	v1 := h.AddVersion("t1", "ADD COLUMN c2 INT")
+	h.AddShards(2, 0)
+	// a connection error is retried, an error altering the table is not
+	h.Script("shard_1", "fail 20 Lost connection to MySQL server")
+	h.Script("shard_2", "fail 12 Error altering the new table")
+
+	stop := startDispatcher(t, e2eConfig(h), store)
+	h.WaitFor(e2eTimeout, "shard 1 applied and shard 2 failed", func() bool {
+		return h.Shard(1).Version == v1 && !h.Shard(1).TaskName.Valid && h.Shard(2).Failed
+	})
+	tu.Equals(t, exitDrained, stop())
+
+	h.AssertVersions(map[uint32]uint32{1: v1, 2: 0})
+	tu.Equals(t, uint8(0), h.Shard(1).Attempts)
+	h.AssertOpLog(1, v1, "starting pt-osc command", "Dry run OK", "starting pt-osc command",
+		"Error: command: pt-online-schema-change", "attempt 1 of 3 failed (connection), retrying in 1s",
+		"starting pt-osc command", "Dry run OK", "starting pt-osc command", "DDL OK", "Completed OK")
+	h.AssertOpLog(2, v1, "starting pt-osc command", "Dry run OK", "starting pt-osc command",
+		"Error: command: pt-online-schema-change",
+		"attempt 1 of 3 failed (unknown), shard marked as failed, waiting for an operator")
+}
+
+func TestE2ECrash(t *testing.T) {
+	e2eStores(t, testE2ECrash)
+}
+
+func testE2ECrash(t *testing.T, store database.Store) {
+	h := harness.New(t, store)
+	v1 := h.AddVersion("t1", "ADD COLUMN c2 INT")
+	h.AddShards(2, 0)
+
+	// shard 1 was claimed by a dispatcher that died 10 minutes ago
+	h.ClaimStale(v1, 1, "deadhost:000042", 10*time.Minute)
+
+	// the tool itself gets killed on shard 2
+	h.Script("shard_2", "progress 10; crash")
+
+	stop := startDispatcher(t, e2eConfig(h), store)
+	h.WaitFor(e2eTimeout, "shards 1 and 2 failed", func() bool {
+		return h.Shard(1).Failed && !h.Shard(1).TaskName.Valid && h.Shard(2).Failed
+	})
+	tu.Equals(t, exitDrained, stop())
+
+	// no shard has t1 at version 1, the reaper can't tell if the DDL landed on shard 1
+	h.AssertOpLog(1, v1, "reaper: stale task deadhost:000042, no shard with table t1 at version 1 to compare with, "+
+		"cannot tell if version 1 was applied, shard marked as failed")
+	tu.Equals(t, 0, len(h.Calls("shard_1")))
+	h.AssertOpLog(2, v1, "starting pt-osc command", "Dry run OK", "starting pt-osc command",
+		"Error: command: pt-online-schema-change",
+		"attempt 1 of 3 failed (unknown), shard marked as failed, waiting for an operator")
+	tu.Equals(t, "crashed", h.Calls("shard_2")[2])
+}
+
+func TestE2EThrottling(t *testing.T) {
+	e2eStores(t, testE2EThrottling)
+}
+
+func testE2EThrottling(t *testing.T, store database.Store) {
+	h := harness.New(t, store)
+	v1 := h.AddVersion("t1", "ADD COLUMN c2 INT")
+	h.AddShards(2, 0)
+	h.Script("shard_1", "copy 5")
+	h.Script("shard_2", "copy 5")
+
+	cfg := e2eConfig(h)
+	setLimit := func(limit string) {
+		tu.Ok(t, ioutil.WriteFile(cfg.ThrottlingFile, []byte(limit+"\n"), 0644))
+	}
+
+	// nothing is claimed while the throttling file is at 0
+	setLimit("0")
+	startDispatcher(t, cfg, store)
+	time.Sleep(time.Second)
+	tu.Equals(t, []string{}, h.Calls("shard_1"))
+	tu.Equals(t, []string{}, h.Calls("shard_2"))
+
+	setLimit("2")
+	h.WaitFor(e2eTimeout, "both shards running", func() bool {
+		return executing(h, "shard_1") && executing(h, "shard_2")
+	})
+
+	// one of the running tasks goes beyond the limit, its pt-osc is paused
+	setLimit("1")
+	paused := ""
+	h.WaitFor(e2eTimeout, "a paused pt-osc", func() bool {
+		for _, schema := range []string{"shard_1", "shard_2"} {
+			if h.HasCall(schema, "paused") {
+				paused = schema
+			}
+		}
+		return paused != ""
+	})
+
+	setLimit("2")
+	h.WaitFor(e2eTimeout, "the pt-osc resumed", func() bool { return h.HasCall(paused, "resumed") })
+	h.WaitFor(e2eTimeout, "all the shards at version 1", func() bool { return h.AtVersion(v1) })
+
+	shardID := uint32(1)
+	if paused == "shard_2" {
+		shardID = 2
+	}
+	h.AssertOpLog(shardID, v1, "starting pt-osc command", "Dry run OK", "starting pt-osc command",
+		"throttled: beyond the task limit", "resumed", "DDL OK", "Completed OK")
+}
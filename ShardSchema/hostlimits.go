@@ -0,0 +1,140 @@
+package main
+
+import (
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/config"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/schedule"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/shardconn"
+)
+
+// how many claimable shards the dispatcher reads at once to find hosts below their limit
+const claimWindow = 500
+
+// how long a dispatcher waits for the others to claim their shards, see Store.LockClaims
+const claimLockTimeout = 10 * time.Second
+
+// hostLimits caps the number of concurrent DDLs per shard server
+type hostLimits struct {
+	perHost   int            // 0 for no limit
+	overrides map[string]int // by host, see shardconn.Host
+	windows   schedule.Windows
+	now       time.Time // when the maintenance windows are checked
+}
+
+func newHostLimits(cfg *config.Config, now time.Time) hostLimits {
+	return hostLimits{perHost: cfg.MaxConcurrentDDLPerHost, overrides: cfg.HostConcurrentDDL,
+		windows: cfg.Windows, now: now}
+}
+
+// enabled returns false if no host is limited
+func (h hostLimits) enabled() bool {
+	return h.perHost > 0 || len(h.overrides) > 0 || h.windows.HasScoped()
+}
+
+// limit returns the maximum number of concurrent DDLs on the server of shard, -1 for no
+// limit. An open maintenance window of the server, or of a group of shard, can only lower
+// the limit.
+func (h hostLimits) limit(shard *models.Shard) int {
+	host := shardHost(shard)
+	l := -1
+	if o, ok := h.overrides[host]; ok {
+		l = o
+	} else if h.perHost > 0 {
+		l = h.perHost
+	}
+
+	if w := h.windows.Active(h.now, host, shard.Groups); w != nil && (l < 0 || w.Concurrency < l) {
+		l = w.Concurrency
+	}
+	return l
+}
+
+// hostSlots counts the DDLs running per host against the host limits, as the tasks start
+type hostSlots struct {
+	limits  hostLimits
+	running map[string]int // nil when no host is limited
+}
+
+// newHostSlots returns the slots of limits, see count
+func newHostSlots(limits hostLimits) hostSlots {
+	if !limits.enabled() {
+		return hostSlots{limits: limits}
+	}
+	return hostSlots{limits: limits, running: map[string]int{}}
+}
+
+// count counts again the DDLs of the tasks of this dispatcher, taskName, and of the shards
+// claimed by the other dispatchers. The tasks of the other dispatchers aren't known, their
+// shards count as one DDL each.
+func (h hostSlots) count(tasks []Task, claimed []*models.Shard, taskName string) {
+	if h.running == nil {
+		return
+	}
+	for host := range h.running {
+		delete(h.running, host)
+	}
+	for _, task := range tasks {
+		h.running[shardHost(task.shard)]++
+	}
+	for _, s := range claimed {
+		if s.TaskName.String != taskName {
+			h.running[shardHost(s)]++
+		}
+	}
+}
+
+// clone returns a copy of the slots, taking its slots leaves h unchanged
+func (h hostSlots) clone() hostSlots {
+	c := hostSlots{limits: h.limits}
+	if h.running != nil {
+		c.running = make(map[string]int, len(h.running))
+		for host, count := range h.running {
+			c.running[host] = count
+		}
+	}
+	return c
+}
+
+// free returns true if one more DDL can run on shard
+func (h hostSlots) free(shard *models.Shard) bool {
+	if h.running == nil {
+		return true
+	}
+	l := h.limits.limit(shard)
+	return l < 0 || h.running[shardHost(shard)] < l
+}
+
+// take counts a DDL started on shard
+func (h hostSlots) take(shard *models.Shard) {
+	if h.running != nil {
+		h.running[shardHost(shard)]++
+	}
+}
+
+// selectShards returns the ids of up to n candidates, in order, whose first DDL can run
+// without exceeding the limits of their host, and takes their slots
+func (h hostSlots) selectShards(candidates []*models.Shard, n int) []uint32 {
+	shardIDs := []uint32{}
+	for _, s := range candidates {
+		if len(shardIDs) >= n {
+			break
+		}
+		if !h.free(s) {
+			continue
+		}
+		h.take(s)
+		shardIDs = append(shardIDs, s.ShardId)
+	}
+	return shardIDs
+}
+
+// shardHost returns the server of the shard, the DSN itself if it can't be parsed
+func shardHost(s *models.Shard) string {
+	host, err := shardconn.Host(s.ShardDSN)
+	if err != nil {
+		return s.ShardDSN
+	}
+	return host
+}
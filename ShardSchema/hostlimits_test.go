@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/schedule"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestSelectShards(t *testing.T) {
+	shard := func(id uint32, dsn string) *models.Shard {
+		return &models.Shard{ShardId: id, ShardDSN: dsn}
+	}
+	h1 := "user:pass@tcp(10.2.2.1:3306)"
+	h2 := "user:pass@tcp(10.2.2.2)"
+	h3 := "user:pass@tcp(10.2.2.3:3306)"
+
+	candidates := []*models.Shard{shard(1, h1), shard(2, h1), shard(3, h2), shard(4, h2), shard(5, h3),
+		shard(6, h1)}
+	claimed := []*models.Shard{shard(10, h1)}
+	claimed[0].TaskName = sql.NullString{String: "other:000002", Valid: true}
+
+	h := hostLimits{perHost: 2, overrides: map[string]int{"10.2.2.3:3306": 0}}
+	tu.Assert(t, h.enabled(), "limits are enabled")
+	// 10.2.2.1 already runs a DDL and 10.2.2.3 is disabled
+	slots := newHostSlots(h)
+	slots.count(nil, claimed, "host:000001")
+	tu.Equals(t, []uint32{1, 3, 4}, slots.clone().selectShards(candidates, 5))
+	tu.Equals(t, []uint32{1, 3}, slots.clone().selectShards(candidates, 2))
+	// the selected shards take their slots
+	selection := slots.clone()
+	tu.Equals(t, []uint32{1}, selection.selectShards(candidates, 1))
+	tu.Equals(t, []uint32{3, 4}, selection.selectShards(candidates, 5))
+
+	// the tasks of the dispatcher count, not its claimed shards
+	own := shard(11, h2)
+	own.TaskName = sql.NullString{String: "host:000001", Valid: true}
+	tasks := []Task{{shard: own, version: &models.Version{Version: 1}},
+		{shard: own, version: &models.Version{Version: 2}}}
+	slots = newHostSlots(h)
+	slots.count(tasks, append(claimed, own), "host:000001")
+	tu.Equals(t, []uint32{1}, slots.clone().selectShards(candidates, 5))
+	tu.Assert(t, !slots.free(shard(0, h2)), "10.2.2.2 runs 2 DDLs")
+	tu.Assert(t, slots.free(shard(0, h1)), "10.2.2.1 runs 1 DDL")
+	slots.take(shard(0, h1))
+	tu.Assert(t, !slots.free(shard(0, h1)), "10.2.2.1 runs 2 DDLs")
+
+	h = hostLimits{overrides: map[string]int{"10.2.2.2:3306": 1}}
+	slots = newHostSlots(h)
+	slots.count(nil, claimed, "host:000001")
+	tu.Equals(t, []uint32{1, 2, 3, 5, 6}, slots.clone().selectShards(candidates, 10))
+
+	h = hostLimits{overrides: map[string]int{}}
+	tu.Assert(t, !h.enabled(), "no limits")
+	tu.Equals(t, -1, h.limit(shard(0, h1)))
+	tu.Assert(t, newHostSlots(h).free(shard(0, h1)), "no limits")
+
+	// 10.2.2.1 only runs one DDL at night
+	nightly, err := schedule.NewWindow("nightly", "0 22 * * *", 8*time.Hour, 1, time.UTC, "10.2.2.1:3306", "")
+	tu.Ok(t, err)
+	h = hostLimits{perHost: 2, overrides: map[string]int{}, windows: schedule.Windows{nightly},
+		now: time.Date(2020, 1, 15, 23, 0, 0, 0, time.UTC)}
+	tu.Equals(t, 1, h.limit(shard(0, h1)))
+	tu.Equals(t, 2, h.limit(shard(0, h2)))
+	slots = newHostSlots(h)
+	slots.count(nil, claimed, "host:000001")
+	tu.Equals(t, []uint32{3, 4, 5}, slots.clone().selectShards(candidates, 5))
+
+	// the premium shards don't run any DDL at night
+	premium, err := schedule.NewWindow("premium", "0 22 * * *", 8*time.Hour, 0, time.UTC, "", "premium")
+	tu.Ok(t, err)
+	h.windows = append(h.windows, premium)
+	candidates[2].Groups = []string{"eu", "premium"}
+	tu.Equals(t, 0, h.limit(candidates[2]))
+	tu.Equals(t, 2, h.limit(candidates[3]))
+	slots = newHostSlots(h)
+	slots.count(nil, claimed, "host:000001")
+	tu.Equals(t, []uint32{4, 5}, slots.clone().selectShards(candidates, 5))
+
+	h.now = time.Date(2020, 1, 15, 12, 0, 0, 0, time.UTC)
+	tu.Equals(t, 2, h.limit(shard(0, h1)))
+	tu.Equals(t, 2, h.limit(candidates[2]))
+}
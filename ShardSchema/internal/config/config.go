@@ -2,19 +2,56 @@ package config
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/groups"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/logging"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/schedule"
 	ini "gopkg.in/ini.v1"
 )
 
+// prefix of the sections defining the maintenance windows, like [window nightly]
+const windowSection = "window "
+
 type Config struct {
-	Host             string
-	Port             int
-	User             string
-	Password         string
-	DBName           string
-	ThrottlingFile   string
-	MaxConcurrentDDL int
+	Host              string
+	Port              int
+	User              string
+	Password          string
+	DBName            string
+	ThrottlingFile    string
+	MaxConcurrentDDL  int
+	StaleTaskTimeout  time.Duration // shards claimed by a task without heartbeat for that long are reclaimed
+	HeartbeatInterval time.Duration // how often the workers report the progress of a running task
+	ShutdownTimeout   time.Duration // how long to wait for the running tasks on shutdown before aborting them
+	PollInterval      time.Duration // how long the dispatcher waits for messages between iterations
+	MaxAttempts       int           // attempts of a version on a shard before it is marked as failed
+	RetryBackoff      time.Duration // delay before retrying a failed DDL, doubled at each attempt
+	RetryMaxBackoff   time.Duration // upper bound of the delay before retrying
+	RetryableErrors   []string      // classes of errors that are retried, see the retry package
+	// concurrent DDLs per shard server, 0 for no limit other than MaxConcurrentDDL
+	MaxConcurrentDDLPerHost int
+	// per-host overrides of MaxConcurrentDDLPerHost, by host:port or socket, 0 disables the host
+	HostConcurrentDDL map[string]int
+	// load thresholds of the shard servers above which their work is throttled, 0 disables them
+	ThrottleThreadsRunning int
+	ThrottleReplicationLag time.Duration
+	ThrottleHistoryLength  int
+	ThrottleHeartbeatTable string        // pt-heartbeat table measuring the lag, SHOW SLAVE STATUS if empty
+	ThrottleCheckInterval  time.Duration // how often the metrics of the shard servers are read
+	// maintenance windows setting the concurrency while open, for all the shards or per host
+	Windows    schedule.Windows
+	HTTPListen string // address of the HTTP API, like 127.0.0.1:8080, disabled if empty
+	HTTPToken  string // bearer token required by the HTTP API
+	LogLevel   string // debug, info, warn or error
+	LogOutput  string // stderr, syslog or the path of a log file
+	LogFormat  string // text or json
+	LogMaxSize int    // size of the log file before it is rotated, in MB, 0 to never rotate it
+	// rotated log files kept
+	LogMaxFiles int
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -24,13 +61,31 @@ func LoadConfig(filename string) (*Config, error) {
 	}
 
 	cfg := &Config{
-		Host:             rawcfg.Section("").Key("host").Value(),
-		User:             rawcfg.Section("").Key("user").Value(),
-		Password:         rawcfg.Section("").Key("password").Value(),
-		ThrottlingFile:   rawcfg.Section("").Key("throttlingfile").Value(),
-		DBName:           rawcfg.Section("").Key("dbname").Value(),
-		Port:             3306,
-		MaxConcurrentDDL: 2,
+		Host:                   rawcfg.Section("").Key("host").Value(),
+		User:                   rawcfg.Section("").Key("user").Value(),
+		Password:               rawcfg.Section("").Key("password").Value(),
+		ThrottlingFile:         rawcfg.Section("").Key("throttlingfile").Value(),
+		DBName:                 rawcfg.Section("").Key("dbname").Value(),
+		Port:                   3306,
+		MaxConcurrentDDL:       2,
+		StaleTaskTimeout:       30 * time.Minute,
+		HeartbeatInterval:      30 * time.Second,
+		ShutdownTimeout:        10 * time.Minute,
+		PollInterval:           time.Second,
+		MaxAttempts:            3,
+		RetryBackoff:           time.Minute,
+		RetryMaxBackoff:        time.Hour,
+		RetryableErrors:        []string{"lock_wait_timeout", "deadlock"},
+		HostConcurrentDDL:      map[string]int{},
+		ThrottleHeartbeatTable: rawcfg.Section("").Key("throttleheartbeattable").Value(),
+		ThrottleCheckInterval:  10 * time.Second,
+		HTTPListen:             rawcfg.Section("").Key("httplisten").Value(),
+		HTTPToken:              rawcfg.Section("").Key("httptoken").Value(),
+		LogLevel:               rawcfg.Section("").Key("loglevel").MustString("info"),
+		LogOutput:              rawcfg.Section("").Key("logoutput").MustString("stderr"),
+		LogFormat:              rawcfg.Section("").Key("logformat").MustString("text"),
+		LogMaxSize:             100,
+		LogMaxFiles:            5,
 	}
 
 	if cfg.Host == "" {
@@ -41,6 +96,24 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, fmt.Errorf("user cannot be empty")
 	}
 
+	// the API can abort tasks, it is never left open
+	if cfg.HTTPListen != "" && cfg.HTTPToken == "" {
+		return nil, fmt.Errorf("httpToken cannot be empty when httpListen is set")
+	}
+
+	if _, err := logging.ParseLevel(cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return nil, fmt.Errorf("invalid logFormat %q, expecting text or json", cfg.LogFormat)
+	}
+	if logMaxSize, err := rawcfg.Section("").Key("logmaxsize").Int(); err == nil && logMaxSize >= 0 {
+		cfg.LogMaxSize = logMaxSize
+	}
+	if logMaxFiles, err := rawcfg.Section("").Key("logmaxfiles").Int(); err == nil && logMaxFiles >= 0 {
+		cfg.LogMaxFiles = logMaxFiles
+	}
+
 	if port, err := rawcfg.Section("").Key("port").Int(); err == nil {
 		cfg.Port = port
 	}
@@ -52,9 +125,177 @@ func LoadConfig(filename string) (*Config, error) {
 		cfg.MaxConcurrentDDL = 1
 	}
 
+	if staleTaskTimeout, err := rawcfg.Section("").Key("staletasktimeout").Duration(); err == nil {
+		cfg.StaleTaskTimeout = staleTaskTimeout
+	}
+	if cfg.StaleTaskTimeout < time.Minute {
+		cfg.StaleTaskTimeout = time.Minute
+	}
+
+	if heartbeatInterval, err := rawcfg.Section("").Key("heartbeatinterval").Duration(); err == nil {
+		cfg.HeartbeatInterval = heartbeatInterval
+	}
+	if cfg.HeartbeatInterval < time.Second {
+		cfg.HeartbeatInterval = time.Second
+	}
+	// a running task must heartbeat several times before being considered stale
+	if cfg.HeartbeatInterval*3 > cfg.StaleTaskTimeout {
+		return nil, fmt.Errorf("heartbeatInterval (%s) must be less than a third of staleTaskTimeout (%s)",
+			cfg.HeartbeatInterval, cfg.StaleTaskTimeout)
+	}
+
+	if shutdownTimeout, err := rawcfg.Section("").Key("shutdowntimeout").Duration(); err == nil {
+		cfg.ShutdownTimeout = shutdownTimeout
+	}
+	if cfg.ShutdownTimeout < 0 {
+		cfg.ShutdownTimeout = 0
+	}
+
+	if pollInterval, err := rawcfg.Section("").Key("pollinterval").Duration(); err == nil {
+		cfg.PollInterval = pollInterval
+	}
+	if cfg.PollInterval < 100*time.Millisecond {
+		cfg.PollInterval = 100 * time.Millisecond
+	}
+
+	if maxAttempts, err := rawcfg.Section("").Key("maxattempts").Int(); err == nil {
+		cfg.MaxAttempts = maxAttempts
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+
+	if retryBackoff, err := rawcfg.Section("").Key("retrybackoff").Duration(); err == nil {
+		cfg.RetryBackoff = retryBackoff
+	}
+	if retryMaxBackoff, err := rawcfg.Section("").Key("retrymaxbackoff").Duration(); err == nil {
+		cfg.RetryMaxBackoff = retryMaxBackoff
+	}
+	if cfg.RetryMaxBackoff < cfg.RetryBackoff {
+		cfg.RetryMaxBackoff = cfg.RetryBackoff
+	}
+
+	// an empty list disables the retries
+	if rawcfg.Section("").HasKey("retryableerrors") {
+		cfg.RetryableErrors = rawcfg.Section("").Key("retryableerrors").Strings(",")
+	}
+
+	if maxPerHost, err := rawcfg.Section("").Key("maxconcurrentddlperhost").Int(); err == nil {
+		cfg.MaxConcurrentDDLPerHost = maxPerHost
+	}
+	if cfg.MaxConcurrentDDLPerHost < 0 {
+		cfg.MaxConcurrentDDLPerHost = 0
+	}
+
+	// a list like 10.2.2.1:3306=3,10.2.2.2:3306=1
+	for _, entry := range rawcfg.Section("").Key("hostconcurrentddl").Strings(",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid hostConcurrentDDL entry %q, expecting host:port=limit", entry)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid hostConcurrentDDL limit in %q", entry)
+		}
+		cfg.HostConcurrentDDL[normalizeHost(parts[0])] = limit
+	}
+
+	if threadsRunning, err := rawcfg.Section("").Key("throttlethreadsrunning").Int(); err == nil {
+		cfg.ThrottleThreadsRunning = threadsRunning
+	}
+	if replicationLag, err := rawcfg.Section("").Key("throttlereplicationlag").Duration(); err == nil {
+		cfg.ThrottleReplicationLag = replicationLag
+	}
+	if historyLength, err := rawcfg.Section("").Key("throttlehistorylength").Int(); err == nil {
+		cfg.ThrottleHistoryLength = historyLength
+	}
+	if cfg.ThrottleThreadsRunning < 0 || cfg.ThrottleReplicationLag < 0 || cfg.ThrottleHistoryLength < 0 {
+		return nil, fmt.Errorf("the throttle thresholds cannot be negative")
+	}
+
+	if checkInterval, err := rawcfg.Section("").Key("throttlecheckinterval").Duration(); err == nil {
+		cfg.ThrottleCheckInterval = checkInterval
+	}
+	if cfg.ThrottleCheckInterval < time.Second {
+		cfg.ThrottleCheckInterval = time.Second
+	}
+
+	for _, section := range rawcfg.Sections() {
+		if !strings.HasPrefix(section.Name(), windowSection) {
+			continue
+		}
+		window, err := loadWindow(section)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Windows = append(cfg.Windows, window)
+	}
+
 	if cfg.ThrottlingFile == "" {
 		cfg.ThrottlingFile = "/tmp/ShardSchema_throttle"
 	}
 
 	return cfg, nil
 }
+
+// loadWindow reads a maintenance window section like:
+//
+//	[window nightly]
+//	schedule=0 22 * * 1-5
+//	duration=8h
+//	concurrency=4
+//	timezone=America/New_York
+//	host=10.2.2.1:3306
+//	group=premium
+//
+// The time zone defaults to the local one and the window applies to all the shards
+// without host nor group. With both, it applies to the shards of the group on the host.
+func loadWindow(section *ini.Section) (*schedule.Window, error) {
+	name := strings.TrimSpace(strings.TrimPrefix(section.Name(), windowSection))
+
+	duration, err := section.Key("duration").Duration()
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration of window %q", name)
+	}
+	concurrency, err := section.Key("concurrency").Int()
+	if err != nil {
+		return nil, fmt.Errorf("invalid concurrency of window %q", name)
+	}
+
+	location := time.Local
+	if tz := section.Key("timezone").Value(); tz != "" {
+		if location, err = time.LoadLocation(tz); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid timezone of window %q", name))
+		}
+	}
+
+	host := ""
+	if section.HasKey("host") {
+		host = normalizeHost(section.Key("host").Value())
+	}
+
+	group := ""
+	if section.HasKey("group") {
+		names, err := groups.ParseGroups(section.Key("group").Value())
+		if err != nil || len(names) != 1 {
+			return nil, fmt.Errorf("invalid group of window %q, expecting a single group name", name)
+		}
+		group = names[0]
+	}
+
+	window, err := schedule.NewWindow(name, section.Key("schedule").Value(), duration, concurrency, location,
+		host, group)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("invalid window %q", name))
+	}
+	return window, nil
+}
+
+// normalizeHost returns a shard server as host:port, adding the default port, or as a socket
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if !strings.HasPrefix(host, "/") && !strings.Contains(host, ":") {
+		host += ":3306"
+	}
+	return host
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
 )
@@ -11,13 +12,28 @@ func TestDefaultValues(t *testing.T) {
 	tu.Ok(t, err)
 
 	want := &Config{
-		Host:             "localhost",
-		Port:             3306,
-		User:             "root",
-		Password:         "",
-		ThrottlingFile:   "/tmp/ShardSchema_throttle",
-		DBName:           "",
-		MaxConcurrentDDL: 2,
+		Host:                  "localhost",
+		Port:                  3306,
+		User:                  "root",
+		Password:              "",
+		ThrottlingFile:        "/tmp/ShardSchema_throttle",
+		DBName:                "",
+		MaxConcurrentDDL:      2,
+		StaleTaskTimeout:      30 * time.Minute,
+		HeartbeatInterval:     30 * time.Second,
+		ShutdownTimeout:       10 * time.Minute,
+		PollInterval:          time.Second,
+		MaxAttempts:           3,
+		RetryBackoff:          time.Minute,
+		RetryMaxBackoff:       time.Hour,
+		RetryableErrors:       []string{"lock_wait_timeout", "deadlock"},
+		HostConcurrentDDL:     map[string]int{},
+		ThrottleCheckInterval: 10 * time.Second,
+		LogLevel:              "info",
+		LogOutput:             "stderr",
+		LogFormat:             "text",
+		LogMaxSize:            100,
+		LogMaxFiles:           5,
 	}
 	tu.Equals(t, cfg, want)
 }
@@ -33,3 +49,85 @@ func TestRequiredValues02(t *testing.T) {
 	tu.NotOk(t, err)
 	tu.Assert(t, cfg == nil, "on errors, config should be nil")
 }
+
+func TestRetryValues(t *testing.T) {
+	cfg, err := LoadConfig("./testdata/config04.ini")
+	tu.Ok(t, err)
+
+	tu.Equals(t, 5, cfg.MaxAttempts)
+	tu.Equals(t, 30*time.Second, cfg.RetryBackoff)
+	tu.Equals(t, 10*time.Minute, cfg.RetryMaxBackoff)
+	tu.Equals(t, []string{"deadlock"}, cfg.RetryableErrors)
+}
+
+func TestHostConcurrentDDL(t *testing.T) {
+	cfg, err := LoadConfig("./testdata/config05.ini")
+	tu.Ok(t, err)
+
+	tu.Equals(t, 2, cfg.MaxConcurrentDDLPerHost)
+	tu.Equals(t, map[string]int{
+		"10.2.2.1:3306":               4,
+		"10.2.2.2:3306":               0,
+		"/var/run/mysqld/mysqld.sock": 1,
+	}, cfg.HostConcurrentDDL)
+
+	cfg, err = LoadConfig("./testdata/config06.ini")
+	tu.NotOk(t, err)
+	tu.Assert(t, cfg == nil, "on errors, config should be nil")
+}
+
+func TestThrottleThresholds(t *testing.T) {
+	cfg, err := LoadConfig("./testdata/config07.ini")
+	tu.Ok(t, err)
+
+	tu.Equals(t, 100, cfg.ThrottleThreadsRunning)
+	tu.Equals(t, 30*time.Second, cfg.ThrottleReplicationLag)
+	tu.Equals(t, 0, cfg.ThrottleHistoryLength)
+	tu.Equals(t, "percona.heartbeat", cfg.ThrottleHeartbeatTable)
+	tu.Equals(t, 5*time.Second, cfg.ThrottleCheckInterval)
+}
+
+func TestWindows(t *testing.T) {
+	cfg, err := LoadConfig("./testdata/config08.ini")
+	tu.Ok(t, err)
+
+	tu.Equals(t, 3, len(cfg.Windows))
+	tu.Equals(t, "business hours", cfg.Windows[0].Name)
+	tu.Equals(t, 8*time.Hour, cfg.Windows[0].Duration)
+	tu.Equals(t, 1, cfg.Windows[0].Concurrency)
+	tu.Equals(t, "America/New_York", cfg.Windows[0].Location.String())
+	tu.Equals(t, "", cfg.Windows[0].Host)
+	tu.Equals(t, "10.2.2.1:3306", cfg.Windows[1].Host)
+	tu.Equals(t, time.Local, cfg.Windows[1].Location)
+	tu.Equals(t, "", cfg.Windows[1].Group)
+	tu.Equals(t, "premium", cfg.Windows[2].Group)
+	tu.Equals(t, "", cfg.Windows[2].Host)
+
+	cfg, err = LoadConfig("./testdata/config09.ini")
+	tu.NotOk(t, err)
+	tu.Assert(t, cfg == nil, "on errors, config should be nil")
+
+	_, err = LoadConfig("./testdata/config13.ini")
+	tu.NotOk(t, err)
+}
+
+func TestHTTPAPI(t *testing.T) {
+	cfg, err := LoadConfig("./testdata/config10.ini")
+	tu.NotOk(t, err)
+	tu.Assert(t, cfg == nil, "on errors, config should be nil")
+}
+
+func TestLogging(t *testing.T) {
+	cfg, err := LoadConfig("./testdata/config11.ini")
+	tu.Ok(t, err)
+
+	tu.Equals(t, "debug", cfg.LogLevel)
+	tu.Equals(t, "/var/log/shardschema.log", cfg.LogOutput)
+	tu.Equals(t, "json", cfg.LogFormat)
+	tu.Equals(t, 10, cfg.LogMaxSize)
+	tu.Equals(t, 0, cfg.LogMaxFiles)
+
+	cfg, err = LoadConfig("./testdata/config12.ini")
+	tu.NotOk(t, err)
+	tu.Assert(t, cfg == nil, "on errors, config should be nil")
+}
@@ -1,8 +1,14 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
@@ -11,20 +17,35 @@ import (
 // Database is the Database Abstraction Layer. It holds all the DB related methods
 type Database struct {
 	Conn *sql.DB
+	Log  *slog.Logger
+
+	// sequence of the claims made through this Database, see ClaimShards
+	claimSeq uint32
 }
 
-// NewDatabase initliazes the DB connection using the parameters from the config file
+// NewDatabase initliazes the DB connection using the parameters from the config file. It logs
+// through the default slog logger.
 func NewDatabase(conn *sql.DB) *Database {
-	return &Database{Conn: conn}
+	return &Database{Conn: conn, Log: slog.Default()}
+}
+
+// Close closes the connection pool to the database
+func (d *Database) Close() error {
+	return d.Conn.Close()
 }
 
 // AddOpLog inserts an Oplog entry
 func (d *Database) AddOpLog(shardID uint32, version uint32, taskName string, message string, stdout string, stderr string) error {
-	res, err := d.Conn.Exec("INSERT INTO oplog (shardId, version, seq, taskName, message, output, err) "+
-		"SELECT ?, ?, (SELECT COALESCE(MAX(seq),0)+1 FROM oplog WHERE shardId = 1 AND version=1),"+
-		"?, ?, ?, ?", shardID, version, taskName, message, stdout, stderr)
+	// run is the attempt of the version on the shard the entry belongs to
+	res, err := d.Conn.Exec("INSERT INTO oplog (shardId, version, seq, run, taskName, message, output, err) "+
+		"SELECT ?, ?, (SELECT COALESCE(MAX(seq),0)+1 FROM oplog WHERE shardId = ? AND version = ?),"+
+		"(SELECT COALESCE(MAX(attempts),0) FROM shards WHERE shardId = ?),"+
+		"?, ?, ?, ?", shardID, version, shardID, version, shardID, taskName, message, stdout, stderr)
 
 	if err != nil {
+		// most callers can't do anything about it, the entry is at least in the log
+		d.Log.Error("cannot insert an oplog entry", "shardId", shardID, "version", version, "task", taskName,
+			"message", message, "error", err)
 		return errors.Wrap(err, "Can't insert a row  in the opLog table")
 	}
 
@@ -35,6 +56,20 @@ func (d *Database) AddOpLog(shardID uint32, version uint32, taskName string, mes
 	return nil
 }
 
+// AddOpLogRun inserts an Oplog entry of the attempt run, for the entries written once the
+// claim of the shard was released and its attempts reset or given back
+func (d *Database) AddOpLogRun(shardID uint32, version uint32, run uint8, taskName string, message string) error {
+	_, err := d.Conn.Exec("INSERT INTO oplog (shardId, version, seq, run, taskName, message, output, err) "+
+		"SELECT ?, ?, (SELECT COALESCE(MAX(seq),0)+1 FROM oplog WHERE shardId = ? AND version = ?), ?, ?, ?, '', ''",
+		shardID, version, shardID, version, run, taskName, message)
+	if err != nil {
+		d.Log.Error("cannot insert an oplog entry", "shardId", shardID, "version", version, "task", taskName,
+			"message", message, "error", err)
+		return errors.Wrap(err, "Can't insert a row  in the opLog table")
+	}
+	return nil
+}
+
 // GetMaxVersion returns the highest current version
 func (d *Database) GetMaxVersion() (uint32, error) {
 	var version uint32
@@ -58,13 +93,28 @@ func (d *Database) GetNextVersion(version uint32) (*models.Version, error) {
 	return d.GetVersion(lVersion)
 }
 
+// columns read by scanVersion
+const versionColumns = "`version`, `command`, `tableName`, `cmdType`, `validationQuery`, " +
+	"`validationAnswer`, `options`, `dependsOn`, `target`, `lastUpdate`"
+
+// scanVersion reads a Version from a row made of versionColumns
+func scanVersion(row scanner) (*models.Version, error) {
+	v := &models.Version{}
+	err := row.Scan(&v.Version, &v.Command, &v.TableName, &v.CmdType, &v.ValidationQuery,
+		&v.ValidationAnswer, &v.Options, &v.DependsOn, &v.Target, &v.LastUpdate)
+
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
 // GetVersion returns a Version struct of a given version
 func (d *Database) GetVersion(version uint32) (*models.Version, error) {
 	//Logger.Println("getVersion for version = " + strconv.Itoa(version))
-	v := &models.Version{}
-	query := "SELECT `version`, `command`, `tableName`, `cmdType`, `lastUpdate` FROM `versions` WHERE `version` = ?"
-	if err := d.Conn.QueryRow(query, version).
-		Scan(&v.Version, &v.Command, &v.TableName, &v.CmdType, &v.LastUpdate); err != nil {
+	query := "SELECT " + versionColumns + " FROM `versions` WHERE `version` = ?"
+	v, err := scanVersion(d.Conn.QueryRow(query, version))
+	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("cannot get version %d from the db", version))
 	}
 
@@ -73,71 +123,649 @@ func (d *Database) GetVersion(version uint32) (*models.Version, error) {
 
 // GetShard returns a Shard struc of for a given shardId
 func (d *Database) GetShard(shardID uint32) (*models.Shard, error) {
-	query := "SELECT shardId, schemaName, shardDSN, version, taskName, lastTaskHb, lastUpdate " +
-		"FROM shards WHERE shardId = ?"
+	query := "SELECT " + shardColumns + " FROM shards WHERE shardId = ?"
+	return scanShard(d.Conn.QueryRow(query, shardID))
+}
+
+// columns read by scanShard, applied is the list of versions of shardVersions
+const shardColumns = "shardId, schemaName, shardDSN, shardGroups, version, " +
+	"(SELECT GROUP_CONCAT(sv.version ORDER BY sv.version) FROM shardVersions sv WHERE sv.shardId = shards.shardId), " +
+	"taskName, lastTaskHb, taskProgress, abortRequested, attempts, retryAfter, failed, lastUpdate"
+
+// scanner is implemented by both sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanShard reads a Shard from a row made of shardColumns
+func scanShard(row scanner) (*models.Shard, error) {
 	s := &models.Shard{}
-	err := d.Conn.QueryRow(query, shardID).Scan(&s.ShardId, &s.SchemaName, &s.ShardDSN,
-		&s.Version, &s.TaskName, &s.LastTaskHb, &s.LastUpdate)
+	var shardGroups string
+	var applied sql.NullString
+	err := row.Scan(&s.ShardId, &s.SchemaName, &s.ShardDSN, &shardGroups, &s.Version, &applied, &s.TaskName,
+		&s.LastTaskHb, &s.TaskProgress, &s.AbortRequested, &s.Attempts, &s.RetryAfter, &s.Failed, &s.LastUpdate)
 
 	if err != nil {
 		return nil, err
 	}
 
+	s.Groups = []string{}
+	for _, group := range strings.Split(shardGroups, ",") {
+		if group != "" {
+			s.Groups = append(s.Groups, group)
+		}
+	}
+	s.Applied = []uint32{}
+	for _, field := range strings.Split(applied.String, ",") {
+		if version, err := strconv.ParseUint(field, 10, 32); err == nil {
+			s.Applied = append(s.Applied, uint32(version))
+		}
+	}
 	return s, nil
 }
 
-// GetShardToUpgrade finds a shard that has a lower version and no taskName
-// Should be called only by the dispatcher otherwise it needs a mutex
-func (d *Database) GetShardToUpgrade(version uint32, taskName string) (*models.Shard, error) {
+// gives back the attempt counted by the claim of a shard, see ReleaseShard
+const giveBackAttempt = "attempts = IF(attempts > 0, attempts - 1, 0)"
+
+// shards that can be claimed, below version
+const claimableShards = "version < ? AND taskName IS NULL AND failed = 0 AND (retryAfter IS NULL OR retryAfter <= NOW())"
+
+// order of the claims, the shards waiting for the longest time first
+const claimOrder = " ORDER BY lastUpdate, shardId"
+
+// name of the lock serializing the claims limited per host, one per ShardSchema database
+const claimLock = "CONCAT('shardschema_claims.', DATABASE())"
+
+// ClaimShards claims up to limit shards that have a lower version and no taskName, skipping
+// the failed shards and the ones waiting for a retry. If shardIDs is not empty, only these
+// shards can be claimed. Claiming a shard counts as an attempt.
+// The claim is a single conditional UPDATE, several dispatchers can claim concurrently and
+// each shard is claimed by only one of them. The claimed shards are tagged with a claimSeq
+// to read them back.
+func (d *Database) ClaimShards(version uint32, taskName string, limit int, shardIDs []uint32) ([]*models.Shard, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	claimSeq := atomic.AddUint32(&d.claimSeq, 1)
+
+	args := []interface{}{taskName, claimSeq, version}
+	query := "UPDATE shards SET taskName = ?, claimSeq = ?, lastTaskHb = NOW(), taskProgress = NULL, " +
+		"abortRequested = 0, attempts = attempts + 1, retryAfter = NULL WHERE " + claimableShards
+	if len(shardIDs) > 0 {
+		query += " AND shardId IN (?" + strings.Repeat(", ?", len(shardIDs)-1) + ")"
+		for _, id := range shardIDs {
+			args = append(args, id)
+		}
+	}
+	query += claimOrder + " LIMIT ?"
+	args = append(args, limit)
+	res, err := d.Conn.Exec(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't claim shards in the database")
+	}
+	count, err := res.RowsAffected()
+	if err == nil && count == 0 {
+		return nil, nil
+	}
+	d.Log.Debug("claimed shards", "task", taskName, "count", count, "claimSeq", claimSeq)
+
+	return d.queryShards("SELECT "+shardColumns+" FROM shards WHERE taskName = ? AND claimSeq = ? "+
+		"ORDER BY shardId", taskName, claimSeq)
+}
+
+// GetClaimableShards returns up to limit shards ClaimShards could claim, in the order it
+// claims them, skipping the first offset ones. It claims nothing.
+func (d *Database) GetClaimableShards(version uint32, offset int, limit int) ([]*models.Shard, error) {
+	query := "SELECT " + shardColumns + " FROM shards WHERE " + claimableShards + claimOrder + " LIMIT ?, ?"
+	return d.queryShards(query, version, offset, limit)
+}
+
+// LockClaims takes a lock held by a single dispatcher at a time, waiting up to timeout for
+// it, so that the shards claimed by the others don't change between the read of the claimed
+// shards and a claim. The lock is held until the returned func is called.
+func (d *Database) LockClaims(timeout time.Duration) (func(), error) {
+	ctx := context.Background()
+	// the lock belongs to the session, the connection is kept out of the pool until released
+	conn, err := d.Conn.Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get a connection for the claim lock")
+	}
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK("+claimLock+", ?)", int(timeout.Seconds())).Scan(&locked)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "cannot get the claim lock")
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("the claim lock is still held by another dispatcher after %s", timeout)
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, "DO RELEASE_LOCK("+claimLock+")"); err != nil {
+			d.Log.Error("cannot release the claim lock", "error", err)
+		}
+		conn.Close()
+	}, nil
+}
+
+// GetClaimedShards returns the shards claimed by a task, of any dispatcher
+func (d *Database) GetClaimedShards() ([]*models.Shard, error) {
+	return d.queryShards("SELECT " + shardColumns + " FROM shards WHERE taskName IS NOT NULL")
+}
+
+// queryShards returns the shards of a query on shardColumns
+func (d *Database) queryShards(query string, args ...interface{}) ([]*models.Shard, error) {
+	rows, err := d.Conn.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read the shards")
+	}
+	defer rows.Close()
+
+	shards := []*models.Shard{}
+	for rows.Next() {
+		s, err := scanShard(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read a shard")
+		}
+		shards = append(shards, s)
+	}
+
+	return shards, rows.Err()
+}
+
+// truncate returns the first n characters of s, the output of the tools may not be ASCII and
+// a multi-byte character is never split
+func truncate(s string, n int) string {
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
+
+// UpdateShardTaskHeartbeat updates the lastTaskHb and taskProgress fields for the shardId
+// provided the taskName matches
+func (d *Database) UpdateShardTaskHeartbeat(shardID uint32, taskName string, progress string) error {
+	// taskProgress is a varchar(255)
+	progress = truncate(progress, 255)
+
+	query := "UPDATE shards SET lastTaskHb = NOW(), taskProgress = ? WHERE taskName = ? AND shardId = ?"
+	res, err := d.Conn.Exec(query, progress, taskName, shardID)
+
+	if err != nil {
+		d.Log.Warn("cannot update the heartbeat", "shardId", shardID, "task", taskName, "error", err)
+		return errors.Wrap(err, "Can't update lastTaskHb of the shard in the database")
+	}
+
+	if count, err := res.RowsAffected(); err == nil && count != 1 {
+		// the shard was taken back, by the reaper of another dispatcher or an operator
+		d.Log.Warn("the shard is not claimed by the task anymore", "shardId", shardID, "task", taskName)
+		return fmt.Errorf("problem with the update, count = %d instead of 1", count)
+	}
+	return nil
+}
+
+// ShardUpgradeDone adds version to the versions applied to a shard claimed by taskName and
+// releases the shard
+func (d *Database) ShardUpgradeDone(shardID uint32, version uint32, taskName string) error {
+	return d.versionApplied(shardID, version, taskName, true)
+}
+
+// ShardVersionApplied adds version to the versions applied to a shard claimed by taskName,
+// the shard stays claimed for its other running tasks
+func (d *Database) ShardVersionApplied(shardID uint32, version uint32, taskName string) error {
+	return d.versionApplied(shardID, version, taskName, false)
+}
+
+// versionApplied adds version to the applied versions of a shard. The version of the shard
+// moves up to the last version below the first one not applied, the versions applied above
+// it are kept in shardVersions.
+func (d *Database) versionApplied(shardID uint32, version uint32, taskName string, andRelease bool) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can't mark the shard as upgraded in the database")
+	}
+	defer tx.Rollback()
+
+	var current uint32
+	err = tx.QueryRow("SELECT version FROM shards WHERE taskName = ? AND shardId = ? FOR UPDATE",
+		taskName, shardID).Scan(&current)
+	if err == sql.ErrNoRows {
+		d.Log.Warn("the shard is not claimed by the task anymore", "shardId", shardID, "version", version,
+			"task", taskName)
+		return fmt.Errorf("problem with the update, count = %d instead of 1", 0)
+	}
+	if err != nil {
+		return errors.Wrap(err, "can't mark the shard as upgraded in the database")
+	}
+
+	if version > current {
+		if _, err = tx.Exec("INSERT IGNORE INTO shardVersions (shardId, version) VALUES (?, ?)",
+			shardID, version); err != nil {
+			return errors.Wrap(err, "can't mark the shard as upgraded in the database")
+		}
+		if current, err = appliedUpTo(tx, shardID, current); err != nil {
+			return errors.Wrap(err, "can't mark the shard as upgraded in the database")
+		}
+		if _, err = tx.Exec("DELETE FROM shardVersions WHERE shardId = ? AND version <= ?",
+			shardID, current); err != nil {
+			return errors.Wrap(err, "can't mark the shard as upgraded in the database")
+		}
+	}
+
+	query := "UPDATE shards SET lastTaskHb = NOW(), version = ?, taskProgress = NULL WHERE shardId = ?"
+	if andRelease {
+		query = "UPDATE shards SET lastTaskHb = NOW(), version = ?, taskName = NULL, taskProgress = NULL, " +
+			"abortRequested = 0, attempts = 0, retryAfter = NULL, failed = 0 WHERE shardId = ?"
+	}
+	if _, err = tx.Exec(query, current, shardID); err != nil {
+		d.Log.Error("cannot mark the shard as upgraded", "shardId", shardID, "version", version,
+			"task", taskName, "error", err)
+		return errors.Wrap(err, "can't mark the shard as upgraded in the database")
+	}
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "can't mark the shard as upgraded in the database")
+	}
+	d.Log.Debug("shard upgraded", "shardId", shardID, "version", version, "task", taskName, "released", andRelease)
+	return nil
+}
+
+// appliedUpTo returns the last version before the first version above current that is not
+// in the shardVersions of the shard
+func appliedUpTo(tx *sql.Tx, shardID uint32, current uint32) (uint32, error) {
+	rows, err := tx.Query("SELECT v.version, sv.version IS NOT NULL FROM versions v "+
+		"LEFT JOIN shardVersions sv ON sv.shardId = ? AND sv.version = v.version "+
+		"WHERE v.version > ? ORDER BY v.version", shardID, current)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version uint32
+		var applied bool
+		if err := rows.Scan(&version, &applied); err != nil {
+			return 0, err
+		}
+		if !applied {
+			break
+		}
+		current = version
+	}
+	return current, rows.Err()
+}
+
+// GetStaleShards returns the shards claimed by a task, other than taskName, whose
+// heartbeat is older than timeout
+func (d *Database) GetStaleShards(timeout time.Duration, taskName string) ([]*models.Shard, error) {
+	query := "SELECT " + shardColumns + " FROM shards " +
+		"WHERE taskName IS NOT NULL AND taskName <> ? AND lastTaskHb < NOW() - INTERVAL ? SECOND"
+	rows, err := d.Conn.Query(query, taskName, int64(timeout/time.Second))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot look for stale shards")
+	}
+	defer rows.Close()
+
+	shards := []*models.Shard{}
+	for rows.Next() {
+		s, err := scanShard(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read a stale shard")
+		}
+		shards = append(shards, s)
+	}
+
+	return shards, rows.Err()
+}
+
+// GetReferenceShard returns a shard, not claimed by any task, whose last applied version
+// on the table of version is version. Returns nil if there are none.
+func (d *Database) GetReferenceShard(version uint32) (*models.Shard, error) {
 	var shardID uint32
 
-	query := "SELECT shardId FROM shards WHERE version < ? AND taskName IS NULL ORDER BY lastUpdate LIMIT 1"
+	// the table of a shard past a later version of the same table may have changed since
+	query := "SELECT s.shardId FROM shards s JOIN versions v ON v.version = ? " +
+		"WHERE (s.version >= v.version OR s.shardId IN " +
+		"(SELECT shardId FROM shardVersions WHERE version = v.version)) AND s.taskName IS NULL " +
+		"AND NOT EXISTS (SELECT 1 FROM versions later WHERE later.tableName = v.tableName " +
+		"AND later.version > v.version AND (s.version >= later.version OR s.shardId IN " +
+		"(SELECT shardId FROM shardVersions WHERE version = later.version))) " +
+		"ORDER BY s.lastUpdate DESC LIMIT 1"
 	err := d.Conn.QueryRow(query, version).Scan(&shardID)
 
 	switch {
 	case err == sql.ErrNoRows:
-		//Logger.Println("Found no shards needing ddl")
 		return nil, nil
 	case err != nil:
-		return nil, errors.Wrap(err, "unexpected error looking for shards")
+		return nil, errors.Wrap(err, fmt.Sprintf("unexpected error looking for a shard at version %d", version))
 	}
 
-	updateQuery := "UPDATE shards SET taskName = ?, lastTaskHb = NOW() WHERE shardId = ?"
-	_, err = d.Conn.Exec(updateQuery, taskName, shardID)
+	return d.GetShard(shardID)
+}
+
+// ReleaseShard clears the taskName of the shard, provided it is still claimed by taskName.
+// The version of the shard is left unchanged. The release isn't a failure, the attempt
+// counted by the claim is given back.
+func (d *Database) ReleaseShard(shardID uint32, taskName string) error {
+	query := "UPDATE shards SET taskName = NULL, taskProgress = NULL, abortRequested = 0, " + giveBackAttempt +
+		" WHERE taskName = ? AND shardId = ?"
+	res, err := d.Conn.Exec(query, taskName, shardID)
+
 	if err != nil {
-		return nil, errors.Wrap(err, "can't update the shards entry in the database")
+		return errors.Wrap(err, "can't release the shard in the database")
 	}
 
-	return d.GetShard(shardID)
+	count, err := res.RowsAffected()
+	if err == nil && count != 1 {
+		return fmt.Errorf("problem with the update, count = %d instead of 1", count)
+	}
+	d.Log.Debug("shard released", "shardId", shardID, "task", taskName)
+	return nil
 }
 
-// UpdateShardTaskHeartbeat updates the lastTaskHb field for the shardId and provided the taskName matches
-func (d *Database) UpdateShardTaskHeartbeat(shardID uint32, taskName string) error {
-	query := "UPDATE shards SET lastTaskHb = NOW() WHERE taskName = ? AND shardId = ?"
-	res, err := d.Conn.Exec(query, taskName, shardID)
+// ShardRetryLater releases a shard claimed by taskName after a failed attempt, it won't
+// be claimed again before delay
+func (d *Database) ShardRetryLater(shardID uint32, taskName string, delay time.Duration) error {
+	query := "UPDATE shards SET taskName = NULL, taskProgress = NULL, abortRequested = 0, " +
+		"retryAfter = NOW() + INTERVAL ? SECOND WHERE taskName = ? AND shardId = ?"
+	res, err := d.Conn.Exec(query, int64(delay/time.Second), taskName, shardID)
 
 	if err != nil {
-		return errors.Wrap(err, "Can't update lastTaskHb of the shard in the database")
+		return errors.Wrap(err, "can't schedule the retry of the shard in the database")
 	}
 
-	if count, err := res.RowsAffected(); err == nil && count != 1 {
+	count, err := res.RowsAffected()
+	if err == nil && count != 1 {
 		return fmt.Errorf("problem with the update, count = %d instead of 1", count)
 	}
+	d.Log.Debug("shard released for a retry", "shardId", shardID, "task", taskName)
 	return nil
 }
 
-// ShardUpgradeDone updates the shards object
-func (d *Database) ShardUpgradeDone(shardID uint32, version uint32, taskName string) error {
-	query := "UPDATE shards SET lastTaskHb = NOW(), VERSION = ?, taskNAme = NULL WHERE taskName = ? AND shardId = ?"
-	res, err := d.Conn.Exec(query, taskName, shardID, version)
+// ShardFailed releases a shard claimed by taskName and marks it as failed, it won't be
+// claimed again until an operator resets it
+func (d *Database) ShardFailed(shardID uint32, taskName string) error {
+	query := "UPDATE shards SET taskName = NULL, taskProgress = NULL, abortRequested = 0, failed = 1 " +
+		"WHERE taskName = ? AND shardId = ?"
+	res, err := d.Conn.Exec(query, taskName, shardID)
 
 	if err != nil {
-		return errors.Wrap(err, "can't mark the shard as upgraded in the database")
+		return errors.Wrap(err, "can't mark the shard as failed in the database")
 	}
 
 	count, err := res.RowsAffected()
 	if err == nil && count != 1 {
 		return fmt.Errorf("problem with the update, count = %d instead of 1", count)
 	}
+	d.Log.Debug("shard marked as failed", "shardId", shardID, "task", taskName)
+	return nil
+}
+
+// ResetShardFailure clears the failed state and the attempts of a shard so that it is retried
+func (d *Database) ResetShardFailure(shardID uint32) error {
+	query := "UPDATE shards SET failed = 0, attempts = 0, retryAfter = NULL WHERE shardId = ?"
+	res, err := d.Conn.Exec(query, shardID)
+
+	if err != nil {
+		return errors.Wrap(err, "can't reset the shard failure in the database")
+	}
+
+	count, err := res.RowsAffected()
+	if err == nil && count != 1 {
+		return fmt.Errorf("shard %d doesn't exist or has no failure to reset", shardID)
+	}
+	return nil
+}
+
+// ReleaseTaskShards releases all the shards claimed by taskName, their versions are left unchanged
+// and the attempts counted by the claims are given back
+func (d *Database) ReleaseTaskShards(taskName string) error {
+	query := "UPDATE shards SET taskName = NULL, taskProgress = NULL, abortRequested = 0, " + giveBackAttempt +
+		" WHERE taskName = ?"
+	if _, err := d.Conn.Exec(query, taskName); err != nil {
+		return errors.Wrap(err, "can't release the shards in the database")
+	}
+	return nil
+}
+
+// RequestAbort flags the task running on the shard to be aborted by its dispatcher
+func (d *Database) RequestAbort(shardID uint32) error {
+	query := "UPDATE shards SET abortRequested = 1 WHERE taskName IS NOT NULL AND shardId = ?"
+	res, err := d.Conn.Exec(query, shardID)
+
+	if err != nil {
+		return errors.Wrap(err, "can't flag the shard task to be aborted")
+	}
+
+	count, err := res.RowsAffected()
+	if err == nil && count != 1 {
+		return fmt.Errorf("shard %d has no running task", shardID)
+	}
+	return nil
+}
+
+// GetAbortRequests returns the ids of the shards claimed by taskName that are flagged to be aborted
+func (d *Database) GetAbortRequests(taskName string) ([]uint32, error) {
+	rows, err := d.Conn.Query("SELECT shardId FROM shards WHERE taskName = ? AND abortRequested = 1", taskName)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot look for the abort requests")
+	}
+	defer rows.Close()
+
+	shardIDs := []uint32{}
+	for rows.Next() {
+		var shardID uint32
+		if err := rows.Scan(&shardID); err != nil {
+			return nil, errors.Wrap(err, "cannot read an abort request")
+		}
+		shardIDs = append(shardIDs, shardID)
+	}
+
+	return shardIDs, rows.Err()
+}
+
+// AddVersion inserts a new version. If v.Version is 0, the next version number is used.
+// Returns the version number.
+func (d *Database) AddVersion(v *models.Version) (uint32, error) {
+	query := "INSERT INTO versions (version, command, tableName, cmdType, validationQuery, validationAnswer, " +
+		"options, dependsOn, target) VALUES (NULLIF(?, 0), ?, ?, ?, ?, ?, ?, ?, ?)"
+	res, err := d.Conn.Exec(query, v.Version, v.Command, v.TableName, v.CmdType, v.ValidationQuery,
+		v.ValidationAnswer, v.Options, v.DependsOn, v.Target)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't insert the version in the database")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get the inserted version")
+	}
+	return uint32(id), nil
+}
+
+// ListVersions returns all the versions, in order
+func (d *Database) ListVersions() ([]*models.Version, error) {
+	query := "SELECT " + versionColumns + " FROM `versions` ORDER BY `version`"
+	rows, err := d.Conn.Query(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list the versions")
+	}
+	defer rows.Close()
+
+	versions := []*models.Version{}
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read a version")
+		}
+		versions = append(versions, v)
+	}
+
+	return versions, rows.Err()
+}
+
+// AddShard inserts a new shard at the given version. Returns the shardId.
+func (d *Database) AddShard(schemaName string, shardDSN string, version uint32) (uint32, error) {
+	query := "INSERT INTO shards (schemaName, shardDSN, version, taskName) VALUES (?, ?, ?, NULL)"
+	res, err := d.Conn.Exec(query, schemaName, shardDSN, version)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't insert the shard in the database")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get the inserted shardId")
+	}
+	return uint32(id), nil
+}
+
+// ListShards returns all the shards ordered by shardId
+func (d *Database) ListShards() ([]*models.Shard, error) {
+	rows, err := d.Conn.Query("SELECT " + shardColumns + " FROM shards ORDER BY shardId")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list the shards")
+	}
+	defer rows.Close()
+
+	shards := []*models.Shard{}
+	for rows.Next() {
+		s, err := scanShard(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read a shard")
+		}
+		shards = append(shards, s)
+	}
+
+	return shards, rows.Err()
+}
+
+// SetShardGroups sets the groups of a shard, sorted. The versions already skipped because
+// they didn't target the shard stay skipped.
+func (d *Database) SetShardGroups(shardID uint32, groups []string) error {
+	res, err := d.Conn.Exec("UPDATE shards SET shardGroups = ? WHERE shardId = ?", strings.Join(groups, ","), shardID)
+	if err != nil {
+		return errors.Wrap(err, "can't set the groups of the shard in the database")
+	}
+
+	// the groups may be unchanged
+	if count, err := res.RowsAffected(); err == nil && count != 1 {
+		if _, err = d.GetShard(shardID); err == sql.ErrNoRows {
+			return fmt.Errorf("shard %d doesn't exist", shardID)
+		}
+	}
 	return nil
 }
+
+// SetShardVersion sets the version of a shard not claimed by a task, without applying anything.
+// The versions above it are not applied anymore.
+func (d *Database) SetShardVersion(shardID uint32, version uint32) error {
+	query := "UPDATE shards SET version = ?, attempts = 0, retryAfter = NULL, failed = 0 " +
+		"WHERE taskName IS NULL AND shardId = ?"
+	res, err := d.Conn.Exec(query, version, shardID)
+
+	if err != nil {
+		return errors.Wrap(err, "can't set the version of the shard in the database")
+	}
+
+	count, err := res.RowsAffected()
+	if err == nil && count != 1 {
+		return fmt.Errorf("shard %d doesn't exist, is already at version %d or is claimed by a task", shardID, version)
+	}
+	if _, err = d.Conn.Exec("DELETE FROM shardVersions WHERE shardId = ?", shardID); err != nil {
+		return errors.Wrap(err, "can't set the version of the shard in the database")
+	}
+	return nil
+}
+
+// GetOpLog returns the oplog entries of a shard, for all versions when allVersions is true
+func (d *Database) GetOpLog(shardID uint32, version uint32, allVersions bool) ([]*models.OpLog, error) {
+	query := "SELECT `shardId`, `version`, `seq`, `run`, `taskName`, `message`, `output`, `err`, `lastUpdate` " +
+		"FROM oplog WHERE shardId = ? AND (version = ? OR ?) ORDER BY version, seq"
+	rows, err := d.Conn.Query(query, shardID, version, allVersions)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read the oplog")
+	}
+	defer rows.Close()
+
+	entries := []*models.OpLog{}
+	for rows.Next() {
+		o := &models.OpLog{}
+		if err := rows.Scan(&o.ShardId, &o.Version, &o.Seq, &o.Run, &o.TaskName, &o.Message,
+			&o.Output, &o.Err, &o.LastUpdate); err != nil {
+			return nil, errors.Wrap(err, "cannot read an oplog entry")
+		}
+		entries = append(entries, o)
+	}
+
+	return entries, rows.Err()
+}
+
+// VersionDuration is how long it took, on average, to apply a version to the shards
+type VersionDuration struct {
+	Version     uint32
+	Completed   int           // number of shards the version was applied to
+	AvgDuration time.Duration // from the first to the last oplog entry
+}
+
+// GetVersionDurations returns the average DDL durations of the versions, computed from the
+// oplog entries of the completed runs. The failed runs and the waits between the attempts
+// don't count.
+func (d *Database) GetVersionDurations() ([]VersionDuration, error) {
+	query := "SELECT version, COUNT(*), COALESCE(AVG(duration), 0) FROM (" +
+		"SELECT shardId, version, TIMESTAMPDIFF(SECOND, MIN(lastUpdate), MAX(lastUpdate)) AS duration " +
+		"FROM oplog GROUP BY shardId, version, run HAVING SUM(message = 'Completed OK') > 0) t " +
+		"GROUP BY version ORDER BY version"
+	rows, err := d.Conn.Query(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot compute the ddl durations")
+	}
+	defer rows.Close()
+
+	durations := []VersionDuration{}
+	for rows.Next() {
+		var vd VersionDuration
+		var seconds float64
+		if err := rows.Scan(&vd.Version, &vd.Completed, &seconds); err != nil {
+			return nil, errors.Wrap(err, "cannot read a ddl duration")
+		}
+		vd.AvgDuration = time.Duration(seconds * float64(time.Second))
+		durations = append(durations, vd)
+	}
+
+	return durations, rows.Err()
+}
+
+// CountShardsByVersion returns the number of shards at each version
+func (d *Database) CountShardsByVersion() (map[uint32]int, error) {
+	rows, err := d.Conn.Query("SELECT version, COUNT(*) FROM shards GROUP BY version")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot count the shards per version")
+	}
+	defer rows.Close()
+
+	counts := map[uint32]int{}
+	for rows.Next() {
+		var version uint32
+		var count int
+		if err := rows.Scan(&version, &count); err != nil {
+			return nil, errors.Wrap(err, "cannot read a shard count")
+		}
+		counts[version] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// GetOldestTaskHeartbeat returns the age of the oldest heartbeat among the claimed shards,
+// measured by the database server. Returns false if no shard is claimed.
+func (d *Database) GetOldestTaskHeartbeat() (time.Duration, bool, error) {
+	var seconds sql.NullInt64
+	err := d.Conn.QueryRow("SELECT TIMESTAMPDIFF(SECOND, MIN(lastTaskHb), NOW()) FROM shards " +
+		"WHERE taskName IS NOT NULL").Scan(&seconds)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "cannot get the oldest task heartbeat")
+	}
+	return time.Duration(seconds.Int64) * time.Second, seconds.Valid, nil
+}
@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/migrate"
 	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
 	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
 )
@@ -25,7 +27,7 @@ func TestAddOpLog(t *testing.T) {
 	want := models.OpLog{
 		ShardId:    100,
 		Version:    100,
-		Seq:        3,
+		Seq:        1,
 		TaskName:   sql.NullString{String: "taskName", Valid: true},
 		Message:    sql.NullString{String: "message", Valid: true},
 		Output:     sql.NullString{String: "stdout", Valid: true},
@@ -69,7 +71,9 @@ func TestGetShard(t *testing.T) {
 		ShardId:    1,
 		SchemaName: "shard_1",
 		ShardDSN:   "user:pass@(tcp:10.2.2.1:3306)",
+		Groups:     []string{},
 		Version:    0,
+		Applied:    []uint32{},
 		TaskName:   sql.NullString{String: "", Valid: false},
 	}
 
@@ -81,7 +85,227 @@ func TestGetShard(t *testing.T) {
 	tu.Equals(t, wantShard, shard)
 }
 
+func TestGetStaleShards(t *testing.T) {
+	db := getDB(t)
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+	_, err := db.Conn.Exec("INSERT INTO shards (shardId, schemaName, shardDSN, version, taskName, lastTaskHb) VALUES " +
+		"(100, 'shard_100', 'user:pass@tcp(10.2.2.1:3306)', 1, 'deadhost:000001', NOW() - INTERVAL 2 HOUR), " +
+		"(101, 'shard_101', 'user:pass@tcp(10.2.2.1:3306)', 1, 'livehost:000001', NOW()), " +
+		"(102, 'shard_102', 'user:pass@tcp(10.2.2.1:3306)', 1, 'myhost:000001', NOW() - INTERVAL 2 HOUR)")
+	tu.Ok(t, err)
+
+	shards, err := db.GetStaleShards(time.Hour, "myhost:000001")
+	tu.Ok(t, err)
+	tu.Assert(t, len(shards) == 1, fmt.Sprintf("invalid number of stale shards. Got %d, want 1", len(shards)))
+	tu.Equals(t, uint32(100), shards[0].ShardId)
+
+	tu.Ok(t, db.ReleaseShard(100, "deadhost:000001"))
+	tu.NotOk(t, db.ReleaseShard(101, "deadhost:000001"))
+
+	shards, err = db.GetStaleShards(time.Hour, "myhost:000001")
+	tu.Ok(t, err)
+	tu.Assert(t, len(shards) == 0, fmt.Sprintf("invalid number of stale shards. Got %d, want 0", len(shards)))
+
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+}
+
+func TestShardMetrics(t *testing.T) {
+	db := getDB(t)
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+	_, err := db.Conn.Exec("INSERT INTO shards (shardId, schemaName, shardDSN, version, taskName, lastTaskHb) VALUES " +
+		"(100, 'shard_100', 'user:pass@tcp(10.2.2.1:3306)', 7, 'deadhost:000001', NOW() - INTERVAL 2 HOUR), " +
+		"(101, 'shard_101', 'user:pass@tcp(10.2.2.1:3306)', 7, NULL, NULL)")
+	tu.Ok(t, err)
+
+	counts, err := db.CountShardsByVersion()
+	tu.Ok(t, err)
+	tu.Equals(t, 2, counts[7])
+
+	age, ok, err := db.GetOldestTaskHeartbeat()
+	tu.Ok(t, err)
+	tu.Assert(t, ok, "shard 100 is claimed")
+	tu.Assert(t, age >= 2*time.Hour, "the oldest heartbeat is 2 hours old, got %s", age)
+
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+}
+
+func TestGetVersionDurations(t *testing.T) {
+	db := getDB(t)
+	// run 1 of shard 100 failed, run 2 completed an hour later
+	_, err := db.Conn.Exec("INSERT INTO oplog (shardId, version, seq, run, message, lastUpdate) VALUES " +
+		"(100, 1, 1, 1, 'Starting', '2024-03-01 10:00:00'), " +
+		"(100, 1, 2, 1, 'Error: command', '2024-03-01 10:05:00'), " +
+		"(100, 1, 3, 2, 'Starting', '2024-03-01 11:05:00'), " +
+		"(100, 1, 4, 2, 'Completed OK', '2024-03-01 11:15:00')")
+	tu.Ok(t, err)
+
+	durations, err := db.GetVersionDurations()
+	tu.Ok(t, err)
+	tu.Equals(t, []VersionDuration{{Version: 1, Completed: 1, AvgDuration: 10 * time.Minute}}, durations)
+}
+
+func TestClaimShards(t *testing.T) {
+	db := getDB(t)
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+	// keep the shards of the test data out of the way
+	db.Conn.Exec("UPDATE shards SET failed = 1 WHERE shardId < 100")
+	defer db.Conn.Exec("UPDATE shards SET failed = 0 WHERE shardId < 100")
+
+	_, err := db.Conn.Exec("INSERT INTO shards (shardId, schemaName, shardDSN, version, taskName, retryAfter) VALUES " +
+		"(100, 'shard_100', 'user:pass@tcp(10.2.2.1:3306)', 1, NULL, NULL), " +
+		"(101, 'shard_101', 'user:pass@tcp(10.2.2.1:3306)', 1, NULL, NULL), " +
+		"(102, 'shard_102', 'user:pass@tcp(10.2.2.1:3306)', 1, NULL, NULL), " +
+		"(103, 'shard_103', 'user:pass@tcp(10.2.2.1:3306)', 1, 'otherhost:000001', NULL), " +
+		"(104, 'shard_104', 'user:pass@tcp(10.2.2.1:3306)', 1, NULL, NOW() + INTERVAL 1 HOUR), " +
+		"(105, 'shard_105', 'user:pass@tcp(10.2.2.1:3306)', 2, NULL, NULL)")
+	tu.Ok(t, err)
+
+	// two dispatchers never get the same shard
+	first, err := db.ClaimShards(2, "host1:000001", 2, nil)
+	tu.Ok(t, err)
+	tu.Assert(t, len(first) == 2, fmt.Sprintf("invalid number of claimed shards. Got %d, want 2", len(first)))
+	second, err := db.ClaimShards(2, "host2:000001", 5, nil)
+	tu.Ok(t, err)
+	tu.Assert(t, len(second) == 1, fmt.Sprintf("invalid number of claimed shards. Got %d, want 1", len(second)))
+
+	claimed := map[uint32]string{}
+	for _, s := range append(first, second...) {
+		_, dup := claimed[s.ShardId]
+		tu.Assert(t, !dup, fmt.Sprintf("shardId = %d claimed twice", s.ShardId))
+		claimed[s.ShardId] = s.TaskName.String
+		tu.Equals(t, uint8(1), s.Attempts)
+	}
+	tu.Equals(t, "host2:000001", second[0].TaskName.String)
+	for _, id := range []uint32{100, 101, 102} {
+		_, ok := claimed[id]
+		tu.Assert(t, ok, fmt.Sprintf("shardId = %d should be claimed", id))
+	}
+
+	// nothing left to claim
+	shards, err := db.ClaimShards(2, "host1:000001", 5, nil)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, len(shards))
+
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+}
+
+func TestAbortRequests(t *testing.T) {
+	db := getDB(t)
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+	_, err := db.Conn.Exec("INSERT INTO shards (shardId, schemaName, shardDSN, version, taskName) VALUES " +
+		"(100, 'shard_100', 'user:pass@tcp(10.2.2.1:3306)', 1, 'myhost:000001'), " +
+		"(101, 'shard_101', 'user:pass@tcp(10.2.2.1:3306)', 1, NULL)")
+	tu.Ok(t, err)
+
+	tu.Ok(t, db.RequestAbort(100))
+	// nothing to abort on a shard without task
+	tu.NotOk(t, db.RequestAbort(101))
+
+	shardIDs, err := db.GetAbortRequests("myhost:000001")
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{100}, shardIDs)
+
+	// releasing the shard clears the request
+	tu.Ok(t, db.ReleaseShard(100, "myhost:000001"))
+	shard, err := db.GetShard(100)
+	tu.Ok(t, err)
+	tu.Assert(t, !shard.AbortRequested, "the abort request should be cleared")
+
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+}
+
+func TestShardVersionApplied(t *testing.T) {
+	db := getDB(t)
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+	db.Conn.Exec("DELETE FROM shardVersions WHERE shardId >= 100")
+	_, err := db.Conn.Exec("INSERT INTO shards (shardId, schemaName, shardDSN, version, taskName) VALUES " +
+		"(100, 'shard_100', 'user:pass@tcp(10.2.2.1:3306)', 0, 'myhost:000001')")
+	tu.Ok(t, err)
+
+	// version 2 applied before version 1, the shard stays claimed
+	tu.Ok(t, db.ShardVersionApplied(100, 2, "myhost:000001"))
+	tu.NotOk(t, db.ShardVersionApplied(100, 2, "otherhost:000001"))
+	shard, err := db.GetShard(100)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(0), shard.Version)
+	tu.Equals(t, []uint32{2}, shard.Applied)
+	tu.Equals(t, "myhost:000001", shard.TaskName.String)
+
+	tu.Ok(t, db.ShardUpgradeDone(100, 1, "myhost:000001"))
+	shard, err = db.GetShard(100)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(2), shard.Version)
+	tu.Equals(t, []uint32{}, shard.Applied)
+	tu.Assert(t, !shard.TaskName.Valid, "the shard should be released")
+
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+	db.Conn.Exec("DELETE FROM shardVersions WHERE shardId >= 100")
+}
+
+func TestGetReferenceShard(t *testing.T) {
+	db := getDB(t)
+	// version 3 alters t1 again, shard 100 is past it and shard 101 applied it out of order
+	for _, query := range []string{
+		"INSERT INTO versions (version, command, cmdType, tableName) VALUES (3, 'SELECT 1', 'sql', 't1')",
+		"INSERT INTO shards (shardId, schemaName, shardDSN, version, lastUpdate) VALUES " +
+			"(100, 'shard_100', 'user:pass@tcp(10.2.2.1:3306)', 3, NOW()), " +
+			"(101, 'shard_101', 'user:pass@tcp(10.2.2.1:3306)', 0, NOW() - INTERVAL 1 MINUTE), " +
+			"(102, 'shard_102', 'user:pass@tcp(10.2.2.1:3306)', 1, NOW() - INTERVAL 2 MINUTE)",
+		"INSERT INTO shardVersions (shardId, version) VALUES (101, 3)",
+	} {
+		_, err := db.Conn.Exec(query)
+		tu.Ok(t, err)
+	}
+
+	ref, err := db.GetReferenceShard(1)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(102), ref.ShardId)
+	ref, err = db.GetReferenceShard(2)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(100), ref.ShardId)
+
+	_, err = db.Conn.Exec("UPDATE shards SET version = 3 WHERE shardId = 102")
+	tu.Ok(t, err)
+	ref, err = db.GetReferenceShard(1)
+	tu.Ok(t, err)
+	tu.Assert(t, ref == nil, "no shard has t1 at version 1, got shard %v", ref)
+}
+
+func TestSetShardGroups(t *testing.T) {
+	db := getDB(t)
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+	_, err := db.Conn.Exec("INSERT INTO shards (shardId, schemaName, shardDSN, version) VALUES " +
+		"(100, 'shard_100', 'user:pass@tcp(10.2.2.1:3306)', 0)")
+	tu.Ok(t, err)
+
+	tu.Ok(t, db.SetShardGroups(100, []string{"archive", "eu"}))
+	// unchanged
+	tu.Ok(t, db.SetShardGroups(100, []string{"archive", "eu"}))
+	tu.NotOk(t, db.SetShardGroups(999, []string{"eu"}))
+	shard, err := db.GetShard(100)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"archive", "eu"}, shard.Groups)
+
+	db.Conn.Exec("DELETE FROM shards WHERE shardId >= 100")
+}
+
+// getDB returns a database created by the migrations, with shard 1 at version 0, versions 1
+// and 2 and two oplog entries of shard 1 at version 1
 func getDB(t *testing.T) *Database {
-	conn := tu.GetMySQLConnection(t)
+	conn := tu.OpenMySQLDatabase(t, "shardschema_test")
+	_, err := migrate.Up(conn)
+	tu.Ok(t, err)
+
+	for _, query := range []string{
+		"INSERT INTO shards (shardId, schemaName, shardDSN, version) " +
+			"VALUES (1, 'shard_1', 'user:pass@(tcp:10.2.2.1:3306)', 0)",
+		"INSERT INTO versions (version, command, cmdType, tableName) " +
+			"VALUES (1, 'pt-online-schema-change', 'pt-osc', 't1'), (2, 'SELECT 1', 'sql', 't2')",
+		"INSERT INTO oplog (shardId, version, seq, run, lastUpdate) " +
+			"VALUES (1, 1, 1, 0, '2017-09-21 20:28:37'), (1, 1, 2, 0, '2017-09-21 20:29:01')",
+	} {
+		_, err = conn.Exec(query)
+		tu.Ok(t, err)
+	}
 	return NewDatabase(conn)
 }
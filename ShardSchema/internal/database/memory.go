@@ -0,0 +1,741 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+)
+
+// MemoryStore is a Store kept in memory, for the tests. It follows the semantics of the
+// MySQL tables: the timestamps have a second precision, lastUpdate changes with every update
+// of a row and an update changing nothing counts as no row updated.
+type MemoryStore struct {
+	// Now is the clock of the store, it replaces NOW()
+	Now func() time.Time
+
+	mu       sync.Mutex
+	claimMu  sync.Mutex // see LockClaims
+	versions map[uint32]*models.Version
+	shards   map[uint32]*models.Shard
+	oplog    []*models.OpLog
+	// last AUTO_INCREMENT values
+	lastVersion uint32
+	lastShardID uint32
+}
+
+// NewMemoryStore creates an empty MemoryStore using the system clock
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		Now:      time.Now,
+		versions: make(map[uint32]*models.Version),
+		shards:   make(map[uint32]*models.Shard),
+	}
+}
+
+// now returns the time of the clock with the precision of a timestamp column
+func (m *MemoryStore) now() time.Time {
+	return m.Now().Truncate(time.Second)
+}
+
+func nullTime(t time.Time) models.NullTime {
+	return models.NullTime{Time: t, Valid: true}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: true}
+}
+
+// AddOpLog inserts an Oplog entry
+func (m *MemoryStore) AddOpLog(shardID uint32, version uint32, taskName string, message string, stdout string,
+	stderr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var run uint8
+	if s, ok := m.shards[shardID]; ok {
+		run = s.Attempts
+	}
+	m.addOpLog(shardID, version, run, taskName, message, stdout, stderr)
+	return nil
+}
+
+// AddOpLogRun inserts an Oplog entry of the attempt run, for the entries written once the
+// claim of the shard was released and its attempts reset or given back
+func (m *MemoryStore) AddOpLogRun(shardID uint32, version uint32, run uint8, taskName string, message string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.addOpLog(shardID, version, run, taskName, message, "", "")
+	return nil
+}
+
+func (m *MemoryStore) addOpLog(shardID uint32, version uint32, run uint8, taskName string, message string,
+	stdout string, stderr string) {
+	var seq uint32
+	for _, o := range m.oplog {
+		if o.ShardId == shardID && o.Version == version && o.Seq > seq {
+			seq = o.Seq
+		}
+	}
+	m.oplog = append(m.oplog, &models.OpLog{ShardId: shardID, Version: version, Seq: seq + 1, Run: run,
+		TaskName: nullString(taskName), Message: nullString(message), Output: nullString(stdout),
+		Err: nullString(stderr), LastUpdate: nullTime(m.now())})
+}
+
+// GetMaxVersion returns the highest current version
+func (m *MemoryStore) GetMaxVersion() (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var version uint32
+	for v := range m.versions {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// GetNextVersion gets the Version object of the following version
+func (m *MemoryStore) GetNextVersion(version uint32) (*models.Version, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var next *models.Version
+	for v, ver := range m.versions {
+		if v > version && (next == nil || v < next.Version) {
+			next = ver
+		}
+	}
+	if next == nil {
+		return nil, errors.Wrap(sql.ErrNoRows, fmt.Sprintf("cannot get next version of %d", version))
+	}
+	v := *next
+	return &v, nil
+}
+
+// GetVersion returns a Version struct of a given version
+func (m *MemoryStore) GetVersion(version uint32) (*models.Version, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ver, ok := m.versions[version]
+	if !ok {
+		return nil, errors.Wrap(sql.ErrNoRows, fmt.Sprintf("cannot get version %d from the db", version))
+	}
+	v := *ver
+	return &v, nil
+}
+
+// AddVersion inserts a new version. If v.Version is 0, the next version number is used.
+// Returns the version number.
+func (m *MemoryStore) AddVersion(v *models.Version) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	version := *v
+	if version.Version == 0 {
+		version.Version = m.lastVersion + 1
+	}
+	if _, ok := m.versions[version.Version]; ok {
+		return 0, fmt.Errorf("can't insert the version in the database: version %d already exists",
+			version.Version)
+	}
+	if version.Version > m.lastVersion {
+		m.lastVersion = version.Version
+	}
+	version.LastUpdate = m.now()
+	m.versions[version.Version] = &version
+	return version.Version, nil
+}
+
+// ListVersions returns all the versions, in order
+func (m *MemoryStore) ListVersions() ([]*models.Version, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	versions := []*models.Version{}
+	for _, ver := range m.versions {
+		v := *ver
+		versions = append(versions, &v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// GetShard returns a Shard struc of for a given shardId
+func (m *MemoryStore) GetShard(shardID uint32) (*models.Shard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.shards[shardID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return copyShard(s), nil
+}
+
+// copyShard returns a copy of a row of the shards table
+func copyShard(s *models.Shard) *models.Shard {
+	shard := *s
+	shard.Groups = append([]string{}, s.Groups...)
+	shard.Applied = append([]uint32{}, s.Applied...)
+	return &shard
+}
+
+// AddShard inserts a new shard at the given version. Returns the shardId.
+func (m *MemoryStore) AddShard(schemaName string, shardDSN string, version uint32) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastShardID++
+	now := m.now()
+	m.shards[m.lastShardID] = &models.Shard{ShardId: m.lastShardID, SchemaName: schemaName, ShardDSN: shardDSN,
+		Groups: []string{}, Version: version, Applied: []uint32{}, LastTaskHb: nullTime(now), LastUpdate: nullTime(now)}
+	return m.lastShardID, nil
+}
+
+// ListShards returns all the shards ordered by shardId
+func (m *MemoryStore) ListShards() ([]*models.Shard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.selectShards(func(s *models.Shard) bool { return true }), nil
+}
+
+// selectShards returns a copy of the shards matching keep, ordered by shardId
+func (m *MemoryStore) selectShards(keep func(s *models.Shard) bool) []*models.Shard {
+	shards := []*models.Shard{}
+	for _, s := range m.sortedShards() {
+		if keep(s) {
+			shards = append(shards, copyShard(s))
+		}
+	}
+	return shards
+}
+
+// sortedShards returns the rows of the shards table ordered by shardId
+func (m *MemoryStore) sortedShards() []*models.Shard {
+	shards := make([]*models.Shard, 0, len(m.shards))
+	for _, s := range m.shards {
+		shards = append(shards, s)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].ShardId < shards[j].ShardId })
+	return shards
+}
+
+// update applies set to the shard if it exists and matches where. Returns the number of
+// rows changed, 0 or 1, lastUpdate is only set when the row changes.
+func (m *MemoryStore) update(shardID uint32, where func(s *models.Shard) bool, set func(s *models.Shard)) int {
+	s, ok := m.shards[shardID]
+	if !ok || !where(s) {
+		return 0
+	}
+	before := copyShard(s)
+	set(s)
+	if reflect.DeepEqual(s, before) {
+		return 0
+	}
+	s.LastUpdate = nullTime(m.now())
+	return 1
+}
+
+// claimedBy returns a where clause matching the shards claimed by taskName
+func claimedBy(taskName string) func(s *models.Shard) bool {
+	return func(s *models.Shard) bool { return s.TaskName.Valid && s.TaskName.String == taskName }
+}
+
+// release clears the claim of a shard
+func release(s *models.Shard) {
+	s.TaskName = sql.NullString{}
+	s.TaskProgress = sql.NullString{}
+	s.AbortRequested = false
+}
+
+// releaseAttempt clears the claim of a shard that ended without a failure, the attempt
+// counted by the claim is given back
+func releaseAttempt(s *models.Shard) {
+	release(s)
+	if s.Attempts > 0 {
+		s.Attempts--
+	}
+}
+
+// SetShardVersion sets the version of a shard not claimed by a task, without applying anything.
+// The versions above it are not applied anymore.
+func (m *MemoryStore) SetShardVersion(shardID uint32, version uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := m.update(shardID, func(s *models.Shard) bool { return !s.TaskName.Valid }, func(s *models.Shard) {
+		s.Version = version
+		s.Attempts = 0
+		s.RetryAfter = models.NullTime{}
+		s.Failed = false
+	})
+	if count != 1 {
+		return fmt.Errorf("shard %d doesn't exist, is already at version %d or is claimed by a task", shardID, version)
+	}
+	// shardVersions isn't part of the row, lastUpdate isn't changed
+	m.shards[shardID].Applied = []uint32{}
+	return nil
+}
+
+// SetShardGroups sets the groups of a shard, sorted. The versions already skipped because
+// they didn't target the shard stay skipped.
+func (m *MemoryStore) SetShardGroups(shardID uint32, groups []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.shards[shardID]; !ok {
+		return fmt.Errorf("shard %d doesn't exist", shardID)
+	}
+	m.update(shardID, func(s *models.Shard) bool { return true }, func(s *models.Shard) {
+		s.Groups = append([]string{}, groups...)
+	})
+	return nil
+}
+
+// GetReferenceShard returns a shard, not claimed by any task, whose last applied version
+// on the table of version is version. Returns nil if there are none.
+func (m *MemoryStore) GetReferenceShard(version uint32) (*models.Shard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ver, ok := m.versions[version]
+	if !ok {
+		return nil, nil
+	}
+	var ref *models.Shard
+	for _, s := range m.sortedShards() {
+		if s.HasApplied(version) && !s.TaskName.Valid && !m.tableAlteredAfter(s, ver) &&
+			(ref == nil || s.LastUpdate.Time.After(ref.LastUpdate.Time)) {
+			ref = s
+		}
+	}
+	if ref == nil {
+		return nil, nil
+	}
+	return copyShard(ref), nil
+}
+
+// tableAlteredAfter returns true if the shard has applied a version above version on the
+// same table
+func (m *MemoryStore) tableAlteredAfter(s *models.Shard, version *models.Version) bool {
+	for v, ver := range m.versions {
+		if v > version.Version && ver.TableName == version.TableName && s.HasApplied(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// CountShardsByVersion returns the number of shards at each version
+func (m *MemoryStore) CountShardsByVersion() (map[uint32]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := map[uint32]int{}
+	for _, s := range m.shards {
+		counts[s.Version]++
+	}
+	return counts, nil
+}
+
+// claimable returns the shards ClaimShards can claim below version, in the order it claims them
+func (m *MemoryStore) claimable(version uint32) []*models.Shard {
+	now := m.now()
+	shards := []*models.Shard{}
+	for _, s := range m.sortedShards() {
+		if s.Version < version && !s.TaskName.Valid && !s.Failed &&
+			(!s.RetryAfter.Valid || !s.RetryAfter.Time.After(now)) {
+			shards = append(shards, s)
+		}
+	}
+	sort.SliceStable(shards, func(i, j int) bool {
+		return shards[i].LastUpdate.Time.Before(shards[j].LastUpdate.Time)
+	})
+	return shards
+}
+
+// ClaimShards claims up to limit shards that have a lower version and no taskName, skipping
+// the failed shards and the ones waiting for a retry. If shardIDs is not empty, only these
+// shards can be claimed. Claiming a shard counts as an attempt.
+func (m *MemoryStore) ClaimShards(version uint32, taskName string, limit int, shardIDs []uint32) (
+	[]*models.Shard, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	only := map[uint32]bool{}
+	for _, id := range shardIDs {
+		only[id] = true
+	}
+
+	now := m.now()
+	claimed := map[uint32]bool{}
+	for _, s := range m.claimable(version) {
+		if len(claimed) == limit {
+			break
+		}
+		if len(only) > 0 && !only[s.ShardId] {
+			continue
+		}
+		s.TaskName = nullString(taskName)
+		s.LastTaskHb = nullTime(now)
+		s.TaskProgress = sql.NullString{}
+		s.AbortRequested = false
+		s.Attempts++
+		s.RetryAfter = models.NullTime{}
+		s.LastUpdate = nullTime(now)
+		claimed[s.ShardId] = true
+	}
+	if len(claimed) == 0 {
+		return nil, nil
+	}
+
+	return m.selectShards(func(s *models.Shard) bool { return claimed[s.ShardId] }), nil
+}
+
+// GetClaimableShards returns up to limit shards ClaimShards could claim, in the order it
+// claims them, skipping the first offset ones. It claims nothing.
+func (m *MemoryStore) GetClaimableShards(version uint32, offset int, limit int) ([]*models.Shard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	shards := []*models.Shard{}
+	claimable := m.claimable(version)
+	for i := offset; i < len(claimable) && len(shards) < limit; i++ {
+		shards = append(shards, copyShard(claimable[i]))
+	}
+	return shards, nil
+}
+
+// LockClaims takes the lock serializing the claims limited per host, the timeout is ignored.
+// The lock is held until the returned func is called.
+func (m *MemoryStore) LockClaims(timeout time.Duration) (func(), error) {
+	m.claimMu.Lock()
+	return m.claimMu.Unlock, nil
+}
+
+// GetClaimedShards returns the shards claimed by a task, of any dispatcher
+func (m *MemoryStore) GetClaimedShards() ([]*models.Shard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.selectShards(func(s *models.Shard) bool { return s.TaskName.Valid }), nil
+}
+
+// UpdateShardTaskHeartbeat updates the lastTaskHb and taskProgress fields for the shardId
+// provided the taskName matches
+func (m *MemoryStore) UpdateShardTaskHeartbeat(shardID uint32, taskName string, progress string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// taskProgress is a varchar(255)
+	progress = truncate(progress, 255)
+	now := m.now()
+	count := m.update(shardID, claimedBy(taskName), func(s *models.Shard) {
+		s.LastTaskHb = nullTime(now)
+		s.TaskProgress = nullString(progress)
+	})
+	if count != 1 {
+		return fmt.Errorf("problem with the update, count = %d instead of 1", count)
+	}
+	return nil
+}
+
+// ShardUpgradeDone adds version to the versions applied to a shard claimed by taskName and
+// releases the shard
+func (m *MemoryStore) ShardUpgradeDone(shardID uint32, version uint32, taskName string) error {
+	return m.versionApplied(shardID, version, taskName, true)
+}
+
+// ShardVersionApplied adds version to the versions applied to a shard claimed by taskName,
+// the shard stays claimed for its other running tasks
+func (m *MemoryStore) ShardVersionApplied(shardID uint32, version uint32, taskName string) error {
+	return m.versionApplied(shardID, version, taskName, false)
+}
+
+// versionApplied adds version to the applied versions of a shard. The version of the shard
+// moves up to the last version below the first one not applied, the versions applied above
+// it are kept in Applied.
+func (m *MemoryStore) versionApplied(shardID uint32, version uint32, taskName string, andRelease bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.shards[shardID]
+	if !ok || !claimedBy(taskName)(s) {
+		return fmt.Errorf("problem with the update, count = %d instead of 1", 0)
+	}
+
+	current := s.Version
+	applied := map[uint32]bool{}
+	for _, v := range s.Applied {
+		applied[v] = true
+	}
+	if version > current {
+		applied[version] = true
+		for _, v := range m.sortedVersions() {
+			if v <= current {
+				continue
+			}
+			if !applied[v] {
+				break
+			}
+			current = v
+		}
+	}
+
+	now := m.now()
+	m.update(shardID, claimedBy(taskName), func(s *models.Shard) {
+		if andRelease {
+			release(s)
+			s.Attempts = 0
+			s.RetryAfter = models.NullTime{}
+			s.Failed = false
+		}
+		s.TaskProgress = sql.NullString{}
+		s.LastTaskHb = nullTime(now)
+		s.Version = current
+		s.Applied = []uint32{}
+		for _, v := range m.sortedVersions() {
+			if v > current && applied[v] {
+				s.Applied = append(s.Applied, v)
+			}
+		}
+	})
+	return nil
+}
+
+// sortedVersions returns the numbers of the versions, in order
+func (m *MemoryStore) sortedVersions() []uint32 {
+	versions := make([]uint32, 0, len(m.versions))
+	for v := range m.versions {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// GetStaleShards returns the shards claimed by a task, other than taskName, whose
+// heartbeat is older than timeout
+func (m *MemoryStore) GetStaleShards(timeout time.Duration, taskName string) ([]*models.Shard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limit := m.now().Add(-timeout.Truncate(time.Second))
+	return m.selectShards(func(s *models.Shard) bool {
+		return s.TaskName.Valid && s.TaskName.String != taskName && s.LastTaskHb.Time.Before(limit)
+	}), nil
+}
+
+// GetOldestTaskHeartbeat returns the age of the oldest heartbeat among the claimed shards.
+// Returns false if no shard is claimed.
+func (m *MemoryStore) GetOldestTaskHeartbeat() (time.Duration, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var oldest *models.Shard
+	for _, s := range m.shards {
+		if s.TaskName.Valid && (oldest == nil || s.LastTaskHb.Time.Before(oldest.LastTaskHb.Time)) {
+			oldest = s
+		}
+	}
+	if oldest == nil {
+		return 0, false, nil
+	}
+	return m.now().Sub(oldest.LastTaskHb.Time), true, nil
+}
+
+// ReleaseShard clears the taskName of the shard, provided it is still claimed by taskName.
+// The version of the shard is left unchanged. The release isn't a failure, the attempt
+// counted by the claim is given back.
+func (m *MemoryStore) ReleaseShard(shardID uint32, taskName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if count := m.update(shardID, claimedBy(taskName), releaseAttempt); count != 1 {
+		return fmt.Errorf("problem with the update, count = %d instead of 1", count)
+	}
+	return nil
+}
+
+// ShardRetryLater releases a shard claimed by taskName after a failed attempt, it won't
+// be claimed again before delay
+func (m *MemoryStore) ShardRetryLater(shardID uint32, taskName string, delay time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	retryAfter := m.now().Add(delay.Truncate(time.Second))
+	count := m.update(shardID, claimedBy(taskName), func(s *models.Shard) {
+		release(s)
+		s.RetryAfter = nullTime(retryAfter)
+	})
+	if count != 1 {
+		return fmt.Errorf("problem with the update, count = %d instead of 1", count)
+	}
+	return nil
+}
+
+// ShardFailed releases a shard claimed by taskName and marks it as failed, it won't be
+// claimed again until an operator resets it
+func (m *MemoryStore) ShardFailed(shardID uint32, taskName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := m.update(shardID, claimedBy(taskName), func(s *models.Shard) {
+		release(s)
+		s.Failed = true
+	})
+	if count != 1 {
+		return fmt.Errorf("problem with the update, count = %d instead of 1", count)
+	}
+	return nil
+}
+
+// ResetShardFailure clears the failed state and the attempts of a shard so that it is retried
+func (m *MemoryStore) ResetShardFailure(shardID uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := m.update(shardID, func(s *models.Shard) bool { return true }, func(s *models.Shard) {
+		s.Failed = false
+		s.Attempts = 0
+		s.RetryAfter = models.NullTime{}
+	})
+	if count != 1 {
+		return fmt.Errorf("shard %d doesn't exist or has no failure to reset", shardID)
+	}
+	return nil
+}
+
+// ReleaseTaskShards releases all the shards claimed by taskName, their versions are left unchanged
+// and the attempts counted by the claims are given back
+func (m *MemoryStore) ReleaseTaskShards(taskName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id := range m.shards {
+		m.update(id, claimedBy(taskName), releaseAttempt)
+	}
+	return nil
+}
+
+// RequestAbort flags the task running on the shard to be aborted by its dispatcher
+func (m *MemoryStore) RequestAbort(shardID uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := m.update(shardID, func(s *models.Shard) bool { return s.TaskName.Valid }, func(s *models.Shard) {
+		s.AbortRequested = true
+	})
+	if count != 1 {
+		return fmt.Errorf("shard %d has no running task", shardID)
+	}
+	return nil
+}
+
+// GetAbortRequests returns the ids of the shards claimed by taskName that are flagged to be aborted
+func (m *MemoryStore) GetAbortRequests(taskName string) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	shardIDs := []uint32{}
+	for _, s := range m.sortedShards() {
+		if claimedBy(taskName)(s) && s.AbortRequested {
+			shardIDs = append(shardIDs, s.ShardId)
+		}
+	}
+	return shardIDs, nil
+}
+
+// GetOpLog returns the oplog entries of a shard, for all versions when allVersions is true
+func (m *MemoryStore) GetOpLog(shardID uint32, version uint32, allVersions bool) ([]*models.OpLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := []*models.OpLog{}
+	for _, o := range m.oplog {
+		if o.ShardId == shardID && (o.Version == version || allVersions) {
+			entry := *o
+			entries = append(entries, &entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Version != entries[j].Version {
+			return entries[i].Version < entries[j].Version
+		}
+		return entries[i].Seq < entries[j].Seq
+	})
+	return entries, nil
+}
+
+// GetVersionDurations returns the average DDL durations of the versions, computed from the
+// oplog entries of the completed runs. The failed runs and the waits between the attempts
+// don't count.
+func (m *MemoryStore) GetVersionDurations() ([]VersionDuration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type key struct {
+		shardID, version uint32
+		run              uint8
+	}
+	type run struct {
+		first, last time.Time
+		completed   bool
+	}
+	runs := map[key]*run{}
+	for _, o := range m.oplog {
+		k := key{o.ShardId, o.Version, o.Run}
+		r, ok := runs[k]
+		if !ok {
+			r = &run{first: o.LastUpdate.Time, last: o.LastUpdate.Time}
+			runs[k] = r
+		}
+		if o.LastUpdate.Time.Before(r.first) {
+			r.first = o.LastUpdate.Time
+		}
+		if o.LastUpdate.Time.After(r.last) {
+			r.last = o.LastUpdate.Time
+		}
+		r.completed = r.completed || o.Message.String == "Completed OK"
+	}
+
+	byVersion := map[uint32]*VersionDuration{}
+	for k, r := range runs {
+		if !r.completed {
+			continue
+		}
+		vd, ok := byVersion[k.version]
+		if !ok {
+			vd = &VersionDuration{Version: k.version}
+			byVersion[k.version] = vd
+		}
+		// the sum until all the runs are counted
+		vd.Completed++
+		vd.AvgDuration += r.last.Sub(r.first)
+	}
+
+	durations := []VersionDuration{}
+	for _, vd := range byVersion {
+		vd.AvgDuration /= time.Duration(vd.Completed)
+		durations = append(durations, *vd)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i].Version < durations[j].Version })
+	return durations, nil
+}
+
+// Close does nothing, the content of the store is kept
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,324 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+// newMemoryStore returns a store with versions 1 and 2 and shards 1 to 3 at version 0, its
+// clock is now
+func newMemoryStore(t *testing.T, now *time.Time) *MemoryStore {
+	m := NewMemoryStore()
+	m.Now = func() time.Time { return *now }
+	for _, table := range []string{"t1", "t2"} {
+		_, err := m.AddVersion(&models.Version{Command: "SELECT 1", TableName: table, CmdType: "sql"})
+		tu.Ok(t, err)
+	}
+	for _, name := range []string{"shard_1", "shard_2", "shard_3"} {
+		_, err := m.AddShard(name, "user:pass@tcp(10.2.2.1:3306)/", 0)
+		tu.Ok(t, err)
+	}
+	return m
+}
+
+func shardIDs(shards []*models.Shard) []uint32 {
+	ids := []uint32{}
+	for _, s := range shards {
+		ids = append(ids, s.ShardId)
+	}
+	return ids
+}
+
+func TestMemoryVersions(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := newMemoryStore(t, &now)
+
+	version, err := m.GetMaxVersion()
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(2), version)
+
+	v, err := m.GetNextVersion(1)
+	tu.Ok(t, err)
+	tu.Equals(t, &models.Version{Version: 2, Command: "SELECT 1", TableName: "t2", CmdType: "sql", LastUpdate: now}, v)
+	_, err = m.GetNextVersion(2)
+	tu.NotOk(t, err)
+
+	_, err = m.AddVersion(&models.Version{Version: 2, Command: "SELECT 2", TableName: "t2", CmdType: "sql"})
+	tu.NotOk(t, err)
+	version, err = m.AddVersion(&models.Version{Version: 5, Command: "SELECT 5", TableName: "t5", CmdType: "sql"})
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(5), version)
+	version, err = m.AddVersion(&models.Version{Command: "SELECT 6", TableName: "t6", CmdType: "sql"})
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(6), version)
+}
+
+func TestTruncate(t *testing.T) {
+	tu.Equals(t, "50%", truncate("50%", 3))
+	tu.Equals(t, "copy", truncate("copy 50%", 4))
+	// 3 characters, 6 bytes
+	tu.Equals(t, "été", truncate("étés", 3))
+	tu.Equals(t, "", truncate("été", 0))
+}
+
+func TestMemoryClaimShards(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := newMemoryStore(t, &now)
+
+	// a shard is claimed by a single task
+	now = now.Add(time.Second)
+	claimed, err := m.ClaimShards(2, "task1", 1, nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{1}, shardIDs(claimed))
+	tu.Equals(t, uint8(1), claimed[0].Attempts)
+	claimed, err = m.ClaimShards(2, "task2", 5, []uint32{1, 2})
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{2}, shardIDs(claimed))
+
+	// only the claiming task can release the shard, which is then claimed last
+	tu.NotOk(t, m.ReleaseShard(1, "task2"))
+	tu.Ok(t, m.ReleaseShard(1, "task1"))
+	claimable, err := m.GetClaimableShards(2, 0, 5)
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{3, 1}, shardIDs(claimable))
+	claimable, err = m.GetClaimableShards(2, 1, 5)
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{1}, shardIDs(claimable))
+
+	tu.NotOk(t, m.UpdateShardTaskHeartbeat(2, "task1", "50%"))
+	tu.Ok(t, m.UpdateShardTaskHeartbeat(2, "task2", "50%"))
+
+	// the heartbeat of shard 2 gets stale
+	now = now.Add(2 * time.Minute)
+	stale, err := m.GetStaleShards(time.Minute, "task1")
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{2}, shardIDs(stale))
+	stale, err = m.GetStaleShards(time.Minute, "task2")
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{}, shardIDs(stale))
+	age, ok, err := m.GetOldestTaskHeartbeat()
+	tu.Ok(t, err)
+	tu.Assert(t, ok, "shard 2 is claimed")
+	tu.Equals(t, 2*time.Minute, age)
+
+	// an update changing nothing fails like in MySQL
+	tu.Ok(t, m.RequestAbort(2))
+	tu.NotOk(t, m.RequestAbort(2))
+	tu.NotOk(t, m.RequestAbort(3))
+	aborts, err := m.GetAbortRequests("task2")
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{2}, aborts)
+
+	// a shard waiting for a retry isn't claimable before its delay
+	tu.Ok(t, m.ShardRetryLater(2, "task2", time.Minute))
+	claimable, err = m.GetClaimableShards(2, 0, 5)
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{3, 1}, shardIDs(claimable))
+	now = now.Add(time.Minute)
+	claimable, err = m.GetClaimableShards(2, 0, 5)
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{3, 1, 2}, shardIDs(claimable))
+
+	// a failed shard isn't claimable until it is reset
+	_, err = m.ClaimShards(2, "task1", 1, []uint32{3})
+	tu.Ok(t, err)
+	tu.Ok(t, m.ShardFailed(3, "task1"))
+	claimable, err = m.GetClaimableShards(2, 0, 5)
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{1, 2}, shardIDs(claimable))
+	tu.Ok(t, m.ResetShardFailure(3))
+	tu.NotOk(t, m.ResetShardFailure(3))
+
+	claimed, err = m.ClaimShards(2, "task1", 5, nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{1, 2, 3}, shardIDs(claimed))
+	tu.Ok(t, m.ShardUpgradeDone(1, 1, "task1"))
+	tu.NotOk(t, m.SetShardVersion(2, 2))
+	tu.Ok(t, m.ReleaseTaskShards("task1"))
+	tu.Ok(t, m.SetShardVersion(2, 2))
+
+	counts, err := m.CountShardsByVersion()
+	tu.Ok(t, err)
+	tu.Equals(t, map[uint32]int{0: 1, 1: 1, 2: 1}, counts)
+	ref, err := m.GetReferenceShard(2)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(2), ref.ShardId)
+	_, ok, err = m.GetOldestTaskHeartbeat()
+	tu.Ok(t, err)
+	tu.Assert(t, !ok, "no shard is claimed")
+}
+
+func TestMemoryVersionApplied(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := newMemoryStore(t, &now)
+	_, err := m.AddVersion(&models.Version{Command: "SELECT 1", TableName: "t3", CmdType: "sql"})
+	tu.Ok(t, err)
+
+	// versions 2 and 3 applied before version 1, the shard stays claimed
+	_, err = m.ClaimShards(3, "task1", 1, []uint32{1})
+	tu.Ok(t, err)
+	tu.Ok(t, m.ShardVersionApplied(1, 3, "task1"))
+	tu.Ok(t, m.ShardVersionApplied(1, 2, "task1"))
+	shard, err := m.GetShard(1)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(0), shard.Version)
+	tu.Equals(t, []uint32{2, 3}, shard.Applied)
+	tu.Equals(t, "task1", shard.TaskName.String)
+	ref, err := m.GetReferenceShard(2)
+	tu.Ok(t, err)
+	tu.Assert(t, ref == nil, "shard 1 is claimed, got shard %v", ref)
+
+	tu.Ok(t, m.ShardUpgradeDone(1, 1, "task1"))
+	shard, err = m.GetShard(1)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(3), shard.Version)
+	tu.Equals(t, []uint32{}, shard.Applied)
+	tu.Assert(t, !shard.TaskName.Valid, "shard 1 should be released")
+	tu.NotOk(t, m.ShardVersionApplied(1, 1, "task1"))
+
+	// setting the version forgets the versions applied above it
+	_, err = m.ClaimShards(3, "task1", 1, []uint32{2})
+	tu.Ok(t, err)
+	tu.Ok(t, m.ShardUpgradeDone(2, 3, "task1"))
+	ref, err = m.GetReferenceShard(3)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(1), ref.ShardId)
+	tu.Ok(t, m.SetShardVersion(2, 1))
+	shard, err = m.GetShard(2)
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{}, shard.Applied)
+}
+
+func TestMemoryReferenceShard(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := newMemoryStore(t, &now)
+	// version 3 alters t1 again
+	_, err := m.AddVersion(&models.Version{Command: "SELECT 1", TableName: "t1", CmdType: "sql"})
+	tu.Ok(t, err)
+
+	tu.Ok(t, m.SetShardVersion(2, 1))
+	now = now.Add(time.Minute)
+	tu.Ok(t, m.SetShardVersion(1, 3))
+
+	// shard 1, the most recently updated, has t1 at version 3
+	ref, err := m.GetReferenceShard(1)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(2), ref.ShardId)
+	ref, err = m.GetReferenceShard(2)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(1), ref.ShardId)
+
+	now = now.Add(time.Minute)
+	tu.Ok(t, m.SetShardVersion(2, 3))
+	ref, err = m.GetReferenceShard(1)
+	tu.Ok(t, err)
+	tu.Assert(t, ref == nil, "no shard has t1 at version 1, got shard %v", ref)
+	ref, err = m.GetReferenceShard(3)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(2), ref.ShardId)
+}
+
+func TestMemoryShardGroups(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := newMemoryStore(t, &now)
+
+	shard, err := m.GetShard(1)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{}, shard.Groups)
+
+	now = now.Add(time.Minute)
+	tu.Ok(t, m.SetShardGroups(1, []string{"archive", "eu"}))
+	tu.NotOk(t, m.SetShardGroups(42, []string{"eu"}))
+	shard, err = m.GetShard(1)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"archive", "eu"}, shard.Groups)
+	tu.Equals(t, now, shard.LastUpdate.Time)
+
+	// unchanged
+	now = now.Add(time.Minute)
+	tu.Ok(t, m.SetShardGroups(1, []string{"archive", "eu"}))
+	shard, err = m.GetShard(1)
+	tu.Ok(t, err)
+	tu.Equals(t, now.Add(-time.Minute), shard.LastUpdate.Time)
+}
+
+func TestMemoryReleaseGivesBackAttempt(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := newMemoryStore(t, &now)
+
+	// a release isn't a failure, unlike a retry
+	_, err := m.ClaimShards(2, "task1", 2, nil)
+	tu.Ok(t, err)
+	tu.Ok(t, m.ReleaseShard(1, "task1"))
+	tu.Ok(t, m.ShardRetryLater(2, "task1", 0))
+	claimed, err := m.ClaimShards(2, "task1", 2, nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{1, 2}, shardIDs(claimed))
+	tu.Equals(t, uint8(1), claimed[0].Attempts)
+	tu.Equals(t, uint8(2), claimed[1].Attempts)
+
+	tu.Ok(t, m.ReleaseTaskShards("task1"))
+	shard, err := m.GetShard(2)
+	tu.Ok(t, err)
+	tu.Equals(t, uint8(1), shard.Attempts)
+
+	// an entry written after the reset of the attempts keeps the run of the claim
+	_, err = m.ClaimShards(2, "task1", 1, []uint32{2})
+	tu.Ok(t, err)
+	tu.Ok(t, m.ShardUpgradeDone(2, 1, "task1"))
+	tu.Ok(t, m.AddOpLogRun(2, 1, 2, "task1", "skipped"))
+	entries, err := m.GetOpLog(2, 1, false)
+	tu.Ok(t, err)
+	tu.Equals(t, uint8(2), entries[0].Run)
+}
+
+func TestMemoryVersionDurations(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := newMemoryStore(t, &now)
+
+	// the first run fails and is retried an hour later
+	_, err := m.ClaimShards(1, "task1", 1, []uint32{1})
+	tu.Ok(t, err)
+	tu.Ok(t, m.AddOpLog(1, 1, "task1", "Starting", "", ""))
+	now = now.Add(5 * time.Minute)
+	tu.Ok(t, m.AddOpLog(1, 1, "task1", "Error: command", "", ""))
+	tu.Ok(t, m.ShardRetryLater(1, "task1", time.Hour))
+	now = now.Add(time.Hour)
+	_, err = m.ClaimShards(1, "task1", 1, []uint32{1})
+	tu.Ok(t, err)
+	tu.Ok(t, m.AddOpLog(1, 1, "task1", "Starting", "", ""))
+	now = now.Add(10 * time.Minute)
+	tu.Ok(t, m.AddOpLog(1, 1, "task1", "Completed OK", "", ""))
+
+	durations, err := m.GetVersionDurations()
+	tu.Ok(t, err)
+	tu.Equals(t, []VersionDuration{{Version: 1, Completed: 1, AvgDuration: 10 * time.Minute}}, durations)
+}
+
+func TestMemoryOpLog(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := newMemoryStore(t, &now)
+
+	_, err := m.ClaimShards(1, "task1", 2, nil)
+	tu.Ok(t, err)
+	tu.Ok(t, m.AddOpLog(1, 1, "task1", "Starting", "", ""))
+	tu.Ok(t, m.AddOpLog(2, 1, "task1", "Starting", "", ""))
+	now = now.Add(10 * time.Minute)
+	tu.Ok(t, m.AddOpLog(1, 1, "task1", "Completed OK", "", ""))
+	now = now.Add(10 * time.Minute)
+	tu.Ok(t, m.AddOpLog(2, 1, "task1", "Completed OK", "", ""))
+
+	entries, err := m.GetOpLog(1, 1, false)
+	tu.Ok(t, err)
+	tu.Equals(t, 2, len(entries))
+	tu.Equals(t, uint32(2), entries[1].Seq)
+	tu.Equals(t, uint8(1), entries[1].Run)
+	tu.Equals(t, "Completed OK", entries[1].Message.String)
+
+	durations, err := m.GetVersionDurations()
+	tu.Ok(t, err)
+	tu.Equals(t, []VersionDuration{{Version: 1, Completed: 2, AvgDuration: 15 * time.Minute}}, durations)
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+)
+
+// Store holds the metadata of the shards and the versions: the shards table, the versions
+// table and the oplog. Database stores them in MySQL and MemoryStore in memory, with the
+// same semantics.
+type Store interface {
+	// versions
+	GetMaxVersion() (uint32, error)
+	GetNextVersion(version uint32) (*models.Version, error)
+	GetVersion(version uint32) (*models.Version, error)
+	AddVersion(v *models.Version) (uint32, error)
+	ListVersions() ([]*models.Version, error)
+
+	// shards
+	GetShard(shardID uint32) (*models.Shard, error)
+	AddShard(schemaName string, shardDSN string, version uint32) (uint32, error)
+	ListShards() ([]*models.Shard, error)
+	SetShardVersion(shardID uint32, version uint32) error
+	SetShardGroups(shardID uint32, groups []string) error
+	GetReferenceShard(version uint32) (*models.Shard, error)
+	CountShardsByVersion() (map[uint32]int, error)
+
+	// claims of the shards by the tasks
+	ClaimShards(version uint32, taskName string, limit int, shardIDs []uint32) ([]*models.Shard, error)
+	GetClaimableShards(version uint32, offset int, limit int) ([]*models.Shard, error)
+	GetClaimedShards() ([]*models.Shard, error)
+	LockClaims(timeout time.Duration) (func(), error)
+	UpdateShardTaskHeartbeat(shardID uint32, taskName string, progress string) error
+	ShardUpgradeDone(shardID uint32, version uint32, taskName string) error
+	ShardVersionApplied(shardID uint32, version uint32, taskName string) error
+	GetStaleShards(timeout time.Duration, taskName string) ([]*models.Shard, error)
+	GetOldestTaskHeartbeat() (time.Duration, bool, error)
+	ReleaseShard(shardID uint32, taskName string) error
+	ShardRetryLater(shardID uint32, taskName string, delay time.Duration) error
+	ShardFailed(shardID uint32, taskName string) error
+	ResetShardFailure(shardID uint32) error
+	ReleaseTaskShards(taskName string) error
+	RequestAbort(shardID uint32) error
+	GetAbortRequests(taskName string) ([]uint32, error)
+
+	// oplog
+	AddOpLog(shardID uint32, version uint32, taskName string, message string, stdout string, stderr string) error
+	AddOpLogRun(shardID uint32, version uint32, run uint8, taskName string, message string) error
+	GetOpLog(shardID uint32, version uint32, allVersions bool) ([]*models.OpLog, error)
+	GetVersionDurations() ([]VersionDuration, error)
+
+	// Close releases the resources of the store
+	Close() error
+}
+
+var (
+	_ Store = (*Database)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
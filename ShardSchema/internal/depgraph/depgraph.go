@@ -0,0 +1,172 @@
+// Package depgraph resolves the dependencies between the versions. A version depends on the
+// previous version altering the same table, two alters of a table never run concurrently, and
+// on the versions listed in its dependsOn column. A version only depends on earlier versions,
+// the graph has no cycle and the versions of a shard can still be applied in numeric order.
+//
+// A version with a target only applies to the shards of the matching groups. On the other
+// shards it is skipped, recorded as applied once its dependencies are, so that the versions
+// depending on it don't wait for it.
+package depgraph
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/groups"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+)
+
+// Graph is the dependency graph of the versions
+type Graph struct {
+	versions []uint32 // in order
+	deps     map[uint32][]uint32
+	targets  map[uint32]*groups.Expr // the versions without target are not in the map
+}
+
+// ParseDependsOn parses a dependsOn column, a comma separated list of versions. An empty
+// string is a version without other dependency than the previous version of its table.
+func ParseDependsOn(dependsOn string) ([]uint32, error) {
+	deps := []uint32{}
+	for _, field := range strings.Split(dependsOn, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		version, err := strconv.ParseUint(field, 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("invalid version %q in the dependencies %q", field, dependsOn)
+		}
+		deps = append(deps, uint32(version))
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i] < deps[j] })
+	return deps, nil
+}
+
+// FormatDependsOn returns the dependsOn column of a list of versions
+func FormatDependsOn(deps []uint32) string {
+	fields := make([]string, 0, len(deps))
+	for _, v := range deps {
+		fields = append(fields, strconv.FormatUint(uint64(v), 10))
+	}
+	return strings.Join(fields, ",")
+}
+
+// New returns the graph of versions. A dependency on an unknown or on a later version, or an
+// invalid target, is an error.
+func New(versions []*models.Version) (*Graph, error) {
+	sorted := make([]*models.Version, len(versions))
+	copy(sorted, versions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	g := &Graph{versions: make([]uint32, 0, len(sorted)), deps: make(map[uint32][]uint32, len(sorted)),
+		targets: map[uint32]*groups.Expr{}}
+	// the last version altering each table
+	lastOfTable := map[string]uint32{}
+	for _, v := range sorted {
+		deps := []uint32{}
+		if v.DependsOn.Valid {
+			var err error
+			if deps, err = ParseDependsOn(v.DependsOn.String); err != nil {
+				return nil, fmt.Errorf("version %d: %s", v.Version, err)
+			}
+			for _, dep := range deps {
+				if _, ok := g.deps[dep]; !ok {
+					return nil, fmt.Errorf("version %d depends on version %d, which is not an earlier version",
+						v.Version, dep)
+				}
+			}
+		}
+		if last, ok := lastOfTable[v.TableName]; ok && !contains(deps, last) {
+			deps = append(deps, last)
+			sort.Slice(deps, func(i, j int) bool { return deps[i] < deps[j] })
+		}
+
+		if v.Target.Valid {
+			target, err := groups.Parse(v.Target.String)
+			if err != nil {
+				return nil, fmt.Errorf("version %d: %s", v.Version, err)
+			}
+			g.targets[v.Version] = target
+		}
+
+		g.versions = append(g.versions, v.Version)
+		g.deps[v.Version] = deps
+		lastOfTable[v.TableName] = v.Version
+	}
+	return g, nil
+}
+
+// Max returns the highest version, 0 if there are none
+func (g *Graph) Max() uint32 {
+	if len(g.versions) == 0 {
+		return 0
+	}
+	return g.versions[len(g.versions)-1]
+}
+
+// Deps returns the versions version depends on, in order
+func (g *Graph) Deps(version uint32) []uint32 {
+	return g.deps[version]
+}
+
+// Target returns the target of version, nil if it applies to all the shards
+func (g *Graph) Target(version uint32) *groups.Expr {
+	return g.targets[version]
+}
+
+// Targets returns true if version applies to the shard
+func (g *Graph) Targets(version uint32, shard *models.Shard) bool {
+	target, ok := g.targets[version]
+	return !ok || target.Match(shard.Groups)
+}
+
+// Pending returns the versions not yet applied to the shard, in order
+func (g *Graph) Pending(shard *models.Shard) []uint32 {
+	pending := []uint32{}
+	for _, v := range g.versions {
+		if !shard.HasApplied(v) {
+			pending = append(pending, v)
+		}
+	}
+	return pending
+}
+
+// Ready returns the versions targeting the shard, not yet applied, whose dependencies are
+// all applied, in order. They are independent from each other and can run concurrently.
+func (g *Graph) Ready(shard *models.Shard) []uint32 {
+	return g.ready(shard, true)
+}
+
+// Skippable returns the versions not targeting the shard, not yet recorded as skipped, whose
+// dependencies are all applied, in order
+func (g *Graph) Skippable(shard *models.Shard) []uint32 {
+	return g.ready(shard, false)
+}
+
+// ready returns the pending versions whose dependencies are all applied and that target the
+// shard, or not
+func (g *Graph) ready(shard *models.Shard, targeted bool) []uint32 {
+	ready := []uint32{}
+	for _, v := range g.Pending(shard) {
+		ok := g.Targets(v, shard) == targeted
+		for _, dep := range g.deps[v] {
+			ok = ok && shard.HasApplied(dep)
+		}
+		if ok {
+			ready = append(ready, v)
+		}
+	}
+	return ready
+}
+
+// contains returns true if version is in versions
+func contains(versions []uint32, version uint32) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
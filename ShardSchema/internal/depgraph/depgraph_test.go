@@ -0,0 +1,98 @@
+package depgraph
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: true}
+}
+
+func TestGraph(t *testing.T) {
+	versions := []*models.Version{
+		{Version: 4, TableName: "t1", DependsOn: nullString("2, 3")},
+		{Version: 1, TableName: "t1"},
+		{Version: 2, TableName: "t2"},
+		{Version: 3, TableName: "t1"},
+		{Version: 5, TableName: "t3", DependsOn: nullString("")},
+		// the previous version of the table is kept with explicit dependencies
+		{Version: 6, TableName: "t1", DependsOn: nullString("5")},
+		{Version: 7, TableName: "t3", DependsOn: nullString("5,6")},
+	}
+	g, err := New(versions)
+	tu.Ok(t, err)
+
+	tu.Equals(t, uint32(7), g.Max())
+	tu.Equals(t, []uint32{}, g.Deps(1))
+	tu.Equals(t, []uint32{}, g.Deps(2))
+	tu.Equals(t, []uint32{1}, g.Deps(3))
+	tu.Equals(t, []uint32{2, 3}, g.Deps(4))
+	tu.Equals(t, []uint32{}, g.Deps(5))
+	tu.Equals(t, []uint32{4, 5}, g.Deps(6))
+	tu.Equals(t, []uint32{5, 6}, g.Deps(7))
+
+	shard := &models.Shard{Version: 0}
+	tu.Equals(t, []uint32{1, 2, 5}, g.Ready(shard))
+	shard = &models.Shard{Version: 1, Applied: []uint32{5}}
+	tu.Equals(t, []uint32{2, 3, 4, 6, 7}, g.Pending(shard))
+	tu.Equals(t, []uint32{2, 3}, g.Ready(shard))
+	shard = &models.Shard{Version: 3}
+	tu.Equals(t, []uint32{4, 5}, g.Ready(shard))
+	shard = &models.Shard{Version: 5}
+	tu.Equals(t, []uint32{6}, g.Ready(shard))
+	shard = &models.Shard{Version: 7}
+	tu.Equals(t, []uint32{}, g.Ready(shard))
+}
+
+func TestGraphTargets(t *testing.T) {
+	versions := []*models.Version{
+		{Version: 1, TableName: "t1"},
+		{Version: 2, TableName: "t1", Target: nullString("eu & !archive")},
+		{Version: 3, TableName: "t1"},
+		{Version: 4, TableName: "t2", Target: nullString("archive")},
+	}
+	g, err := New(versions)
+	tu.Ok(t, err)
+	tu.Equals(t, "eu & !archive", g.Target(2).String())
+	tu.Assert(t, g.Target(3) == nil, "version 3 has no target")
+
+	eu := &models.Shard{Version: 1, Groups: []string{"eu"}}
+	tu.Equals(t, []uint32{2}, g.Ready(eu))
+	tu.Equals(t, []uint32{4}, g.Skippable(eu))
+
+	// version 3 waits for version 2 to be skipped
+	archive := &models.Shard{Version: 0, Groups: []string{"archive", "eu"}}
+	tu.Equals(t, []uint32{1, 4}, g.Ready(archive))
+	tu.Equals(t, []uint32{}, g.Skippable(archive))
+	archive.Version = 1
+	tu.Equals(t, []uint32{4}, g.Ready(archive))
+	tu.Equals(t, []uint32{2}, g.Skippable(archive))
+	archive.Applied = []uint32{2}
+	tu.Equals(t, []uint32{3, 4}, g.Ready(archive))
+	tu.Equals(t, []uint32{}, g.Skippable(archive))
+}
+
+func TestGraphErrors(t *testing.T) {
+	_, err := New([]*models.Version{{Version: 1, TableName: "t1", DependsOn: nullString("2")},
+		{Version: 2, TableName: "t1"}})
+	tu.NotOk(t, err)
+	_, err = New([]*models.Version{{Version: 2, TableName: "t1", DependsOn: nullString("1")}})
+	tu.NotOk(t, err)
+	_, err = New([]*models.Version{{Version: 1, TableName: "t1", DependsOn: nullString("x")}})
+	tu.NotOk(t, err)
+	_, err = New([]*models.Version{{Version: 1, TableName: "t1", Target: nullString("eu &")}})
+	tu.NotOk(t, err)
+}
+
+func TestParseDependsOn(t *testing.T) {
+	deps, err := ParseDependsOn(" 4,1 ,")
+	tu.Ok(t, err)
+	tu.Equals(t, []uint32{1, 4}, deps)
+	tu.Equals(t, "1,4", FormatDependsOn(deps))
+	_, err = ParseDependsOn("0")
+	tu.NotOk(t, err)
+}
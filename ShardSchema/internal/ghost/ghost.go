@@ -0,0 +1,131 @@
+package ghost
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// Commands of the interactive socket of gh-ost
+const (
+	Status     = "status"
+	Throttle   = "throttle"
+	NoThrottle = "no-throttle"
+	Unpostpone = "unpostpone"
+)
+
+// Files are the files used to control a gh-ost run
+type Files struct {
+	Conf     string // credentials, in the [client] section
+	Socket   string // unix socket gh-ost serves its interactive commands on
+	Postpone string // the cut-over is postponed while this file exists
+}
+
+// NewFiles returns the files of a gh-ost run, in dir, named after name
+func NewFiles(dir string, name string) Files {
+	return Files{
+		Conf:     filepath.Join(dir, "gh-ost."+name+".cnf"),
+		Socket:   filepath.Join(dir, "gh-ost."+name+".sock"),
+		Postpone: filepath.Join(dir, "gh-ost."+name+".postpone"),
+	}
+}
+
+// Create writes the credentials file, readable only by the current user, and the
+// postpone flag file
+func (f Files) Create(user string, password string) error {
+	conf := fmt.Sprintf("[client]\nuser=%s\npassword=%s\n", quote(user), quote(password))
+	if err := ioutil.WriteFile(f.Conf, []byte(conf), 0600); err != nil {
+		return errors.Wrap(err, "cannot write the gh-ost credentials file")
+	}
+	if err := ioutil.WriteFile(f.Postpone, nil, 0600); err != nil {
+		f.Remove()
+		return errors.Wrap(err, "cannot create the gh-ost postpone flag file")
+	}
+	return nil
+}
+
+// Remove removes the files of the run
+func (f Files) Remove() {
+	os.Remove(f.Conf)
+	os.Remove(f.Socket)
+	os.Remove(f.Postpone)
+}
+
+// quote quotes a value of the gh-ost config file
+func quote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// Args returns the arguments of gh-ost to apply alter to table in schema, on the server of
+// dsn. gh-ost only connects through tcp.
+func Args(dsn *mysql.Config, schema string, table string, alter string, files Files) ([]string, error) {
+	if dsn.Net != "tcp" {
+		return nil, fmt.Errorf("gh-ost needs a tcp connection, not %s", dsn.Net)
+	}
+
+	host, port, err := net.SplitHostPort(dsn.Addr)
+	if err != nil {
+		host, port = dsn.Addr, "3306"
+	}
+
+	return []string{
+		"--host=" + host,
+		"--port=" + port,
+		"--conf=" + files.Conf,
+		"--database=" + schema,
+		"--table=" + table,
+		"--alter=" + alter,
+		// the shard DSN is the server to alter
+		"--allow-on-master",
+		"--serve-socket-file=" + files.Socket,
+		"--initially-drop-socket-file",
+		"--postpone-cut-over-flag-file=" + files.Postpone,
+		"--initially-drop-ghost-table",
+		"--execute",
+	}, nil
+}
+
+// SendCommand sends a command to the interactive socket of gh-ost and returns the answer
+func SendCommand(socket string, command string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot connect to the gh-ost socket")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err = fmt.Fprintln(conn, command); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("cannot send %q to gh-ost", command))
+	}
+
+	// gh-ost closes the connection once it answered
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("cannot read the answer of gh-ost to %q", command))
+	}
+	return string(answer), nil
+}
+
+// ParseStatus returns the progress line from the answer of gh-ost to the status command,
+// like:
+// Copy: 1000/2915 34.3%; Applied: 0; Backlog: 0/1000; Time: 10s(total), 9s(copy); ...; State: migrating; ETA: 19s
+// and if gh-ost is waiting for the cut-over to be unpostponed
+func ParseStatus(status string) (string, bool) {
+	progress := ""
+	scanner := bufio.NewScanner(strings.NewReader(status))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "Copy:") {
+			progress = line
+		}
+	}
+	return progress, strings.Contains(progress, "State: postponing cut-over")
+}
@@ -0,0 +1,120 @@
+package ghost
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestArgs(t *testing.T) {
+	files := NewFiles("/tmp", "1.2")
+	dsn := &mysql.Config{User: "user", Passwd: "pass", Net: "tcp", Addr: "10.2.2.1:3307"}
+
+	args, err := Args(dsn, "shard_1", "t1", "ADD COLUMN c2 INT", files)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{
+		"--host=10.2.2.1",
+		"--port=3307",
+		"--conf=/tmp/gh-ost.1.2.cnf",
+		"--database=shard_1",
+		"--table=t1",
+		"--alter=ADD COLUMN c2 INT",
+		"--allow-on-master",
+		"--serve-socket-file=/tmp/gh-ost.1.2.sock",
+		"--initially-drop-socket-file",
+		"--postpone-cut-over-flag-file=/tmp/gh-ost.1.2.postpone",
+		"--initially-drop-ghost-table",
+		"--execute",
+	}, args)
+	for _, arg := range args {
+		tu.Assert(t, arg != "pass", "the password must not be on the command line")
+	}
+
+	dsn.Addr = "10.2.2.1"
+	args, err = Args(dsn, "shard_1", "t1", "ADD COLUMN c2 INT", files)
+	tu.Ok(t, err)
+	tu.Equals(t, "--port=3306", args[1])
+
+	dsn.Net = "unix"
+	_, err = Args(dsn, "shard_1", "t1", "ADD COLUMN c2 INT", files)
+	tu.NotOk(t, err)
+}
+
+func TestCreateFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghost")
+	tu.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	files := NewFiles(dir, "1.2")
+	tu.Ok(t, files.Create("user", `pa"ss\`))
+
+	conf, err := ioutil.ReadFile(files.Conf)
+	tu.Ok(t, err)
+	tu.Equals(t, "[client]\nuser=\"user\"\npassword=\"pa\\\"ss\\\\\"\n", string(conf))
+	info, err := os.Stat(files.Conf)
+	tu.Ok(t, err)
+	tu.Equals(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = os.Stat(files.Postpone)
+	tu.Ok(t, err)
+
+	files.Remove()
+	_, err = os.Stat(files.Conf)
+	tu.Assert(t, os.IsNotExist(err), "the credentials file must be removed")
+}
+
+func TestParseStatus(t *testing.T) {
+	status := "# Migrating `shard_1`.`t1`; Ghost table is `shard_1`.`_t1_gho`\n" +
+		"# Serving on unix socket: /tmp/gh-ost.1.2.sock\n" +
+		"Copy: 1000/2915 34.3%; Applied: 0; Backlog: 0/1000; Time: 10s(total), 9s(copy); State: migrating; ETA: 19s\n"
+
+	progress, postponing := ParseStatus(status)
+	tu.Equals(t, "Copy: 1000/2915 34.3%; Applied: 0; Backlog: 0/1000; Time: 10s(total), 9s(copy); "+
+		"State: migrating; ETA: 19s", progress)
+	tu.Assert(t, !postponing, "not postponing the cut-over")
+
+	_, postponing = ParseStatus("Copy: 2915/2915 100.0%; Applied: 0; State: postponing cut-over; ETA: due\n")
+	tu.Assert(t, postponing, "postponing the cut-over")
+
+	progress, postponing = ParseStatus("")
+	tu.Equals(t, "", progress)
+	tu.Assert(t, !postponing, "empty status")
+}
+
+func TestSendCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghost")
+	tu.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "gh-ost.sock")
+	l, err := net.Listen("unix", socket)
+	tu.Ok(t, err)
+	defer l.Close()
+
+	// a fake gh-ost answering one command
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+		conn.Write([]byte("throttled\n"))
+	}()
+
+	answer, err := SendCommand(socket, Throttle, time.Second)
+	tu.Ok(t, err)
+	tu.Equals(t, "throttled\n", answer)
+	tu.Equals(t, "throttle\n", <-received)
+
+	_, err = SendCommand(filepath.Join(dir, "missing.sock"), Status, time.Second)
+	tu.NotOk(t, err)
+}
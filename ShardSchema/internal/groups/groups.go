@@ -0,0 +1,176 @@
+// Package groups parses the groups of the shards and the target expressions of the versions.
+// A shard belongs to a list of groups, like "eu,premium", and a version targets the shards
+// matching an expression of groups: "," or "|" for or, "&" for and, "!" for not, and
+// parentheses, ex "eu & !archive" or "(eu, us) & premium". The and binds tighter than the or.
+package groups
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Expr is a parsed target expression
+type Expr struct {
+	source string
+	match  func(groups map[string]bool) bool
+}
+
+// validName returns true if name is a valid group name: letters, digits, "_" and "-"
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ParseGroups parses the groups of a shard, a comma separated list. The groups are returned
+// sorted and without duplicates, an empty string is a shard without group.
+func ParseGroups(list string) ([]string, error) {
+	seen := map[string]bool{}
+	groups := []string{}
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !validName(field) {
+			return nil, fmt.Errorf("invalid group name %q in %q", field, list)
+		}
+		if !seen[field] {
+			seen[field] = true
+			groups = append(groups, field)
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// FormatGroups returns the comma separated list of groups
+func FormatGroups(groups []string) string {
+	return strings.Join(groups, ",")
+}
+
+// Parse parses a target expression
+func Parse(expr string) (*Expr, error) {
+	p := &parser{input: expr}
+	match, err := p.or()
+	if err == nil && p.peek() != 0 {
+		err = fmt.Errorf("unexpected %q at position %d", p.peek(), p.pos+1)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %s", expr, err)
+	}
+	return &Expr{source: strings.TrimSpace(expr), match: match}, nil
+}
+
+// Match returns true if a shard in groups is targeted by the expression
+func (e *Expr) Match(groups []string) bool {
+	set := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		set[g] = true
+	}
+	return e.match(set)
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+// parser is a recursive descent parser of the expressions
+type parser struct {
+	input string
+	pos   int
+}
+
+// peek skips the spaces and returns the next character, 0 at the end of the input
+func (p *parser) peek() byte {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+	if p.pos == len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// or parses: and { ("," | "|") and }
+func (p *parser) or() (func(map[string]bool) bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.peek(); c == ',' || c == '|'; c = p.peek() {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(g map[string]bool) bool { return l(g) || right(g) }
+	}
+	return left, nil
+}
+
+// and parses: not { "&" not }
+func (p *parser) and() (func(map[string]bool) bool, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == '&' {
+		p.pos++
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(g map[string]bool) bool { return l(g) && right(g) }
+	}
+	return left, nil
+}
+
+// not parses: "!" not | "(" or ")" | name
+func (p *parser) not() (func(map[string]bool) bool, error) {
+	switch c := p.peek(); c {
+	case '!':
+		p.pos++
+		operand, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(g map[string]bool) bool { return !operand(g) }, nil
+
+	case '(':
+		p.pos++
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos+1)
+		}
+		p.pos++
+		return inner, nil
+
+	case 0:
+		return nil, fmt.Errorf("missing group name at the end")
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && validName(p.input[p.pos:p.pos+1]) {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	if name == "" {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	return func(g map[string]bool) bool { return g[name] }, nil
+}
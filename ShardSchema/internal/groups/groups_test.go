@@ -0,0 +1,62 @@
+package groups
+
+import (
+	"testing"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestParseGroups(t *testing.T) {
+	groups, err := ParseGroups(" premium,eu ,, premium")
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"eu", "premium"}, groups)
+	tu.Equals(t, "eu,premium", FormatGroups(groups))
+
+	groups, err = ParseGroups("")
+	tu.Ok(t, err)
+	tu.Equals(t, []string{}, groups)
+
+	_, err = ParseGroups("eu,premium tenants")
+	tu.NotOk(t, err)
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr   string
+		groups []string
+		match  bool
+	}{
+		{"eu", []string{"eu"}, true},
+		{"eu", []string{"us"}, false},
+		{"eu, us", []string{"us"}, true},
+		{"eu | us", []string{"apac"}, false},
+		{"eu & premium", []string{"eu"}, false},
+		{"eu & premium", []string{"eu", "premium"}, true},
+		{"!archive", []string{}, true},
+		{"!archive", []string{"archive", "eu"}, false},
+		{"eu & !archive", []string{"eu"}, true},
+		// the and binds tighter than the or
+		{"us, eu & premium", []string{"us"}, true},
+		{"(us, eu) & premium", []string{"us"}, false},
+		{"!(us | eu)", []string{"apac"}, true},
+		{"!!eu", []string{"eu"}, true},
+	}
+
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		tu.Ok(t, err)
+		tu.Assert(t, e.Match(test.groups) == test.match, "%q with the groups %v: expected %v",
+			test.expr, test.groups, test.match)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "eu &", "(eu", "eu)", "eu us", "eu & & us", "eu.us", "!"} {
+		_, err := Parse(expr)
+		tu.Assert(t, err != nil, "%q should not parse", expr)
+	}
+
+	e, err := Parse(" eu & !archive ")
+	tu.Ok(t, err)
+	tu.Equals(t, "eu & !archive", e.String())
+}
@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strings"
+)
+
+// Options of the logger, from the config file
+type Options struct {
+	Level    string // debug, info, warn or error
+	Output   string // stderr, syslog or the path of a file
+	Format   string // text or json
+	MaxSize  int64  // size of the log file before it is rotated, in bytes, 0 to never rotate it
+	MaxFiles int    // number of rotated log files kept
+}
+
+// ParseLevel parses a level name, case insensitive
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+		return l, fmt.Errorf("invalid log level %q, expecting debug, info, warn or error", level)
+	}
+	return l, nil
+}
+
+// New creates the logger described by o. The returned io.Closer closes its output, the
+// caller closes it once the logger isn't used anymore.
+func New(o Options) (*slog.Logger, io.Closer, error) {
+	level, err := ParseLevel(o.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var w io.Writer
+	var closer io.Closer = nopCloser{}
+	switch o.Output {
+	case "", "stderr":
+		w = os.Stderr
+	case "syslog":
+		sw, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "shardschema")
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot connect to syslog: %s", err)
+		}
+		w, closer = sw, sw
+	default:
+		rf, err := OpenRotatingFile(o.Output, o.MaxSize, o.MaxFiles)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closer = rf, rf
+	}
+
+	handler, err := NewHandler(w, o.Format, level)
+	if err != nil {
+		closer.Close()
+		return nil, nil, err
+	}
+	return slog.New(handler), closer, nil
+}
+
+// NewHandler returns a text or json handler writing the records of level and above to w
+func NewHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, expecting text or json", format)
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
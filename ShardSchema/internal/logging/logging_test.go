@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("debug")
+	tu.Ok(t, err)
+	tu.Equals(t, slog.LevelDebug, level)
+	level, err = ParseLevel("WARN")
+	tu.Ok(t, err)
+	tu.Equals(t, slog.LevelWarn, level)
+
+	_, err = ParseLevel("verbose")
+	tu.NotOk(t, err)
+}
+
+func TestNewHandler(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := NewHandler(&buf, "json", slog.LevelInfo)
+	tu.Ok(t, err)
+
+	logger := slog.New(handler).With("shardId", 7, "version", 3)
+	logger.Debug("not logged")
+	logger.Info("task done", "workerId", 2)
+
+	var record map[string]interface{}
+	tu.Ok(t, json.Unmarshal(buf.Bytes(), &record))
+	tu.Equals(t, "task done", record["msg"])
+	tu.Equals(t, "INFO", record["level"])
+	tu.Equals(t, float64(7), record["shardId"])
+	tu.Equals(t, float64(3), record["version"])
+	tu.Equals(t, float64(2), record["workerId"])
+
+	_, err = NewHandler(&buf, "xml", slog.LevelInfo)
+	tu.NotOk(t, err)
+}
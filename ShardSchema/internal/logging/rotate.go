@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RotatingFile is a log file rotated once it reaches its maximum size. The rotated files
+// are named like the file with a .1, .2, ... suffix, .1 being the most recent.
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// OpenRotatingFile opens the log file at path, in append mode. It is rotated when it
+// exceeds maxSize bytes, 0 to never rotate it, and maxFiles rotated files are kept.
+func OpenRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return errors.Wrap(err, "cannot open the log file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "cannot open the log file")
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// Write writes a record to the file, rotating it first if the record would exceed the
+// maximum size
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, fmt.Errorf("the log file %s is closed", r.path)
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files, dropping the oldest one, and starts a new file
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return errors.Wrap(err, "cannot close the log file")
+	}
+	r.f = nil
+
+	if r.maxFiles < 1 {
+		os.Remove(r.path)
+	} else {
+		for i := r.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return errors.Wrap(err, "cannot rotate the log file")
+		}
+	}
+	return r.open()
+}
+
+// Close closes the file
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shardschema-log")
+	tu.Ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shardschema.log")
+
+	r, err := OpenRotatingFile(path, 10, 2)
+	tu.Ok(t, err)
+	for _, record := range []string{"record 1\n", "record 2\n", "record 3\n", "record 4\n"} {
+		_, err = r.Write([]byte(record))
+		tu.Ok(t, err)
+	}
+	tu.Ok(t, r.Close())
+
+	// each record exceeds the size with the previous one, only 2 rotated files are kept
+	content := func(name string) string {
+		b, err := ioutil.ReadFile(name)
+		tu.Ok(t, err)
+		return string(b)
+	}
+	tu.Equals(t, "record 4\n", content(path))
+	tu.Equals(t, "record 3\n", content(path+".1"))
+	tu.Equals(t, "record 2\n", content(path+".2"))
+	_, err = os.Stat(path + ".3")
+	tu.Assert(t, os.IsNotExist(err), "only 2 rotated files are kept")
+
+	// the file is appended to when reopened
+	r, err = OpenRotatingFile(path, 0, 2)
+	tu.Ok(t, err)
+	_, err = r.Write([]byte("record 5\n"))
+	tu.Ok(t, err)
+	tu.Ok(t, r.Close())
+	tu.Equals(t, "record 4\nrecord 5\n", content(path))
+}
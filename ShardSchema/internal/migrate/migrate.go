@@ -0,0 +1,220 @@
+// Package migrate creates and upgrades the tables of the ShardSchema metadata database:
+// shards, versions and oplog. The migrations are embedded, they are applied in order and
+// recorded in the schemaMigrations table.
+package migrate
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+//go:embed migrations/*.sql
+var files embed.FS
+
+// ER_NO_SUCH_TABLE, the schemaMigrations table doesn't exist before the first migration
+const errNoSuchTable = 1146
+
+// MySQL errors of a change already made, see Up
+var alreadyApplied = map[uint16]bool{
+	1050: true, // ER_TABLE_EXISTS_ERROR
+	1060: true, // ER_DUP_FIELDNAME
+	1061: true, // ER_DUP_KEYNAME
+}
+
+const createTable = "CREATE TABLE IF NOT EXISTS `schemaMigrations` (" +
+	"`version` int(10) unsigned NOT NULL, " +
+	"`name` varchar(100) NOT NULL, " +
+	"`appliedAt` timestamp NULL DEFAULT CURRENT_TIMESTAMP, " +
+	"PRIMARY KEY (`version`)" +
+	") ENGINE=InnoDB DEFAULT CHARSET=latin1"
+
+// Migration is an embedded migration, from a file named <version>_<name>.sql
+type Migration struct {
+	Version    uint32
+	Name       string
+	Statements []string
+}
+
+// Status is a migration and when it was applied, AppliedAt is nil if it wasn't
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations, in order
+func Migrations() ([]Migration, error) {
+	names, err := files.ReadDir("migrations")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read the migrations")
+	}
+
+	migrations := []Migration{}
+	for _, f := range names {
+		base := strings.TrimSuffix(f.Name(), ".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name %q, expecting <version>_<name>.sql", f.Name())
+		}
+		data, err := files.ReadFile(path.Join("migrations", f.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read the migrations")
+		}
+		migrations = append(migrations, Migration{Version: uint32(version), Name: parts[1],
+			Statements: splitStatements(string(data))})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitStatements splits a migration on the semicolons ending a line, the comment lines
+// are dropped
+func splitStatements(data string) []string {
+	statements := []string{}
+	var stmt strings.Builder
+	for _, line := range strings.Split(data, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		stmt.WriteString(line + "\n")
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(stmt.String()), ";"))
+			stmt.Reset()
+		}
+	}
+	if s := strings.TrimSpace(stmt.String()); s != "" {
+		statements = append(statements, s)
+	}
+	return statements
+}
+
+// Latest returns the version of the last embedded migration, the version of the metadata
+// schema this build expects
+func Latest() uint32 {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Current returns the version of the last migration applied to db, 0 if none was
+func Current(db *sql.DB) (uint32, error) {
+	var version uint32
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schemaMigrations").Scan(&version)
+	if isError(err, errNoSuchTable) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot read the version of the metadata schema")
+	}
+	return version, nil
+}
+
+// Check returns an error if the metadata schema of db is older than the one expected
+func Check(db *sql.DB) error {
+	current, err := Current(db)
+	if err != nil {
+		return err
+	}
+	if latest := Latest(); current < latest {
+		return fmt.Errorf("the metadata schema is at version %d, version %d is expected, "+
+			"run \"shardSchema migrate\"", current, latest)
+	}
+	return nil
+}
+
+// Up applies the migrations not yet applied to db, in order, and returns them. The tables
+// of the databases created before the migrations existed are adopted: the errors about a
+// table, a column or an index that already exists are ignored.
+func Up(db *sql.DB) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(createTable); err != nil {
+		return nil, errors.Wrap(err, "cannot create the schemaMigrations table")
+	}
+	current, err := Current(db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []Migration{}
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		// the DDLs are not transactional, the statements already run are skipped on the next run
+		for _, stmt := range m.Statements {
+			if _, err := db.Exec(stmt); err != nil {
+				if mysqlErr, ok := err.(*mysql.MySQLError); ok && alreadyApplied[mysqlErr.Number] {
+					continue
+				}
+				return applied, errors.Wrap(err, fmt.Sprintf("migration %d_%s failed", m.Version, m.Name))
+			}
+		}
+		if _, err := db.Exec("INSERT INTO schemaMigrations (version, name) VALUES (?, ?)",
+			m.Version, m.Name); err != nil {
+			return applied, errors.Wrap(err, fmt.Sprintf("cannot record the migration %d_%s", m.Version, m.Name))
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// List returns the embedded migrations and when they were applied to db
+func List(db *sql.DB) ([]Status, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	appliedAt := map[uint32]time.Time{}
+	rows, err := db.Query("SELECT version, appliedAt FROM schemaMigrations")
+	switch {
+	case isError(err, errNoSuchTable):
+		// nothing was applied
+	case err != nil:
+		return nil, errors.Wrap(err, "cannot read the applied migrations")
+	default:
+		defer rows.Close()
+		for rows.Next() {
+			var version uint32
+			var at sql.NullTime
+			if err := rows.Scan(&version, &at); err != nil {
+				return nil, errors.Wrap(err, "cannot read an applied migration")
+			}
+			appliedAt[version] = at.Time
+		}
+		if err := rows.Err(); err != nil {
+			return nil, errors.Wrap(err, "cannot read the applied migrations")
+		}
+	}
+
+	statuses := []Status{}
+	for _, m := range migrations {
+		s := Status{Migration: m}
+		if at, ok := appliedAt[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// isError returns true if err is the MySQL error number
+func isError(err error, number uint16) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == number
+}
@@ -0,0 +1,105 @@
+package migrate
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	tu.Ok(t, err)
+
+	for i, m := range migrations {
+		tu.Equals(t, uint32(i+1), m.Version)
+		tu.Assert(t, len(m.Statements) > 0, "migration %d has no statement", m.Version)
+		for _, stmt := range m.Statements {
+			tu.Assert(t, !strings.HasSuffix(stmt, ";") && !strings.HasPrefix(stmt, "--"),
+				"invalid statement %q in migration %d", stmt, m.Version)
+		}
+	}
+	tu.Equals(t, migrations[len(migrations)-1].Version, Latest())
+	tu.Equals(t, "initial", migrations[0].Name)
+	tu.Equals(t, 3, len(migrations[0].Statements))
+}
+
+func TestSplitStatements(t *testing.T) {
+	tu.Equals(t, []string{"CREATE TABLE t (\n  a int\n)", "ALTER TABLE t ADD b int", "SELECT 1"},
+		splitStatements("-- a comment\nCREATE TABLE t (\n  a int\n);\n\nALTER TABLE t ADD b int;\nSELECT 1\n"))
+}
+
+// columns returns the definitions of the columns of the tables of a database
+func columns(t *testing.T, db *sql.DB, schema string) []string {
+	rows, err := db.Query("SELECT TABLE_NAME, COLUMN_NAME, COLUMN_TYPE, IS_NULLABLE, COALESCE(COLUMN_DEFAULT, 'NULL') "+
+		"FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME IN ('shards', 'versions', 'oplog', 'shardVersions') "+
+		"ORDER BY TABLE_NAME, ORDINAL_POSITION", schema)
+	tu.Ok(t, err)
+	defer rows.Close()
+
+	defs := []string{}
+	for rows.Next() {
+		var table, column, columnType, nullable, def string
+		tu.Ok(t, rows.Scan(&table, &column, &columnType, &nullable, &def))
+		defs = append(defs, strings.Join([]string{table, column, columnType, nullable, def}, " "))
+	}
+	tu.Ok(t, rows.Err())
+	return defs
+}
+
+func TestUp(t *testing.T) {
+	db := tu.OpenMySQLDatabase(t, "shardschema_migrate")
+	defer db.Close()
+
+	current, err := Current(db)
+	tu.Ok(t, err)
+	tu.Equals(t, uint32(0), current)
+	tu.NotOk(t, Check(db))
+
+	applied, err := Up(db)
+	tu.Ok(t, err)
+	tu.Equals(t, int(Latest()), len(applied))
+	tu.Ok(t, Check(db))
+	applied, err = Up(db)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, len(applied))
+
+	statuses, err := List(db)
+	tu.Ok(t, err)
+	for _, s := range statuses {
+		tu.Assert(t, s.AppliedAt != nil, "migration %d is not applied", s.Version)
+	}
+
+	// the columns of the last migrations
+	defs := strings.Join(columns(t, db, "shardschema_migrate"), "\n")
+	tu.Assert(t, strings.Contains(defs, "shards shardGroups varchar(1000) "), "columns: %s", defs)
+	tu.Assert(t, strings.Contains(defs, "oplog seq int"), "columns: %s", defs)
+}
+
+// the tables of a database created from a dump are adopted
+func TestUpAdopt(t *testing.T) {
+	db := tu.OpenMySQLDatabase(t, "shardschema_adopt")
+	defer db.Close()
+
+	// the tables of a previous release, without schemaMigrations
+	migrations, err := Migrations()
+	tu.Ok(t, err)
+	for _, m := range migrations[:len(migrations)-1] {
+		for _, stmt := range m.Statements {
+			_, err := db.Exec(stmt)
+			tu.Ok(t, err)
+		}
+	}
+
+	applied, err := Up(db)
+	tu.Ok(t, err)
+	tu.Equals(t, int(Latest()), len(applied))
+
+	// the tables match the ones created by the migrations
+	fresh := tu.OpenMySQLDatabase(t, "shardschema_fresh")
+	defer fresh.Close()
+	_, err = Up(fresh)
+	tu.Ok(t, err)
+	tu.Equals(t, columns(t, fresh, "shardschema_fresh"), columns(t, db, "shardschema_adopt"))
+}
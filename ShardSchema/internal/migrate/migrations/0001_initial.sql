@@ -0,0 +1,34 @@
+-- the tables of the first releases
+CREATE TABLE IF NOT EXISTS `shards` (
+  `shardId` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `schemaName` varchar(64) NOT NULL,
+  `shardDSN` varchar(200) NOT NULL,
+  `version` int(11) NOT NULL DEFAULT '0',
+  `taskName` varchar(100) DEFAULT NULL,
+  `lastTaskHb` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  `lastUpdate` timestamp NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`shardId`),
+  KEY `idx_version_task` (`version`,`taskName`),
+  KEY `idx_task_lasthb` (`taskName`,`lastTaskHb`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+CREATE TABLE IF NOT EXISTS `versions` (
+  `version` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `command` varchar(1000) NOT NULL,
+  `cmdType` enum('sql','pt-osc') NOT NULL DEFAULT 'sql',
+  `lastUpdate` timestamp NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `tableName` varchar(64) NOT NULL,
+  PRIMARY KEY (`version`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+CREATE TABLE IF NOT EXISTS `oplog` (
+  `shardId` int(10) unsigned NOT NULL,
+  `version` int(10) unsigned NOT NULL,
+  `seq` tinyint(4) unsigned NOT NULL,
+  `taskName` varchar(100) DEFAULT NULL,
+  `message` text,
+  `output` longtext,
+  `err` longtext,
+  `lastUpdate` timestamp NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`shardId`,`version`,`seq`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
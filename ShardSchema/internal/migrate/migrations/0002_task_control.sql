@@ -0,0 +1,3 @@
+-- progress reported by the heartbeats and abort requests of the running tasks
+ALTER TABLE `shards` ADD COLUMN `taskProgress` varchar(255) DEFAULT NULL AFTER `lastTaskHb`;
+ALTER TABLE `shards` ADD COLUMN `abortRequested` tinyint(1) NOT NULL DEFAULT '0' AFTER `taskProgress`;
@@ -0,0 +1,5 @@
+-- attempts of the next version, the retry backoff and the failed shards
+ALTER TABLE `shards` ADD COLUMN `attempts` tinyint(3) unsigned NOT NULL DEFAULT '0' AFTER `abortRequested`;
+ALTER TABLE `shards` ADD COLUMN `retryAfter` timestamp NULL DEFAULT NULL AFTER `attempts`;
+ALTER TABLE `shards` ADD COLUMN `failed` tinyint(1) NOT NULL DEFAULT '0' AFTER `retryAfter`;
+ALTER TABLE `oplog` ADD COLUMN `run` tinyint(3) unsigned NOT NULL DEFAULT '0' AFTER `seq`;
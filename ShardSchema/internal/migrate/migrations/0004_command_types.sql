@@ -0,0 +1,5 @@
+-- gh-ost, the validation of the versions and the options of pt-osc
+ALTER TABLE `versions` MODIFY COLUMN `cmdType` enum('sql','pt-osc','gh-ost') NOT NULL DEFAULT 'sql';
+ALTER TABLE `versions` ADD COLUMN `validationQuery` text AFTER `tableName`;
+ALTER TABLE `versions` ADD COLUMN `validationAnswer` text AFTER `validationQuery`;
+ALTER TABLE `versions` ADD COLUMN `options` varchar(1000) DEFAULT NULL AFTER `validationAnswer`;
@@ -0,0 +1,2 @@
+-- the shards claimed together by a dispatcher, read back after the claim
+ALTER TABLE `shards` ADD COLUMN `claimSeq` int(10) unsigned DEFAULT NULL AFTER `lastTaskHb`;
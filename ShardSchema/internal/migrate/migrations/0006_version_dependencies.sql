@@ -0,0 +1,10 @@
+-- the versions a version depends on, NULL for the previous version on the same table
+ALTER TABLE `versions` ADD COLUMN `dependsOn` varchar(1000) DEFAULT NULL AFTER `options`;
+
+-- the versions applied to a shard above its version, out of order
+CREATE TABLE IF NOT EXISTS `shardVersions` (
+  `shardId` int(10) unsigned NOT NULL,
+  `version` int(10) unsigned NOT NULL,
+  `appliedAt` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`shardId`,`version`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
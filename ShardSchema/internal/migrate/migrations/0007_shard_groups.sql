@@ -0,0 +1,5 @@
+-- the groups of a shard, comma separated
+ALTER TABLE `shards` ADD COLUMN `shardGroups` varchar(1000) NOT NULL DEFAULT '' AFTER `shardDSN`;
+
+-- the expression of the shard groups a version applies to, NULL for all the shards
+ALTER TABLE `versions` ADD COLUMN `target` varchar(1000) DEFAULT NULL AFTER `dependsOn`;
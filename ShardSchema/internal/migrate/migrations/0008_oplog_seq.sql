@@ -0,0 +1,2 @@
+-- a version of a shard logs a message per throttle and resume of its tasks, beyond 255 entries
+ALTER TABLE `oplog` MODIFY COLUMN `seq` int(10) unsigned NOT NULL;
@@ -5,7 +5,8 @@ import "database/sql"
 type OpLog struct {
 	ShardId    uint32         // Id of the shard
 	Version    uint32         // current schema version of the shard
-	Seq        uint8          // message sequence
+	Seq        uint32         // message sequence
+	Run        uint8          // attempt of the version the message belongs to
 	TaskName   sql.NullString // identifier for current task updating the shard
 	Message    sql.NullString //
 	Output     sql.NullString // stdout output of the command
@@ -3,11 +3,31 @@ package models
 import "database/sql"
 
 type Shard struct {
-	ShardId    uint32         // Id of the shard
-	SchemaName string         // Name of the schema, ex shard_1234
-	ShardDSN   string         // DSN of the shard, schemaName is appended
-	Version    uint32         // current schema version of the shard
-	TaskName   sql.NullString // identifier for current task updating the shard
-	LastTaskHb NullTime       // last heartbeat of the updating task
-	LastUpdate NullTime       // when was the last update to the row
+	ShardId        uint32         // Id of the shard
+	SchemaName     string         // Name of the schema, ex shard_1234
+	ShardDSN       string         // DSN of the shard, schemaName is appended
+	Groups         []string       // groups of the shard, sorted, the versions target them
+	Version        uint32         // current schema version of the shard, all the versions up to it are applied
+	Applied        []uint32       // versions above Version already applied, in order
+	TaskName       sql.NullString // identifier for current task updating the shard
+	LastTaskHb     NullTime       // last heartbeat of the updating task
+	TaskProgress   sql.NullString // progress reported by the last heartbeat of the updating task
+	AbortRequested bool           // an operator asked to abort the updating task
+	Attempts       uint8          // attempts of the next version, reset when the version changes
+	RetryAfter     NullTime       // a failed attempt is not retried before
+	Failed         bool           // the next version failed and won't be retried without an operator
+	LastUpdate     NullTime       // when was the last update to the row
+}
+
+// HasApplied returns true if version was applied to the shard
+func (s *Shard) HasApplied(version uint32) bool {
+	if version <= s.Version {
+		return true
+	}
+	for _, v := range s.Applied {
+		if v == version {
+			return true
+		}
+	}
+	return false
 }
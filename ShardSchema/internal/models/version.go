@@ -1,11 +1,19 @@
 package models
 
-import "time"
+import (
+	"database/sql"
+	"time"
+)
 
 type Version struct {
-	Version    uint32
-	Command    string    // alter command to run
-	TableName  string    // affected table
-	CmdType    string    // type of command, 'sql' or 'pt-osc'
-	LastUpdate time.Time // when was the last update to the row
+	Version          uint32
+	Command          string         // alter command to run
+	TableName        string         // affected table
+	CmdType          string         // type of command, 'sql', 'pt-osc' or 'gh-ost'
+	ValidationQuery  sql.NullString // query run on the shard once the command succeeded
+	ValidationAnswer sql.NullString // expected result of the validation query
+	Options          sql.NullString // extra options of pt-osc, like --max-load
+	DependsOn        sql.NullString // versions it depends on, comma separated, NULL for the previous version on the same table
+	Target           sql.NullString // expression of the shard groups it applies to, NULL for all the shards
+	LastUpdate       time.Time      // when was the last update to the row
 }
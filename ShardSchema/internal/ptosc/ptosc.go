@@ -0,0 +1,182 @@
+package ptosc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// Command is the name of the pt-online-schema-change executable
+const Command = "pt-online-schema-change"
+
+// Exit statuses of pt-online-schema-change
+const (
+	InvalidParameters            = 1
+	UnsupportedMySQLVersion      = 2
+	NoMinimumRequirements        = 3
+	NoPrimaryOrUniqueKey         = 4
+	InvalidPluginFile            = 5
+	InvalidAlterFKMethod         = 6
+	InvalidKeySize               = 7
+	CannotDetermineKeySize       = 9 // pt-osc uses the same status for both
+	NotSafeToAscend              = 9
+	ErrorCreatingNewTable        = 11
+	ErrorAlteringTable           = 12
+	ErrorCreatingTriggers        = 13
+	ErrorRestoringTriggers       = 14
+	ErrorSwappingTables          = 15
+	ErrorUpdatingFKs             = 16
+	ErrorDroppingOldTable        = 17
+	UnsupportedOperation         = 18
+	MySQLConnectionError         = 19
+	LostMySQLConnection          = 20
+	ErrorCreatingReverseTriggers = 21
+)
+
+var statusNames = map[int]string{
+	InvalidParameters:            "invalid parameters",
+	UnsupportedMySQLVersion:      "unsupported MySQL version",
+	NoMinimumRequirements:        "minimum requirements not met",
+	NoPrimaryOrUniqueKey:         "no primary or unique key",
+	InvalidPluginFile:            "invalid plugin file",
+	InvalidAlterFKMethod:         "invalid alter foreign keys method",
+	InvalidKeySize:               "invalid key size",
+	NotSafeToAscend:              "cannot determine the key size or not safe to ascend",
+	ErrorCreatingNewTable:        "error creating the new table",
+	ErrorAlteringTable:           "error altering the new table",
+	ErrorCreatingTriggers:        "error creating the triggers",
+	ErrorRestoringTriggers:       "error restoring the triggers",
+	ErrorSwappingTables:          "error swapping the tables",
+	ErrorUpdatingFKs:             "error updating the foreign keys",
+	ErrorDroppingOldTable:        "error dropping the old table",
+	UnsupportedOperation:         "unsupported operation",
+	MySQLConnectionError:         "MySQL connection error",
+	LostMySQLConnection:          "lost the MySQL connection",
+	ErrorCreatingReverseTriggers: "error creating the reverse triggers",
+}
+
+// Error is a run of pt-online-schema-change that exited with a non-zero status
+type Error struct {
+	Status int
+}
+
+func (e *Error) Error() string {
+	name, ok := statusNames[e.Status]
+	if !ok {
+		name = "unknown error"
+	}
+	return fmt.Sprintf("pt-online-schema-change exited with status %d: %s", e.Status, name)
+}
+
+// Connection returns true if pt-online-schema-change failed because of the MySQL connection
+func (e *Error) Connection() bool {
+	return e.Status == MySQLConnectionError || e.Status == LostMySQLConnection
+}
+
+// ExitError converts the error of exec.Cmd.Wait into an *Error when pt-online-schema-change
+// exited with a non-zero status, the other errors are returned unchanged
+func ExitError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		return &Error{Status: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// options set by the Migration, they can't be part of the options of a version
+var reservedOptions = []string{
+	"--alter", "--execute", "--dry-run", "--defaults-file", "--user", "--password", "--ask-pass",
+	"--host", "--port", "--socket", "--database", "--help", "--version", "--pause-file",
+}
+
+// ParseOptions splits the extra options of a version, like "--max-load Threads_running=50
+// --chunk-time 0.5", and rejects the options set by the Migration
+func ParseOptions(options string) ([]string, error) {
+	fields := strings.Fields(options)
+	for _, f := range fields {
+		name := strings.SplitN(f, "=", 2)[0]
+		if strings.HasPrefix(name, "-") && !strings.HasPrefix(name, "--") {
+			return nil, fmt.Errorf("option %q: use the long form of the pt-online-schema-change options", f)
+		}
+		for _, r := range reservedOptions {
+			if name == r {
+				return nil, fmt.Errorf("option %s is set by ShardSchema", r)
+			}
+		}
+	}
+	return fields, nil
+}
+
+// Migration is the change of a table with pt-online-schema-change
+type Migration struct {
+	DSN          *mysql.Config // server of the shard
+	Schema       string
+	Table        string
+	Alter        string   // in the format of --alter
+	Options      []string // extra options of the version, see ParseOptions
+	DefaultsFile string   // file holding the credentials, see WriteDefaultsFile
+	PauseFile    string   // pt-online-schema-change pauses while this file exists
+}
+
+// DSNString returns the DSN of the table in the format of pt-online-schema-change. The
+// credentials are read from the defaults file.
+func (m *Migration) DSNString() string {
+	parts := []string{}
+	if m.DSN.Net == "unix" {
+		parts = append(parts, "S="+m.DSN.Addr)
+	} else {
+		host, port, err := net.SplitHostPort(m.DSN.Addr)
+		if err != nil {
+			host, port = m.DSN.Addr, "3306"
+		}
+		parts = append(parts, "h="+host, "P="+port)
+	}
+	if m.DefaultsFile != "" {
+		parts = append(parts, "F="+m.DefaultsFile)
+	}
+	parts = append(parts, "D="+m.Schema, "t="+m.Table)
+	return strings.Join(parts, ",")
+}
+
+// Args returns the arguments of pt-online-schema-change, it only checks what it would do
+// unless execute is true
+func (m *Migration) Args(execute bool) []string {
+	mode := "--dry-run"
+	if execute {
+		mode = "--execute"
+	}
+	args := []string{mode, "--alter", m.Alter}
+	if m.PauseFile != "" {
+		args = append(args, "--pause-file", m.PauseFile)
+	}
+	args = append(args, m.Options...)
+	return append(args, m.DSNString())
+}
+
+// WriteDefaultsFile writes the credentials in a temporary file, in the format of the
+// MySQL option files, readable only by the current user. The caller removes the file.
+func WriteDefaultsFile(user string, password string) (string, error) {
+	f, err := ioutil.TempFile("", "ptosc-*.cnf")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create the pt-osc defaults file")
+	}
+	defer f.Close()
+
+	// ioutil.TempFile creates the file with the 0600 mode
+	if _, err = fmt.Fprintf(f, "[client]\nuser=%s\npassword=%s\n", quote(user), quote(password)); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "cannot write the pt-osc defaults file")
+	}
+	return f.Name(), nil
+}
+
+// quote quotes a value of a MySQL option file
+func quote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,88 @@
+package ptosc
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestArgs(t *testing.T) {
+	m := &Migration{
+		DSN:          &mysql.Config{User: "user", Passwd: "pass", Net: "tcp", Addr: "10.2.2.1:3307"},
+		Schema:       "shard_1",
+		Table:        "t1",
+		Alter:        "ADD COLUMN c2 INT",
+		Options:      []string{"--max-load", "Threads_running=50"},
+		DefaultsFile: "/tmp/ptosc.cnf",
+	}
+
+	tu.Equals(t, []string{"--dry-run", "--alter", "ADD COLUMN c2 INT", "--max-load", "Threads_running=50",
+		"h=10.2.2.1,P=3307,F=/tmp/ptosc.cnf,D=shard_1,t=t1"}, m.Args(false))
+	tu.Equals(t, "--execute", m.Args(true)[0])
+
+	m.PauseFile = "/tmp/ptosc.pause"
+	tu.Equals(t, []string{"--execute", "--alter", "ADD COLUMN c2 INT", "--pause-file", "/tmp/ptosc.pause",
+		"--max-load", "Threads_running=50", "h=10.2.2.1,P=3307,F=/tmp/ptosc.cnf,D=shard_1,t=t1"}, m.Args(true))
+
+	m.DSN.Addr = "10.2.2.1"
+	tu.Equals(t, "h=10.2.2.1,P=3306,F=/tmp/ptosc.cnf,D=shard_1,t=t1", m.DSNString())
+
+	m.DSN.Net = "unix"
+	m.DSN.Addr = "/var/run/mysqld/mysqld.sock"
+	tu.Equals(t, "S=/var/run/mysqld/mysqld.sock,F=/tmp/ptosc.cnf,D=shard_1,t=t1", m.DSNString())
+}
+
+func TestParseOptions(t *testing.T) {
+	options, err := ParseOptions(" --max-load Threads_running=50 --critical-load=Threads_running:200  " +
+		"--chunk-time 0.5 --recursion-method none")
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"--max-load", "Threads_running=50", "--critical-load=Threads_running:200",
+		"--chunk-time", "0.5", "--recursion-method", "none"}, options)
+
+	options, err = ParseOptions("")
+	tu.Ok(t, err)
+	tu.Equals(t, 0, len(options))
+
+	_, err = ParseOptions("--chunk-time 0.5 --execute")
+	tu.NotOk(t, err)
+	_, err = ParseOptions("--password=secret")
+	tu.NotOk(t, err)
+	_, err = ParseOptions("--pause-file=/tmp/pause")
+	tu.NotOk(t, err)
+	_, err = ParseOptions("-p secret")
+	tu.NotOk(t, err)
+}
+
+func TestExitError(t *testing.T) {
+	err := ExitError(exec.Command("sh", "-c", "exit 20").Run())
+	perr, ok := err.(*Error)
+	tu.Assert(t, ok, "expecting a *ptosc.Error, got %T", err)
+	tu.Equals(t, LostMySQLConnection, perr.Status)
+	tu.Assert(t, perr.Connection(), "a lost connection is a connection error")
+	tu.Equals(t, "pt-online-schema-change exited with status 20: lost the MySQL connection", perr.Error())
+
+	perr = ExitError(exec.Command("sh", "-c", "exit 4").Run()).(*Error)
+	tu.Assert(t, !perr.Connection(), "a missing key is not a connection error")
+
+	tu.Ok(t, ExitError(nil))
+	_, ok = ExitError(exec.Command("/nonexistent/pt-online-schema-change").Run()).(*Error)
+	tu.Assert(t, !ok, "a command that can't start is not a *ptosc.Error")
+}
+
+func TestWriteDefaultsFile(t *testing.T) {
+	name, err := WriteDefaultsFile("user", `pa"ss\`)
+	tu.Ok(t, err)
+	defer os.Remove(name)
+
+	content, err := ioutil.ReadFile(name)
+	tu.Ok(t, err)
+	tu.Equals(t, "[client]\nuser=\"user\"\npassword=\"pa\\\"ss\\\\\"\n", string(content))
+
+	info, err := os.Stat(name)
+	tu.Ok(t, err)
+	tu.Equals(t, os.FileMode(0600), info.Mode().Perm())
+}
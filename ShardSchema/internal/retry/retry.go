@@ -0,0 +1,114 @@
+package retry
+
+import (
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// Error classes of a failed DDL
+const (
+	LockWaitTimeout = "lock_wait_timeout"
+	Deadlock        = "deadlock"
+	Connection      = "connection"
+	Syntax          = "syntax"
+	Validation      = "validation" // the DDL succeeded but the validation query got a wrong answer
+	Unknown         = "unknown"
+)
+
+// MySQL error numbers mapped to a class
+var errorNumbers = map[uint16]string{
+	1205: LockWaitTimeout, // ER_LOCK_WAIT_TIMEOUT
+	1213: Deadlock,        // ER_LOCK_DEADLOCK
+	1064: Syntax,          // ER_PARSE_ERROR
+	1149: Syntax,          // ER_SYNTAX_ERROR
+	1040: Connection,      // ER_CON_COUNT_ERROR
+	1053: Connection,      // ER_SERVER_SHUTDOWN
+	2006: Connection,      // CR_SERVER_GONE_ERROR
+	2013: Connection,      // CR_SERVER_LOST
+}
+
+// Messages found in the output of the tools, like pt-osc, mapped to a class
+var errorMessages = []struct {
+	message string
+	class   string
+}{
+	{"Lock wait timeout exceeded", LockWaitTimeout},
+	{"Deadlock found", Deadlock},
+	{"You have an error in your SQL syntax", Syntax},
+	{"Lost connection to MySQL server", Connection},
+	{"MySQL server has gone away", Connection},
+	{"Can't connect to MySQL server", Connection},
+	{"Too many connections", Connection},
+}
+
+// Classify returns the class of a DDL error. output is the error output of the command,
+// if any, and is searched for known messages when err is not a MySQL error.
+func Classify(err error, output string) string {
+	if err == nil && output == "" {
+		return Unknown
+	}
+
+	if err != nil {
+		cause := errors.Cause(err)
+		if mysqlErr, ok := cause.(*mysql.MySQLError); ok {
+			if class, ok := errorNumbers[mysqlErr.Number]; ok {
+				return class
+			}
+			return Unknown
+		}
+		if cause == driver.ErrBadConn || cause == mysql.ErrInvalidConn {
+			return Connection
+		}
+		output = err.Error() + "\n" + output
+	}
+
+	for _, m := range errorMessages {
+		if strings.Contains(output, m.message) {
+			return m.class
+		}
+	}
+	return Unknown
+}
+
+// Policy decides if and when a failed DDL is retried
+type Policy struct {
+	MaxAttempts int           // attempts per shard and version, including the first one
+	Backoff     time.Duration // delay before the first retry, doubled at each attempt
+	MaxBackoff  time.Duration // upper bound of the delay
+	Retryable   map[string]bool
+}
+
+// NewPolicy creates a Policy retrying the given error classes
+func NewPolicy(maxAttempts int, backoff time.Duration, maxBackoff time.Duration, retryable []string) *Policy {
+	p := &Policy{
+		MaxAttempts: maxAttempts,
+		Backoff:     backoff,
+		MaxBackoff:  maxBackoff,
+		Retryable:   make(map[string]bool),
+	}
+	for _, class := range retryable {
+		p.Retryable[class] = true
+	}
+	return p
+}
+
+// ShouldRetry returns true if a DDL that failed with class after attempts attempts is retried
+func (p *Policy) ShouldRetry(class string, attempts int) bool {
+	return p.Retryable[class] && attempts < p.MaxAttempts
+}
+
+// Delay returns how long to wait before the next attempt, after attempts attempts
+func (p *Policy) Delay(attempts int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempts && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,41 @@
+package retry
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestClassify(t *testing.T) {
+	lockErr := &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded; try restarting transaction"}
+	tu.Equals(t, LockWaitTimeout, Classify(lockErr, ""))
+	tu.Equals(t, LockWaitTimeout, Classify(errors.Wrap(lockErr, "ddl error"), ""))
+	tu.Equals(t, Deadlock, Classify(&mysql.MySQLError{Number: 1213}, ""))
+	tu.Equals(t, Syntax, Classify(&mysql.MySQLError{Number: 1064}, ""))
+	tu.Equals(t, Unknown, Classify(&mysql.MySQLError{Number: 1060}, ""))
+	tu.Equals(t, Connection, Classify(mysql.ErrInvalidConn, ""))
+
+	// pt-osc reports the errors on stderr
+	tu.Equals(t, Deadlock, Classify(fmt.Errorf("exit status 255"),
+		"Error copying rows: DBD::mysql::st execute failed: Deadlock found when trying to get lock"))
+	tu.Equals(t, Unknown, Classify(fmt.Errorf("exit status 255"), "something else"))
+}
+
+func TestPolicy(t *testing.T) {
+	p := NewPolicy(3, time.Minute, 5*time.Minute, []string{LockWaitTimeout, Deadlock})
+
+	tu.Assert(t, p.ShouldRetry(Deadlock, 1), "deadlock should be retried")
+	tu.Assert(t, p.ShouldRetry(LockWaitTimeout, 2), "lock wait timeout should be retried")
+	tu.Assert(t, !p.ShouldRetry(LockWaitTimeout, 3), "no retry after MaxAttempts")
+	tu.Assert(t, !p.ShouldRetry(Syntax, 1), "syntax errors should not be retried")
+
+	tu.Equals(t, time.Minute, p.Delay(1))
+	tu.Equals(t, 2*time.Minute, p.Delay(2))
+	tu.Equals(t, 4*time.Minute, p.Delay(3))
+	tu.Equals(t, 5*time.Minute, p.Delay(4))
+	tu.Equals(t, 5*time.Minute, p.Delay(20))
+}
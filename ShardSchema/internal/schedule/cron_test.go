@@ -0,0 +1,42 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestParseCron(t *testing.T) {
+	c, err := ParseCron("*/15 8-18/2 * * 1-5")
+	tu.Ok(t, err)
+	tu.Equals(t, uint64(1|1<<15|1<<30|1<<45), c.minute)
+	tu.Equals(t, uint64(1<<8|1<<10|1<<12|1<<14|1<<16|1<<18), c.hour)
+	tu.Equals(t, uint64(0x3e), c.dow)
+
+	c, err = ParseCron("0 0 1,15 * 7")
+	tu.Ok(t, err)
+	tu.Equals(t, uint64(1|1<<7), c.dow)
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 5-1 * * *", "* * 0 * *", "*/0 * * * *",
+		"a * * * *", "* * * 13 *"} {
+		_, err = ParseCron(spec)
+		tu.NotOk(t, err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	// Wednesday 2020-01-15 22:00
+	at := time.Date(2020, 1, 15, 22, 0, 0, 0, time.UTC)
+
+	c, _ := ParseCron("0 22 * * 1-5")
+	tu.Assert(t, c.Match(at), "a weekday at 22:00")
+	tu.Assert(t, !c.Match(at.Add(time.Minute)), "22:01 doesn't match")
+	tu.Assert(t, !c.Match(at.AddDate(0, 0, 3)), "a Saturday doesn't match")
+
+	// either the day of month or the day of week
+	c, _ = ParseCron("0 22 1 * 3")
+	tu.Assert(t, c.Match(at), "a Wednesday")
+	tu.Assert(t, c.Match(time.Date(2020, 2, 1, 22, 0, 0, 0, time.UTC)), "the first of the month")
+	tu.Assert(t, !c.Match(at.AddDate(0, 0, 1)), "a Thursday that is not the first")
+}
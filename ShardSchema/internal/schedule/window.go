@@ -0,0 +1,121 @@
+package schedule
+
+import (
+	"fmt"
+	"time"
+)
+
+// the longest a window can stay open, a window is found active by looking for its opening
+// in the past
+const maxDuration = 7 * 24 * time.Hour
+
+// Window is a maintenance window, it opens at the times of its cron expression and stays
+// open for its duration. While open, it sets the allowed concurrency.
+type Window struct {
+	Name        string
+	Cron        *Cron
+	Duration    time.Duration
+	Concurrency int            // concurrent DDLs allowed while the window is open
+	Location    *time.Location // time zone of the cron expression
+	Host        string         // host:port or socket of the shard server, empty for all the shards
+	Group       string         // group of the shards, empty for all the groups
+}
+
+// NewWindow creates a window opening at the times of spec, in the time zone location. It
+// applies to the shards of host and of group, all the shards if both are empty.
+func NewWindow(name string, spec string, duration time.Duration, concurrency int, location *time.Location,
+	host string, group string) (*Window, error) {
+	cron, err := ParseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	if duration < time.Minute || duration > maxDuration {
+		return nil, fmt.Errorf("the duration of window %q must be between %s and %s", name, time.Minute,
+			maxDuration)
+	}
+	if concurrency < 0 {
+		return nil, fmt.Errorf("the concurrency of window %q cannot be negative", name)
+	}
+	if location == nil {
+		location = time.Local
+	}
+	return &Window{Name: name, Cron: cron, Duration: duration, Concurrency: concurrency, Location: location,
+		Host: host, Group: group}, nil
+}
+
+// scoped returns true if the window applies to the shards of a host or of a group
+func (w *Window) scoped() bool {
+	return w.Host != "" || w.Group != ""
+}
+
+// matches returns true if the window applies to the shards of host in groups. The windows
+// of all the shards only match an empty host.
+func (w *Window) matches(host string, groups []string) bool {
+	if !w.scoped() {
+		return host == ""
+	}
+	if w.Host != "" && w.Host != host {
+		return false
+	}
+	if w.Group == "" {
+		return true
+	}
+	for _, g := range groups {
+		if g == w.Group {
+			return true
+		}
+	}
+	return false
+}
+
+// Open returns true if the window is open at t
+func (w *Window) Open(t time.Time) bool {
+	t = t.In(w.Location)
+	start := t.Truncate(time.Minute)
+	// the window opened at most Duration ago, the minutes are checked backwards
+	for s := start; t.Sub(s) < w.Duration; s = s.Add(-time.Minute) {
+		if w.Cron.Match(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Windows is the set of maintenance windows of the config
+type Windows []*Window
+
+// Active returns the open window at t of the shards of host in groups, or of all the shards
+// if host is empty. When several windows are open, the one allowing the lowest concurrency
+// wins. Returns nil if none is open.
+func (ws Windows) Active(t time.Time, host string, groups []string) *Window {
+	var active *Window
+	for _, w := range ws {
+		if !w.matches(host, groups) || !w.Open(t) {
+			continue
+		}
+		if active == nil || w.Concurrency < active.Concurrency {
+			active = w
+		}
+	}
+	return active
+}
+
+// HasScoped returns true if at least one window is specific to a host or a group
+func (ws Windows) HasScoped() bool {
+	for _, w := range ws {
+		if w.scoped() {
+			return true
+		}
+	}
+	return false
+}
+
+// HasGlobal returns true if at least one window applies to all the shards
+func (ws Windows) HasGlobal() bool {
+	for _, w := range ws {
+		if !w.scoped() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestWindowOpen(t *testing.T) {
+	// from 22:00 to 06:00, in UTC-5
+	est := time.FixedZone("EST", -5*3600)
+	w, err := NewWindow("nightly", "0 22 * * *", 8*time.Hour, 4, est, "", "")
+	tu.Ok(t, err)
+
+	tu.Assert(t, w.Open(time.Date(2020, 1, 16, 3, 0, 0, 0, time.UTC)), "22:00 EST is 03:00 UTC")
+	tu.Assert(t, w.Open(time.Date(2020, 1, 16, 10, 59, 0, 0, time.UTC)), "05:59 EST")
+	tu.Assert(t, !w.Open(time.Date(2020, 1, 16, 11, 0, 0, 0, time.UTC)), "06:00 EST, the window closed")
+	tu.Assert(t, !w.Open(time.Date(2020, 1, 16, 2, 59, 0, 0, time.UTC)), "21:59 EST, not yet open")
+
+	_, err = NewWindow("short", "0 22 * * *", time.Second, 4, est, "", "")
+	tu.NotOk(t, err)
+	_, err = NewWindow("negative", "0 22 * * *", time.Hour, -1, est, "", "")
+	tu.NotOk(t, err)
+}
+
+func TestActive(t *testing.T) {
+	business, _ := NewWindow("business", "0 9 * * 1-5", 8*time.Hour, 0, time.UTC, "", "")
+	lunch, _ := NewWindow("lunch", "0 12 * * *", time.Hour, 1, time.UTC, "", "")
+	host, _ := NewWindow("host", "0 0 * * *", 24*time.Hour, 3, time.UTC, "10.2.2.1:3306", "")
+	ws := Windows{lunch, business, host}
+
+	// Wednesday
+	tu.Equals(t, business, ws.Active(time.Date(2020, 1, 15, 12, 30, 0, 0, time.UTC), "", nil))
+	tu.Equals(t, lunch, ws.Active(time.Date(2020, 1, 18, 12, 30, 0, 0, time.UTC), "", nil))
+	tu.Assert(t, ws.Active(time.Date(2020, 1, 18, 20, 0, 0, 0, time.UTC), "", nil) == nil, "no window open")
+	tu.Equals(t, host, ws.Active(time.Date(2020, 1, 18, 20, 0, 0, 0, time.UTC), "10.2.2.1:3306", nil))
+
+	tu.Assert(t, ws.HasScoped() && ws.HasGlobal(), "global and host windows")
+	tu.Assert(t, !Windows{host}.HasGlobal(), "only a host window")
+
+	// a group window applies to the shards of the group, on any host unless it has one
+	premium, _ := NewWindow("premium", "0 0 * * *", 24*time.Hour, 0, time.UTC, "", "premium")
+	premiumHost, _ := NewWindow("premium host", "0 0 * * *", 24*time.Hour, 1, time.UTC, "10.2.2.2:3306", "premium")
+	ws = Windows{host, premium, premiumHost}
+	saturday := time.Date(2020, 1, 18, 20, 0, 0, 0, time.UTC)
+	tu.Equals(t, premium, ws.Active(saturday, "10.2.2.1:3306", []string{"eu", "premium"}))
+	tu.Equals(t, host, ws.Active(saturday, "10.2.2.1:3306", []string{"eu"}))
+	tu.Equals(t, premiumHost, Windows{premiumHost}.Active(saturday, "10.2.2.2:3306", []string{"premium"}))
+	tu.Assert(t, Windows{premiumHost}.Active(saturday, "10.2.2.3:3306", []string{"premium"}) == nil,
+		"not the host of the window")
+	tu.Assert(t, ws.Active(saturday, "", nil) == nil, "no global window")
+	tu.Assert(t, Windows{premium}.HasScoped() && !Windows{premium}.HasGlobal(), "only a group window")
+}
@@ -0,0 +1,167 @@
+package shardconn
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+)
+
+// Pool holds one sql.DB per MySQL server hosting shards. Since many shards share
+// the same server, the connections are pooled by host and not by shard.
+type Pool struct {
+	mu             sync.Mutex
+	dbs            map[string]*sql.DB
+	maxConnPerHost int
+}
+
+// NewPool creates an empty pool, maxConnPerHost caps the number of open connections per host
+func NewPool(maxConnPerHost int) *Pool {
+	return &Pool{dbs: make(map[string]*sql.DB), maxConnPerHost: maxConnPerHost}
+}
+
+// ParseDSN parses the shardDSN of the shards table. The shardDSN doesn't contain
+// the schema name so the slash separating the db name is optional.
+func ParseDSN(shardDSN string) (*mysql.Config, error) {
+	dsn := shardDSN
+	if i := strings.LastIndex(dsn, "/"); i < 0 || i < strings.LastIndex(dsn, ")") {
+		dsn += "/"
+	}
+
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse the shard DSN")
+	}
+	return cfg, nil
+}
+
+// Host returns the server of the shardDSN, host:port for tcp with the default port if
+// missing, or the socket path
+func Host(shardDSN string) (string, error) {
+	cfg, err := ParseDSN(shardDSN)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Net == "unix" {
+		return cfg.Addr, nil
+	}
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return net.JoinHostPort(cfg.Addr, "3306"), nil
+	}
+	return cfg.Addr, nil
+}
+
+// QuoteIdentifier quotes a schema or table name with backticks
+func QuoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// Conn returns a connection to the shard server with the shard schema as default database.
+// The caller must close the connection to return it to the pool.
+func (p *Pool) Conn(ctx context.Context, shard *models.Shard) (*sql.Conn, error) {
+	db, err := p.getDB(shard.ShardDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot connect to the server of shard %d", shard.ShardId))
+	}
+
+	if _, err = conn.ExecContext(ctx, "USE "+QuoteIdentifier(shard.SchemaName)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot use schema %q", shard.SchemaName))
+	}
+	return conn, nil
+}
+
+// SetMaxConnPerHost changes the maximum number of open connections per host
+func (p *Pool) SetMaxConnPerHost(maxConnPerHost int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.maxConnPerHost = maxConnPerHost
+	for _, db := range p.dbs {
+		db.SetMaxOpenConns(maxConnPerHost)
+		db.SetMaxIdleConns(maxConnPerHost)
+	}
+}
+
+// Close closes all the pooled connections
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, db := range p.dbs {
+		db.Close()
+		delete(p.dbs, key)
+	}
+}
+
+// getDB returns the sql.DB of the shard server, creating it if needed
+func (p *Pool) getDB(shardDSN string) (*sql.DB, error) {
+	cfg, err := ParseDSN(shardDSN)
+	if err != nil {
+		return nil, err
+	}
+	// the schema is selected per connection, the pool is per server
+	cfg.DBName = ""
+	key := cfg.FormatDSN()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if db, ok := p.dbs[key]; ok {
+		return db, nil
+	}
+
+	db, err := sql.Open("mysql", key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open the shard server connection pool")
+	}
+	db.SetMaxOpenConns(p.maxConnPerHost)
+	db.SetMaxIdleConns(p.maxConnPerHost)
+	p.dbs[key] = db
+
+	return db, nil
+}
+
+// QueryState returns the state, from the processlist, of the connection connID on the
+// server of the shard. Returns an empty string if the connection is gone.
+func (p *Pool) QueryState(ctx context.Context, shard *models.Shard, connID uint64) (string, error) {
+	db, err := p.getDB(shard.ShardDSN)
+	if err != nil {
+		return "", err
+	}
+
+	var state string
+	query := "SELECT COALESCE(STATE, '') FROM information_schema.PROCESSLIST WHERE ID = ?"
+	err = db.QueryRowContext(ctx, query, connID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "cannot query the processlist")
+	}
+	return state, nil
+}
+
+// KillQuery kills the statement running on the connection connID of the server of the shard
+func (p *Pool) KillQuery(ctx context.Context, shard *models.Shard, connID uint64) error {
+	db, err := p.getDB(shard.ShardDSN)
+	if err != nil {
+		return err
+	}
+
+	if _, err = db.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", connID)); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cannot kill the query of connection %d", connID))
+	}
+	return nil
+}
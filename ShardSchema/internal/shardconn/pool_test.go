@@ -0,0 +1,48 @@
+package shardconn
+
+import (
+	"testing"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestParseDSN(t *testing.T) {
+	cfg, err := ParseDSN("user:pass@tcp(10.2.2.1:3306)")
+	tu.Ok(t, err)
+	tu.Equals(t, "user", cfg.User)
+	tu.Equals(t, "pass", cfg.Passwd)
+	tu.Equals(t, "tcp", cfg.Net)
+	tu.Equals(t, "10.2.2.1:3306", cfg.Addr)
+	tu.Equals(t, "", cfg.DBName)
+
+	cfg, err = ParseDSN("user:pass@tcp(10.2.2.1:3306)/")
+	tu.Ok(t, err)
+	tu.Equals(t, "10.2.2.1:3306", cfg.Addr)
+
+	cfg, err = ParseDSN("user:pa/ss@unix(/var/run/mysqld/mysqld.sock)")
+	tu.Ok(t, err)
+	tu.Equals(t, "pa/ss", cfg.Passwd)
+	tu.Equals(t, "/var/run/mysqld/mysqld.sock", cfg.Addr)
+}
+
+func TestHost(t *testing.T) {
+	host, err := Host("user:pass@tcp(10.2.2.1:3307)")
+	tu.Ok(t, err)
+	tu.Equals(t, "10.2.2.1:3307", host)
+
+	host, err = Host("user:pass@tcp(10.2.2.1)")
+	tu.Ok(t, err)
+	tu.Equals(t, "10.2.2.1:3306", host)
+
+	host, err = Host("user:pass@unix(/var/run/mysqld/mysqld.sock)")
+	tu.Ok(t, err)
+	tu.Equals(t, "/var/run/mysqld/mysqld.sock", host)
+
+	_, err = Host("user:pass@tcp(10.2.2.1:3306")
+	tu.NotOk(t, err)
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	tu.Equals(t, "`shard_1`", QuoteIdentifier("shard_1"))
+	tu.Equals(t, "`sh``ard`", QuoteIdentifier("sh`ard"))
+}
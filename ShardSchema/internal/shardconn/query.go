@@ -0,0 +1,75 @@
+package shardconn
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// QueryResult runs query and returns its result as text, like the batch output of the
+// mysql client: one line per row with the columns separated by tabs, NULL for the null
+// values.
+func QueryResult(ctx context.Context, conn *sql.Conn, query string) (string, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot run the query")
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get the columns of the result")
+	}
+
+	result := [][]sql.NullString{}
+	for rows.Next() {
+		row := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return "", errors.Wrap(err, "cannot read a row of the result")
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return "", errors.Wrap(err, "cannot read the result")
+	}
+
+	return formatResult(result), nil
+}
+
+func formatResult(result [][]sql.NullString) string {
+	lines := make([]string, 0, len(result))
+	for _, row := range result {
+		values := make([]string, 0, len(row))
+		for _, v := range row {
+			if v.Valid {
+				values = append(values, v.String)
+			} else {
+				values = append(values, "NULL")
+			}
+		}
+		lines = append(lines, strings.Join(values, "\t"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SameResult compares the result of a query with an expected answer. The columns can be
+// separated by any number of spaces or tabs, the empty lines are ignored.
+func SameResult(result string, answer string) bool {
+	return normalizeResult(result) == normalizeResult(answer)
+}
+
+func normalizeResult(s string) string {
+	lines := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
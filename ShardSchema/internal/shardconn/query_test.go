@@ -0,0 +1,25 @@
+package shardconn
+
+import (
+	"database/sql"
+	"testing"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestFormatResult(t *testing.T) {
+	tu.Equals(t, "", formatResult([][]sql.NullString{}))
+
+	result := [][]sql.NullString{
+		{{String: "c1", Valid: true}, {String: "int", Valid: true}},
+		{{String: "c2", Valid: true}, {}},
+	}
+	tu.Equals(t, "c1\tint\nc2\tNULL", formatResult(result))
+}
+
+func TestSameResult(t *testing.T) {
+	tu.Assert(t, SameResult("1", "1"), "identical results")
+	tu.Assert(t, SameResult("c1\tint\nc2\tNULL", "  c1 int\r\nc2\t  NULL\n\n"), "spaces and empty lines")
+	tu.Assert(t, !SameResult("1", "0"), "different results")
+	tu.Assert(t, !SameResult("c1\nc2", "c2\nc1"), "rows in a different order")
+}
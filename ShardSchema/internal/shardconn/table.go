@@ -0,0 +1,33 @@
+package shardconn
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// ER_NO_SUCH_TABLE
+const errNoSuchTable = 1146
+
+var autoIncrementRe = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// TableDefinition returns the output of SHOW CREATE TABLE for table, without the
+// AUTO_INCREMENT counter so that definitions from different shards can be compared.
+// Returns an empty string if the table doesn't exist.
+func TableDefinition(ctx context.Context, conn *sql.Conn, table string) (string, error) {
+	var name, definition string
+
+	err := conn.QueryRowContext(ctx, "SHOW CREATE TABLE "+QuoteIdentifier(table)).Scan(&name, &definition)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == errNoSuchTable {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("cannot get the definition of table %q", table))
+	}
+
+	return autoIncrementRe.ReplaceAllString(definition, ""), nil
+}
@@ -0,0 +1,221 @@
+package status
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/depgraph"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+)
+
+// VersionProgress is the state of a version over all the shards
+type VersionProgress struct {
+	Version    uint32  `json:"version"`
+	TableName  string  `json:"tableName"`
+	CmdType    string  `json:"cmdType"`
+	Applied    int     `json:"applied"`    // targeted shards with this version applied
+	InProgress int     `json:"inProgress"` // shards claimed by a task applying this version
+	Failed     int     `json:"failed"`     // shards where this version failed, waiting for an operator
+	Pending    int     `json:"pending"`    // shards still waiting for this version
+	Skipped    int     `json:"skipped"`    // shards not targeted by this version
+	AvgSeconds float64 `json:"avgDurationSeconds"`
+}
+
+// StuckShard is a shard claimed by a task that stopped sending heartbeats
+type StuckShard struct {
+	ShardID      uint32     `json:"shardId"`
+	Version      uint32     `json:"version"`
+	TaskName     string     `json:"taskName"`
+	LastTaskHb   *time.Time `json:"lastTaskHb,omitempty"`
+	TaskProgress string     `json:"taskProgress,omitempty"`
+}
+
+// Report is the rollout status of the versions over the shards
+type Report struct {
+	GeneratedAt    time.Time         `json:"generatedAt"`
+	Shards         int               `json:"shards"`
+	Versions       []VersionProgress `json:"versions"`
+	StaleTimeout   float64           `json:"staleTimeoutSeconds"`
+	Stuck          []StuckShard      `json:"stuck"`
+	RemainingTasks int               `json:"remainingTasks"`
+	Concurrency    int               `json:"concurrency"`
+	ETAKnown       bool              `json:"etaKnown"` // false when no version completed yet
+	ETASeconds     float64           `json:"etaSeconds"`
+}
+
+// Build reads the shards, versions and oplog tables and computes the report. Shards
+// claimed without heartbeat for staleTimeout are reported as stuck, concurrency is
+// the number of concurrent DDL used to estimate the time to completion.
+func Build(db database.Store, staleTimeout time.Duration, concurrency int) (*Report, error) {
+	versions, err := db.ListVersions()
+	if err != nil {
+		return nil, err
+	}
+	shards, err := db.ListShards()
+	if err != nil {
+		return nil, err
+	}
+	durations, err := db.GetVersionDurations()
+	if err != nil {
+		return nil, err
+	}
+	stuck, err := db.GetStaleShards(staleTimeout, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot look for the stuck shards")
+	}
+
+	r := Compute(versions, shards, durations, stuck, concurrency)
+	r.StaleTimeout = staleTimeout.Seconds()
+	return r, nil
+}
+
+// Compute builds the report from the content of the tables
+func Compute(versions []*models.Version, shards []*models.Shard, durations []database.VersionDuration,
+	stuck []*models.Shard, concurrency int) *Report {
+
+	r := &Report{
+		GeneratedAt: time.Now(),
+		Shards:      len(shards),
+		Versions:    make([]VersionProgress, 0, len(versions)),
+		Stuck:       make([]StuckShard, 0, len(stuck)),
+		Concurrency: concurrency,
+	}
+
+	sorted := make([]*models.Version, len(versions))
+	copy(sorted, versions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	index := make(map[uint32]int, len(sorted))
+	for i, v := range sorted {
+		index[v.Version] = i
+		r.Versions = append(r.Versions, VersionProgress{Version: v.Version, TableName: v.TableName, CmdType: v.CmdType})
+	}
+
+	// the dependencies are only needed to know the versions that can be running, an invalid
+	// dependency counts the pending versions as pending
+	graph, _ := depgraph.New(versions)
+	for _, s := range shards {
+		// only the ready versions can be running or failed
+		ready := map[uint32]bool{}
+		if graph != nil {
+			for _, v := range graph.Ready(s) {
+				ready[v] = true
+			}
+		}
+
+		for i, v := range sorted {
+			vp := &r.Versions[i]
+			switch {
+			case graph != nil && !graph.Targets(v.Version, s):
+				vp.Skipped++
+			case s.HasApplied(v.Version):
+				vp.Applied++
+			case ready[v.Version] && s.TaskName.Valid:
+				vp.InProgress++
+			case ready[v.Version] && s.Failed:
+				vp.Failed++
+			default:
+				vp.Pending++
+			}
+		}
+	}
+
+	// the versions never applied are estimated with the average of all the others
+	var totalSeconds float64
+	var totalCompleted int
+	for _, d := range durations {
+		if i, ok := index[d.Version]; ok {
+			r.Versions[i].AvgSeconds = d.AvgDuration.Seconds()
+		}
+		totalSeconds += d.AvgDuration.Seconds() * float64(d.Completed)
+		totalCompleted += d.Completed
+	}
+
+	var work float64
+	for _, vp := range r.Versions {
+		remaining := vp.InProgress + vp.Failed + vp.Pending
+		r.RemainingTasks += remaining
+		avg := vp.AvgSeconds
+		if avg == 0 && totalCompleted > 0 {
+			avg = totalSeconds / float64(totalCompleted)
+		}
+		work += avg * float64(remaining)
+	}
+	if totalCompleted > 0 && concurrency > 0 {
+		r.ETAKnown = true
+		r.ETASeconds = work / float64(concurrency)
+	}
+
+	for _, s := range stuck {
+		ss := StuckShard{
+			ShardID:      s.ShardId,
+			Version:      s.Version,
+			TaskName:     s.TaskName.String,
+			TaskProgress: s.TaskProgress.String,
+		}
+		if s.LastTaskHb.Valid {
+			hb := s.LastTaskHb.Time
+			ss.LastTaskHb = &hb
+		}
+		r.Stuck = append(r.Stuck, ss)
+	}
+
+	return r
+}
+
+// WriteText writes the report in a human readable format
+func (r *Report) WriteText(out io.Writer) error {
+	fmt.Fprintf(out, "%d shards, %d versions, generated at %s\n\n", r.Shards, len(r.Versions),
+		r.GeneratedAt.Format("2006-01-02 15:04:05"))
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTABLE\tTYPE\tAPPLIED\tIN PROGRESS\tFAILED\tPENDING\tSKIPPED\tAVG DURATION")
+	for _, vp := range r.Versions {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n", vp.Version, vp.TableName, vp.CmdType,
+			vp.Applied, vp.InProgress, vp.Failed, vp.Pending, vp.Skipped, formatSeconds(vp.AvgSeconds))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(r.Stuck) > 0 {
+		fmt.Fprintf(out, "\n%d stuck shards, no heartbeat for %s:\n", len(r.Stuck), formatSeconds(r.StaleTimeout))
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SHARD\tVERSION\tTASK\tLAST HEARTBEAT\tPROGRESS")
+		for _, s := range r.Stuck {
+			hb := ""
+			if s.LastTaskHb != nil {
+				hb = s.LastTaskHb.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", s.ShardID, s.Version, s.TaskName, hb, s.TaskProgress)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(out)
+	switch {
+	case r.RemainingTasks == 0:
+		fmt.Fprintln(out, "All the versions are applied")
+	case !r.ETAKnown:
+		fmt.Fprintf(out, "%d tasks remaining, no completed DDL yet to estimate the time to completion\n",
+			r.RemainingTasks)
+	default:
+		fmt.Fprintf(out, "%d tasks remaining, estimated time to completion: %s with %d concurrent DDL\n",
+			r.RemainingTasks, formatSeconds(r.ETASeconds), r.Concurrency)
+	}
+	return nil
+}
+
+func formatSeconds(seconds float64) string {
+	if seconds == 0 {
+		return "-"
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
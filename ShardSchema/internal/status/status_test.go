@@ -0,0 +1,75 @@
+package status
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestCompute(t *testing.T) {
+	versions := []*models.Version{
+		{Version: 2, TableName: "t2", CmdType: "sql"},
+		{Version: 1, TableName: "t1", CmdType: "pt-osc"},
+	}
+	claimed := sql.NullString{String: "host:000001", Valid: true}
+	shards := []*models.Shard{
+		{ShardId: 1, Version: 2},
+		{ShardId: 2, Version: 1, TaskName: claimed},
+		{ShardId: 3, Version: 0, Failed: true},
+		{ShardId: 4, Version: 0},
+	}
+	durations := []database.VersionDuration{{Version: 1, Completed: 2, AvgDuration: 10 * time.Minute}}
+
+	r := Compute(versions, shards, durations, []*models.Shard{shards[1]}, 2)
+
+	// version 2 doesn't depend on version 1, it is also ready on the failed shard 3
+	want := []VersionProgress{
+		{Version: 1, TableName: "t1", CmdType: "pt-osc", Applied: 2, Failed: 1, Pending: 1, AvgSeconds: 600},
+		{Version: 2, TableName: "t2", CmdType: "sql", Applied: 1, InProgress: 1, Failed: 1, Pending: 1},
+	}
+	tu.Equals(t, want, r.Versions)
+	tu.Equals(t, 4, r.Shards)
+	tu.Equals(t, 5, r.RemainingTasks)
+
+	// version 2 never completed, it is estimated with the average of version 1
+	tu.Assert(t, r.ETAKnown, "the ETA should be known")
+	tu.Equals(t, float64(5*600/2), r.ETASeconds)
+
+	tu.Equals(t, 1, len(r.Stuck))
+	tu.Equals(t, uint32(2), r.Stuck[0].ShardID)
+}
+
+func TestComputeTargets(t *testing.T) {
+	versions := []*models.Version{
+		{Version: 1, TableName: "t1", CmdType: "sql"},
+		{Version: 2, TableName: "t1", CmdType: "sql", Target: sql.NullString{String: "!archive", Valid: true}},
+	}
+	shards := []*models.Shard{
+		{ShardId: 1, Version: 2},
+		// version 2 was skipped
+		{ShardId: 2, Version: 2, Groups: []string{"archive"}},
+		{ShardId: 3, Version: 0, Groups: []string{"archive"}},
+		{ShardId: 4, Version: 1},
+	}
+
+	r := Compute(versions, shards, nil, nil, 2)
+	want := []VersionProgress{
+		{Version: 1, TableName: "t1", CmdType: "sql", Applied: 3, Pending: 1},
+		{Version: 2, TableName: "t1", CmdType: "sql", Applied: 1, Pending: 1, Skipped: 2},
+	}
+	tu.Equals(t, want, r.Versions)
+	tu.Equals(t, 2, r.RemainingTasks)
+}
+
+func TestComputeNoDurations(t *testing.T) {
+	versions := []*models.Version{{Version: 1, TableName: "t1", CmdType: "sql"}}
+	shards := []*models.Shard{{ShardId: 1, Version: 0}}
+
+	r := Compute(versions, shards, nil, nil, 2)
+	tu.Assert(t, !r.ETAKnown, "the ETA cannot be known without completed DDL")
+	tu.Equals(t, 1, r.RemainingTasks)
+}
@@ -0,0 +1,182 @@
+package throttle
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/shardconn"
+)
+
+// servers holds one connection per server checked by the Monitor, shard servers and replicas
+type servers struct {
+	mu  sync.Mutex
+	dbs map[string]*sql.DB
+}
+
+func newServers() *servers {
+	return &servers{dbs: make(map[string]*sql.DB)}
+}
+
+func (s *servers) get(dsn string) (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if db, ok := s.dbs[dsn]; ok {
+		return db, nil
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open the connection to the server")
+	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	s.dbs[dsn] = db
+	return db, nil
+}
+
+func (s *servers) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for dsn, db := range s.dbs {
+		db.Close()
+		delete(s.dbs, dsn)
+	}
+}
+
+// collect reads the metrics of the server of shardDSN needed by the thresholds
+func (s *servers) collect(ctx context.Context, shardDSN string, t Thresholds) (Metrics, error) {
+	m := Metrics{}
+
+	cfg, err := shardconn.ParseDSN(shardDSN)
+	if err != nil {
+		return m, err
+	}
+	cfg.DBName = ""
+	db, err := s.get(cfg.FormatDSN())
+	if err != nil {
+		return m, err
+	}
+
+	if t.ThreadsRunning > 0 {
+		var name string
+		if err = db.QueryRowContext(ctx, "SHOW GLOBAL STATUS LIKE 'Threads_running'").
+			Scan(&name, &m.ThreadsRunning); err != nil {
+			return m, errors.Wrap(err, "cannot read Threads_running")
+		}
+	}
+
+	if t.HistoryLength > 0 {
+		if err = db.QueryRowContext(ctx, "SELECT `COUNT` FROM information_schema.INNODB_METRICS "+
+			"WHERE NAME = 'trx_rseg_history_len'").Scan(&m.HistoryLength); err != nil {
+			return m, errors.Wrap(err, "cannot read the history list length")
+		}
+	}
+
+	if t.ReplicationLag > 0 {
+		replicas, err := queryRows(ctx, db, "SHOW SLAVE HOSTS")
+		if err != nil {
+			return m, errors.Wrap(err, "cannot list the replicas")
+		}
+		for _, r := range replicas {
+			addr := net.JoinHostPort(r["Host"], r["Port"])
+			rcfg := cfg.Clone()
+			rcfg.Net = "tcp"
+			rcfg.Addr = addr
+
+			rdb, err := s.get(rcfg.FormatDSN())
+			if err != nil {
+				return m, err
+			}
+			lag, known, err := replicationLag(ctx, rdb, t.HeartbeatTable)
+			if err != nil {
+				return m, errors.Wrap(err, fmt.Sprintf("cannot read the lag of replica %s", addr))
+			}
+			if !known {
+				m.LagUnknown = append(m.LagUnknown, addr)
+			}
+			if lag > m.ReplicationLag {
+				m.ReplicationLag = lag
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// replicationLag returns the lag of a replica from the heartbeat table or from SHOW SLAVE
+// STATUS, known is false if the replication is stopped
+func replicationLag(ctx context.Context, db *sql.DB, heartbeatTable string) (time.Duration, bool, error) {
+	if heartbeatTable != "" {
+		var micros sql.NullInt64
+		query := "SELECT TIMESTAMPDIFF(MICROSECOND, MAX(ts), UTC_TIMESTAMP(6)) FROM " + quoteTable(heartbeatTable)
+		if err := db.QueryRowContext(ctx, query).Scan(&micros); err != nil {
+			return 0, false, err
+		}
+		if !micros.Valid {
+			return 0, false, nil
+		}
+		return time.Duration(micros.Int64) * time.Microsecond, true, nil
+	}
+
+	rows, err := queryRows(ctx, db, "SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, false, err
+	}
+	if len(rows) == 0 {
+		return 0, false, fmt.Errorf("not a replica")
+	}
+	seconds, err := strconv.Atoi(rows[0]["Seconds_Behind_Master"])
+	if err != nil {
+		// NULL, the replication is stopped
+		return 0, false, nil
+	}
+	return time.Duration(seconds) * time.Second, true, nil
+}
+
+// quoteTable quotes a table name, optionally prefixed by its schema
+func quoteTable(table string) string {
+	parts := strings.SplitN(table, ".", 2)
+	for i, p := range parts {
+		parts[i] = shardconn.QuoteIdentifier(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// queryRows returns the rows of a SHOW statement by column name, the NULL values are empty
+func queryRows(ctx context.Context, db *sql.DB, query string) ([]map[string]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]string{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(columns))
+		for i, c := range columns {
+			row[c] = values[i].String
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,252 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Thresholds above which the new work on a host is paused and the running tasks slowed down
+type Thresholds struct {
+	ThreadsRunning int           // Threads_running of the host, 0 disables the check
+	ReplicationLag time.Duration // lag of the replicas of the host, 0 disables the check
+	HistoryLength  int           // InnoDB history list length of the host, 0 disables the check
+	HeartbeatTable string        // pt-heartbeat table measuring the lag, SHOW SLAVE STATUS if empty
+}
+
+// Enabled returns true if at least one threshold is set
+func (t Thresholds) Enabled() bool {
+	return t.ThreadsRunning > 0 || t.ReplicationLag > 0 || t.HistoryLength > 0
+}
+
+// Metrics of a host, only the ones with a threshold are collected
+type Metrics struct {
+	ThreadsRunning int
+	ReplicationLag time.Duration // highest lag of the replicas
+	LagUnknown     []string      // replicas where the replication is stopped
+	HistoryLength  int
+}
+
+// Check returns the thresholds crossed by m, none if the host is fine
+func (t Thresholds) Check(m Metrics) []string {
+	reasons := []string{}
+	if t.ThreadsRunning > 0 && m.ThreadsRunning >= t.ThreadsRunning {
+		reasons = append(reasons, fmt.Sprintf("Threads_running %d >= %d", m.ThreadsRunning, t.ThreadsRunning))
+	}
+	if t.ReplicationLag > 0 {
+		if m.ReplicationLag >= t.ReplicationLag {
+			reasons = append(reasons, fmt.Sprintf("replication lag %s >= %s", m.ReplicationLag, t.ReplicationLag))
+		}
+		for _, replica := range m.LagUnknown {
+			reasons = append(reasons, "replication stopped on "+replica)
+		}
+	}
+	if t.HistoryLength > 0 && m.HistoryLength >= t.HistoryLength {
+		reasons = append(reasons, fmt.Sprintf("history list length %d >= %d", m.HistoryLength, t.HistoryLength))
+	}
+	return reasons
+}
+
+// a host is forgotten when nobody asked about it for that many check intervals
+const forgetAfter = 10
+
+type hostState struct {
+	dsn       string
+	checked   bool // false until the first check
+	throttled bool
+	reason    string
+	lastCheck time.Time
+	lastWatch time.Time
+}
+
+// Monitor polls the metrics of the watched hosts in the background and tells which ones
+// are throttled. It is safe for concurrent use.
+type Monitor struct {
+	mu         sync.Mutex
+	thresholds Thresholds
+	interval   time.Duration
+	hosts      map[string]*hostState
+	logger     *slog.Logger
+	wake       chan struct{}
+
+	// collects the metrics of a host, replaced in the tests
+	collect func(ctx context.Context, dsn string, t Thresholds) (Metrics, error)
+	servers *servers
+}
+
+// NewMonitor creates a Monitor checking the hosts every interval, the throttle decisions
+// are written to logger
+func NewMonitor(thresholds Thresholds, interval time.Duration, logger *slog.Logger) *Monitor {
+	m := &Monitor{
+		thresholds: thresholds,
+		interval:   interval,
+		hosts:      make(map[string]*hostState),
+		logger:     logger,
+		wake:       make(chan struct{}, 1),
+		servers:    newServers(),
+	}
+	m.collect = m.servers.collect
+	return m
+}
+
+// Enabled returns true if at least one threshold is set
+func (m *Monitor) Enabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.thresholds.Enabled()
+}
+
+// SetThresholds changes the thresholds and the check interval, on a reload of the config
+func (m *Monitor) SetThresholds(thresholds Thresholds, interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.thresholds = thresholds
+	m.interval = interval
+	for _, h := range m.hosts {
+		h.lastCheck = time.Time{}
+	}
+}
+
+// Throttled returns true, and why, if the work on host must be paused. The host is watched
+// from then on, dsn is used to connect to it. A host is throttled until its first check.
+func (m *Monitor) Throttled(host string, dsn string) (bool, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.thresholds.Enabled() {
+		return false, ""
+	}
+
+	h, ok := m.hosts[host]
+	if !ok {
+		h = &hostState{dsn: dsn}
+		m.hosts[host] = h
+		// check the new host now
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}
+	h.lastWatch = time.Now()
+
+	if !h.checked {
+		return true, "waiting for the first check"
+	}
+	return h.throttled, h.reason
+}
+
+// HostState is the throttle state of a watched host
+type HostState struct {
+	Host      string    `json:"host"`
+	Throttled bool      `json:"throttled"`
+	Reason    string    `json:"reason,omitempty"`
+	LastCheck time.Time `json:"lastCheck"`
+}
+
+// Hosts returns the state of the watched hosts, sorted by host
+func (m *Monitor) Hosts() []HostState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make([]HostState, 0, len(m.hosts))
+	for host, h := range m.hosts {
+		throttled, reason := h.throttled, h.reason
+		if !h.checked {
+			throttled, reason = true, "waiting for the first check"
+		}
+		states = append(states, HostState{Host: host, Throttled: throttled, Reason: reason, LastCheck: h.lastCheck})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Host < states[j].Host })
+	return states
+}
+
+// Run checks the watched hosts until ctx is done
+func (m *Monitor) Run(ctx context.Context) {
+	defer m.servers.close()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		m.checkHosts(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// checkHosts checks the hosts not checked for an interval and forgets the ones nobody
+// watches anymore
+func (m *Monitor) checkHosts(ctx context.Context, now time.Time) {
+	type check struct {
+		host string
+		dsn  string
+	}
+
+	m.mu.Lock()
+	thresholds := m.thresholds
+	checks := []check{}
+	for host, h := range m.hosts {
+		if now.Sub(h.lastWatch) > forgetAfter*m.interval {
+			delete(m.hosts, host)
+			continue
+		}
+		if now.Sub(h.lastCheck) >= m.interval {
+			checks = append(checks, check{host: host, dsn: h.dsn})
+		}
+	}
+	m.mu.Unlock()
+
+	if !thresholds.Enabled() {
+		return
+	}
+
+	for _, c := range checks {
+		cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		metrics, err := m.collect(cctx, c.dsn, thresholds)
+		cancel()
+
+		reasons := []string{}
+		if err != nil {
+			// without metrics, the host is considered overloaded
+			reasons = append(reasons, fmt.Sprintf("cannot check the host: %s", err))
+		} else {
+			reasons = thresholds.Check(metrics)
+		}
+		m.update(c.host, reasons, now)
+	}
+}
+
+// update records the result of a check of host and logs the throttle decisions
+func (m *Monitor) update(host string, reasons []string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.hosts[host]
+	if !ok {
+		return
+	}
+
+	sort.Strings(reasons)
+	throttled := len(reasons) > 0
+	reason := strings.Join(reasons, ", ")
+
+	switch {
+	case throttled && (!h.throttled || reason != h.reason):
+		m.logger.Info("throttling host", "host", host, "reason", reason)
+	case !throttled && (h.throttled || !h.checked):
+		m.logger.Info("host below the thresholds, resuming", "host", host)
+	}
+
+	h.checked = true
+	h.throttled = throttled
+	h.reason = reason
+	h.lastCheck = now
+}
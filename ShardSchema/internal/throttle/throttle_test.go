@@ -0,0 +1,99 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestCheck(t *testing.T) {
+	th := Thresholds{ThreadsRunning: 50, ReplicationLag: 10 * time.Second}
+
+	tu.Equals(t, []string{}, th.Check(Metrics{ThreadsRunning: 10, ReplicationLag: time.Second}))
+	tu.Equals(t, []string{"Threads_running 60 >= 50", "replication lag 12s >= 10s"},
+		th.Check(Metrics{ThreadsRunning: 60, ReplicationLag: 12 * time.Second, HistoryLength: 1e6}))
+	tu.Equals(t, []string{"replication stopped on 10.2.3.1:3306"},
+		th.Check(Metrics{LagUnknown: []string{"10.2.3.1:3306"}}))
+
+	tu.Assert(t, !Thresholds{HeartbeatTable: "percona.heartbeat"}.Enabled(), "no threshold is set")
+}
+
+// dropTime removes the time from the log records
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.TimeKey && len(groups) == 0 {
+		return slog.Attr{}
+	}
+	return a
+}
+
+func TestMonitor(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMonitor(Thresholds{ThreadsRunning: 50}, 10*time.Second,
+		slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: dropTime})))
+
+	threads := map[string]int{"dsn1": 10, "dsn2": 80}
+	m.collect = func(ctx context.Context, dsn string, t Thresholds) (Metrics, error) {
+		if dsn == "dsn3" {
+			return Metrics{}, fmt.Errorf("connection refused")
+		}
+		return Metrics{ThreadsRunning: threads[dsn]}, nil
+	}
+
+	// the hosts are throttled until checked
+	throttled, reason := m.Throttled("host1", "dsn1")
+	tu.Assert(t, throttled, "a new host is throttled until its first check")
+	tu.Equals(t, "waiting for the first check", reason)
+	m.Throttled("host2", "dsn2")
+	m.Throttled("host3", "dsn3")
+
+	now := time.Now()
+	m.checkHosts(context.Background(), now)
+
+	throttled, _ = m.Throttled("host1", "dsn1")
+	tu.Assert(t, !throttled, "host1 is below the thresholds")
+	throttled, reason = m.Throttled("host2", "dsn2")
+	tu.Assert(t, throttled, "host2 is above the thresholds")
+	tu.Equals(t, "Threads_running 80 >= 50", reason)
+	throttled, reason = m.Throttled("host3", "dsn3")
+	tu.Assert(t, throttled, "a host that can't be checked is throttled")
+	tu.Equals(t, "cannot check the host: connection refused", reason)
+
+	// host2 goes back below the thresholds, it is checked again after the interval
+	threads["dsn2"] = 20
+	m.checkHosts(context.Background(), now.Add(time.Second))
+	throttled, _ = m.Throttled("host2", "dsn2")
+	tu.Assert(t, throttled, "host2 is only checked again after the interval")
+	m.checkHosts(context.Background(), now.Add(10*time.Second))
+	throttled, _ = m.Throttled("host2", "dsn2")
+	tu.Assert(t, !throttled, "host2 is back below the thresholds")
+
+	// every decision is logged, once
+	logs := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	tu.Equals(t, 4, len(logs))
+	tu.Equals(t, `level=INFO msg="host below the thresholds, resuming" host=host2`, logs[3])
+
+	states := m.Hosts()
+	tu.Equals(t, 3, len(states))
+	tu.Equals(t, HostState{Host: "host3", Throttled: true, Reason: "cannot check the host: connection refused",
+		LastCheck: now.Add(10 * time.Second)}, states[2])
+
+	// the hosts nobody asks about are forgotten
+	m.checkHosts(context.Background(), time.Now().Add(forgetAfter*time.Minute))
+	tu.Equals(t, 0, len(m.hosts))
+
+	// without thresholds, nothing is throttled
+	m.SetThresholds(Thresholds{}, time.Second)
+	throttled, _ = m.Throttled("host2", "dsn2")
+	tu.Assert(t, !throttled, "throttling is disabled")
+}
+
+func TestQuoteTable(t *testing.T) {
+	tu.Equals(t, "`percona`.`heartbeat`", quoteTable("percona.heartbeat"))
+	tu.Equals(t, "`heartbeat`", quoteTable("heartbeat"))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// how often the metrics read from the database are refreshed
+const metricsInterval = 15 * time.Second
+
+// metrics are the Prometheus metrics of the dispatcher, served on /metrics by the HTTP API.
+// They are only updated from the dispatcher loop.
+type metrics struct {
+	registry *prometheus.Registry
+
+	shards         *prometheus.GaugeVec
+	oldestHb       prometheus.Gauge
+	tasks          prometheus.Gauge
+	taskLimit      prometheus.Gauge
+	paused         prometheus.Gauge
+	throttledTasks prometheus.Gauge
+	throttledHosts prometheus.Gauge
+	ddlDuration    *prometheus.HistogramVec
+	failures       *prometheus.CounterVec
+
+	lastRefresh time.Time
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		shards: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "shardschema_shards",
+			Help: "Number of shards at each version.",
+		}, []string{"version"}),
+		oldestHb: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shardschema_oldest_task_heartbeat_age_seconds",
+			Help: "Seconds since the oldest heartbeat among the claimed shards, 0 if none is claimed.",
+		}),
+		tasks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shardschema_tasks_in_flight",
+			Help: "Number of tasks in the onGoing list of the dispatcher.",
+		}),
+		taskLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shardschema_task_limit",
+			Help: "Effective limit of concurrent tasks.",
+		}),
+		paused: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shardschema_paused",
+			Help: "1 if the dispatcher is paused through the API.",
+		}),
+		throttledTasks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shardschema_throttled_tasks",
+			Help: "Number of running tasks currently throttled.",
+		}),
+		throttledHosts: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "shardschema_throttled_hosts",
+			Help: "Number of shard servers above the load thresholds.",
+		}),
+		ddlDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "shardschema_ddl_duration_seconds",
+			Help: "Duration of the completed tasks, by command type.",
+			// from a second to a few days
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		}, []string{"cmd_type"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shardschema_task_failures_total",
+			Help: "Number of failed tasks, by error class.",
+		}, []string{"error_class"}),
+	}
+
+	m.registry.MustRegister(m.shards, m.oldestHb, m.tasks, m.taskLimit, m.paused, m.throttledTasks,
+		m.throttledHosts, m.ddlDuration, m.failures)
+	return m
+}
+
+// updateMetrics sets the metrics from the state of the dispatcher, the ones read from the
+// database are refreshed every metricsInterval
+func (d *dispatcher) updateMetrics() {
+	m := d.metrics
+	m.tasks.Set(float64(d.onGoing.Len()))
+	m.taskLimit.Set(float64(d.taskLimit))
+	if d.paused {
+		m.paused.Set(1)
+	} else {
+		m.paused.Set(0)
+	}
+
+	throttled := 0
+	for _, t := range d.throttled {
+		if t {
+			throttled++
+		}
+	}
+	m.throttledTasks.Set(float64(throttled))
+
+	throttled = 0
+	for _, h := range d.monitor.Hosts() {
+		if h.Throttled {
+			throttled++
+		}
+	}
+	m.throttledHosts.Set(float64(throttled))
+
+	if time.Since(m.lastRefresh) < metricsInterval {
+		return
+	}
+	m.lastRefresh = time.Now()
+
+	counts, err := d.db.CountShardsByVersion()
+	if err != nil {
+		Logger.Warn("cannot refresh the metrics", "error", err)
+		return
+	}
+	m.shards.Reset()
+	for version, count := range counts {
+		m.shards.WithLabelValues(strconv.FormatUint(uint64(version), 10)).Set(float64(count))
+	}
+
+	age, _, err := d.db.GetOldestTaskHeartbeat()
+	if err != nil {
+		Logger.Warn("cannot refresh the metrics", "error", err)
+		return
+	}
+	m.oldestHb.Set(age.Seconds())
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/ghost"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/groups"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/ptosc"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/shardconn"
+)
+
+// the defaults file of pt-osc is a temporary file created by the worker
+const planDefaultsFile = "<defaults file>"
+
+// planStep is a command the dispatcher would run on a shard
+type planStep struct {
+	Version uint32 `json:"version"`
+	CmdType string `json:"cmdType"`
+	Command string `json:"command"`
+}
+
+// shardPlan is the sequence of commands the dispatcher would run on a shard, in order
+type shardPlan struct {
+	ShardID    uint32     `json:"shardId"`
+	SchemaName string     `json:"schemaName"`
+	ShardDSN   string     `json:"shardDSN"`
+	Version    uint32     `json:"version"`
+	Skipped    string     `json:"skipped,omitempty"` // why the shard can't be claimed now
+	Steps      []planStep `json:"steps"`
+}
+
+var planHeaders = []string{"SHARD", "SCHEMA", "FROM", "VERSION", "TYPE", "COMMAND", "NOTE"}
+
+// what the plan leaves out, the dispatcher checks it when it claims the shards
+const planLimitsNote = "# ignoring the host limits, the maintenance windows and the load thresholds, " +
+	"checked when the shards are claimed"
+
+// parseRunArgs parses the arguments of the run command, returns true for a plan
+func parseRunArgs(args []string) (bool, error) {
+	var plan bool
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.BoolVar(&plan, "plan", false, "print what the dispatcher would do, without doing it")
+	if err := fs.Parse(args); err != nil {
+		return false, fmt.Errorf("run: %s", err)
+	}
+	if fs.NArg() > 0 {
+		return false, fmt.Errorf("run: unexpected argument %q", fs.Arg(0))
+	}
+	return plan, nil
+}
+
+// planCmd prints the commands the dispatcher would run on each shard, it only reads the
+// shards and versions tables
+func (c *cli) planCmd() error {
+	shards, err := c.db.ListShards()
+	if err != nil {
+		return err
+	}
+	versions, err := c.db.ListVersions()
+	if err != nil {
+		return err
+	}
+	maxVersion, err := c.db.GetMaxVersion()
+	if err != nil {
+		return err
+	}
+	// the shards the dispatcher can claim, in the order it claims them
+	claimable := []*models.Shard{}
+	for offset := 0; ; offset += claimWindow {
+		window, err := c.db.GetClaimableShards(maxVersion, offset, claimWindow)
+		if err != nil {
+			return err
+		}
+		claimable = append(claimable, window...)
+		if len(window) < claimWindow {
+			break
+		}
+	}
+
+	plans := buildPlan(shards, claimable, versions)
+	rows := [][]string{}
+	for _, p := range plans {
+		for i, step := range p.Steps {
+			note := ""
+			if i == 0 {
+				note = p.Skipped
+			}
+			rows = append(rows, []string{strconv.FormatUint(uint64(p.ShardID), 10), p.SchemaName,
+				strconv.FormatUint(uint64(p.Version), 10), strconv.FormatUint(uint64(step.Version), 10),
+				step.CmdType, step.Command, note})
+		}
+	}
+	if err = c.print(plans, planHeaders, rows); err != nil {
+		return err
+	}
+	if c.output != "json" {
+		fmt.Fprintln(c.out, planLimitsNote)
+	}
+	return nil
+}
+
+// buildPlan returns the plans of the shards below the highest version. The claimable shards,
+// as returned by GetClaimableShards, come first in the order of the claims, followed by the
+// shards that can't be claimed now. The host limits, the maintenance windows and the load
+// thresholds are ignored.
+func buildPlan(shards []*models.Shard, claimable []*models.Shard, versions []*models.Version) []shardPlan {
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	maxVersion := uint32(0)
+	if len(versions) > 0 {
+		maxVersion = versions[len(versions)-1].Version
+	}
+
+	isClaimable := map[uint32]bool{}
+	for _, s := range claimable {
+		isClaimable[s.ShardId] = true
+	}
+	waiting := []*models.Shard{}
+	for _, s := range shards {
+		// the shards at maxVersion have all the versions applied
+		if s.Version < maxVersion && !isClaimable[s.ShardId] {
+			waiting = append(waiting, s)
+		}
+	}
+	sort.SliceStable(waiting, func(i, j int) bool {
+		return waiting[i].LastUpdate.Time.Before(waiting[j].LastUpdate.Time)
+	})
+
+	plans := make([]shardPlan, 0, len(claimable)+len(waiting))
+	for _, s := range append(append([]*models.Shard{}, claimable...), waiting...) {
+		p := shardPlan{
+			ShardID:    s.ShardId,
+			SchemaName: s.SchemaName,
+			ShardDSN:   redactDSN(s.ShardDSN),
+			Version:    s.Version,
+			Steps:      []planStep{},
+		}
+		if !isClaimable[s.ShardId] {
+			p.Skipped = skipReason(s)
+		}
+		// the independent versions may run concurrently, they are listed in order
+		for _, v := range versions {
+			if !s.HasApplied(v.Version) {
+				p.Steps = append(p.Steps, planSteps(s, v)...)
+			}
+		}
+		plans = append(plans, p)
+	}
+	return plans
+}
+
+// skipReason returns why a shard not returned by GetClaimableShards can't be claimed now
+func skipReason(s *models.Shard) string {
+	switch {
+	case s.TaskName.Valid:
+		return "claimed by " + s.TaskName.String
+	case s.Failed:
+		return "failed, waiting for an operator"
+	case s.RetryAfter.Valid:
+		return "retry after " + s.RetryAfter.Time.Format(timeFormat)
+	}
+	return "not claimable now"
+}
+
+// planSteps returns the commands the worker would run to apply version to shard, a skip
+// step if the version doesn't target the shard
+func planSteps(shard *models.Shard, version *models.Version) []planStep {
+	steps := []planStep{}
+	step := func(cmdType string, command string) {
+		steps = append(steps, planStep{Version: version.Version, CmdType: cmdType, Command: command})
+	}
+
+	if version.Target.Valid {
+		target, err := groups.Parse(version.Target.String)
+		if err != nil {
+			step("error", err.Error())
+			return steps
+		}
+		if !target.Match(shard.Groups) {
+			step("skip", fmt.Sprintf("target %q doesn't match the groups of the shard %q", target,
+				groups.FormatGroups(shard.Groups)))
+			return steps
+		}
+	}
+
+	switch version.CmdType {
+	case "sql":
+		step("sql", sqlDDL(version))
+
+	case "pt-osc":
+		mysqlDSN, err := shardconn.ParseDSN(shard.ShardDSN)
+		if err != nil {
+			step("error", err.Error())
+			return steps
+		}
+		options, err := ptosc.ParseOptions(version.Options.String)
+		if err != nil {
+			step("error", err.Error())
+			return steps
+		}
+		m := &ptosc.Migration{
+			DSN:          mysqlDSN,
+			Schema:       shard.SchemaName,
+			Table:        version.TableName,
+			Alter:        version.Command,
+			Options:      options,
+			DefaultsFile: planDefaultsFile,
+			PauseFile:    ptoscPauseFile(Task{shard: shard, version: version}),
+		}
+		step("pt-osc", shellJoin(append([]string{ptosc.Command}, m.Args(false)...)))
+		step("pt-osc", shellJoin(append([]string{ptosc.Command}, m.Args(true)...)))
+
+	case "gh-ost":
+		mysqlDSN, err := shardconn.ParseDSN(shard.ShardDSN)
+		if err != nil {
+			step("error", err.Error())
+			return steps
+		}
+		args, err := ghost.Args(mysqlDSN, shard.SchemaName, version.TableName, version.Command,
+			ghostFiles(Task{shard: shard, version: version}))
+		if err != nil {
+			step("error", err.Error())
+			return steps
+		}
+		step("gh-ost", shellJoin(append([]string{"gh-ost"}, args...)))
+
+	default:
+		step("error", "unknown cmdType '"+version.CmdType+"'")
+		return steps
+	}
+
+	if version.ValidationQuery.Valid && version.ValidationQuery.String != "" {
+		step("validation", version.ValidationQuery.String+" = "+strconv.Quote(version.ValidationAnswer.String))
+	}
+	return steps
+}
+
+// shellJoin joins the arguments of a command, quoting them for a shell when needed
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "" || strings.IndexFunc(arg, needsQuote) >= 0 {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func needsQuote(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("-_=,./:%+@", r)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestBuildPlan(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) models.NullTime {
+		return models.NullTime{Time: now.Add(d), Valid: true}
+	}
+
+	versions := []*models.Version{
+		{Version: 2, CmdType: "pt-osc", TableName: "t1", Command: "ADD COLUMN c3 INT",
+			Options: sql.NullString{String: "--chunk-time 0.5", Valid: true}},
+		{Version: 1, CmdType: "sql", TableName: "t1", Command: "ADD COLUMN c2 INT",
+			ValidationQuery:  sql.NullString{String: "SELECT COUNT(*) FROM t1", Valid: true},
+			ValidationAnswer: sql.NullString{String: "0", Valid: true}},
+		{Version: 3, CmdType: "sql", TableName: "t2", Command: "ADD COLUMN c2 INT",
+			Target: sql.NullString{String: "archive", Valid: true}},
+	}
+	shards := []*models.Shard{
+		{ShardId: 1, SchemaName: "shard_1", ShardDSN: "user:pass@tcp(10.2.2.1:3306)", Version: 0,
+			TaskName: sql.NullString{String: "host:000001", Valid: true}, LastUpdate: at(-time.Hour)},
+		{ShardId: 2, SchemaName: "shard_2", ShardDSN: "user:pass@tcp(10.2.2.1:3306)", Version: 1,
+			Groups: []string{"archive"}, LastUpdate: at(-time.Minute)},
+		{ShardId: 3, SchemaName: "shard_3", ShardDSN: "user:pass@tcp(10.2.2.1:3306)", Version: 3,
+			LastUpdate: at(-2 * time.Hour)},
+		{ShardId: 4, SchemaName: "shard_4", ShardDSN: "user:pass@tcp(10.2.2.2:3306)", Version: 0,
+			LastUpdate: at(-30 * time.Minute)},
+		{ShardId: 5, SchemaName: "shard_5", ShardDSN: "user:pass@tcp(10.2.2.2:3306)", Version: 0,
+			RetryAfter: at(time.Minute), LastUpdate: at(-2 * time.Hour)},
+	}
+
+	// as returned by GetClaimableShards
+	claimable := []*models.Shard{shards[3], shards[1]}
+	plans := buildPlan(shards, claimable, versions)
+
+	// shard 3 is up to date, the claimable shards come first in their order, then the others
+	// by lastUpdate
+	tu.Equals(t, 4, len(plans))
+	order := []uint32{}
+	for _, p := range plans {
+		order = append(order, p.ShardID)
+	}
+	tu.Equals(t, []uint32{4, 2, 5, 1}, order)
+
+	tu.Equals(t, "", plans[0].Skipped)
+	tu.Equals(t, "retry after 2020-01-01 12:01:00", plans[2].Skipped)
+	tu.Equals(t, "claimed by host:000001", plans[3].Skipped)
+	tu.Equals(t, "user:xxx@tcp(10.2.2.2:3306)", plans[0].ShardDSN)
+
+	pauseFile := filepath.Join(os.TempDir(), "ptosc.4.2.pause")
+	tu.Equals(t, []planStep{
+		{Version: 1, CmdType: "sql", Command: "alter table `t1` ADD COLUMN c2 INT"},
+		{Version: 1, CmdType: "validation", Command: `SELECT COUNT(*) FROM t1 = "0"`},
+		{Version: 2, CmdType: "pt-osc", Command: "pt-online-schema-change --dry-run --alter 'ADD COLUMN c3 INT' " +
+			"--pause-file " + pauseFile + " --chunk-time 0.5 'h=10.2.2.2,P=3306,F=<defaults file>,D=shard_4,t=t1'"},
+		{Version: 2, CmdType: "pt-osc", Command: "pt-online-schema-change --execute --alter 'ADD COLUMN c3 INT' " +
+			"--pause-file " + pauseFile + " --chunk-time 0.5 'h=10.2.2.2,P=3306,F=<defaults file>,D=shard_4,t=t1'"},
+		{Version: 3, CmdType: "skip", Command: `target "archive" doesn't match the groups of the shard ""`},
+	}, plans[0].Steps)
+
+	// shard 2 only needs version 2, version 3 targets its group
+	tu.Equals(t, 3, len(plans[1].Steps))
+	tu.Equals(t, uint32(2), plans[1].Steps[0].Version)
+	tu.Equals(t, planStep{Version: 3, CmdType: "sql", Command: "alter table `t2` ADD COLUMN c2 INT"},
+		plans[1].Steps[2])
+}
+
+func TestShellJoin(t *testing.T) {
+	tu.Equals(t, "gh-ost --host=10.2.2.1 '--alter=ADD COLUMN c2 INT' ''", shellJoin([]string{"gh-ost",
+		"--host=10.2.2.1", "--alter=ADD COLUMN c2 INT", ""}))
+	tu.Equals(t, `'it'\''s'`, shellJoin([]string{"it's"}))
+}
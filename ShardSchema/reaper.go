@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/depgraph"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/groups"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/retry"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/shardconn"
+)
+
+// how often the dispatcher looks for stale shards
+const reapInterval = time.Minute
+
+// ddlState is the outcome of the check of a DDL on a shard
+type ddlState int
+
+const (
+	ddlMissing ddlState = iota // the DDL didn't land on the shard
+	ddlApplied                 // the DDL landed on the shard
+	ddlUnknown                 // there is no shard to compare with
+)
+
+// reapStaleShards reclaims the shards claimed by tasks that stopped sending heartbeats,
+// most likely because their dispatcher died. The stale task may have been applying any of
+// the ready versions of the shard, the ones whose DDL landed on the shard are marked as
+// applied. If they all landed the shard is released, otherwise it is released so that it
+// can be picked up again, or marked as failed if it has no attempts left or if the DDL
+// can't be checked: running it again may not be safe, an operator has to look.
+func reapStaleShards(db database.Store, pool *shardconn.Pool, taskName string, timeout time.Duration,
+	policy *retry.Policy) {
+	shards, err := db.GetStaleShards(timeout, taskName)
+	if err != nil {
+		Logger.Error("cannot look for stale shards", "error", err)
+		return
+	}
+	if len(shards) == 0 {
+		return
+	}
+
+	versions, err := db.ListVersions()
+	if err != nil {
+		Logger.Error("cannot read the versions", "error", err)
+		return
+	}
+	graph, err := depgraph.New(versions)
+	if err != nil {
+		Logger.Error("invalid version dependencies", "error", err)
+		return
+	}
+	byVersion := make(map[uint32]*models.Version, len(versions))
+	for _, v := range versions {
+		byVersion[v.Version] = v
+	}
+
+	for _, shard := range shards {
+		staleTask := shard.TaskName.String
+		log := Logger.With("shardId", shard.ShardId, "task", staleTask)
+		log.Warn("shard claimed by a stale task")
+
+		ready := graph.Ready(shard)
+		if len(ready) == 0 {
+			// no version to apply, the stale task had nothing to apply
+			if err = db.ReleaseShard(shard.ShardId, staleTask); err == nil {
+				db.AddOpLogRun(shard.ShardId, shard.Version, shard.Attempts, taskName,
+					"reaper: stale task "+staleTask+" had no version to apply, shard released")
+			}
+			continue
+		}
+
+		// the versions whose DDL landed, and the first one whose DDL didn't
+		landed := []*models.Version{}
+		reasons := []string{}
+		var version *models.Version
+		var reason string
+		var state ddlState
+		verified := true
+		for _, v := range ready {
+			s, why, err := ddlLanded(db, pool, shard, byVersion[v], byVersion)
+			if err != nil {
+				// most likely the shard server is unreachable, we'll try again on the next pass
+				log.Warn("cannot verify the version", "version", v, "error", err)
+				verified = false
+				break
+			}
+			if s == ddlApplied {
+				landed = append(landed, byVersion[v])
+				reasons = append(reasons, why)
+			} else if version == nil {
+				version, reason, state = byVersion[v], why, s
+			}
+		}
+		if !verified {
+			continue
+		}
+
+		applied := true
+		for i, v := range landed {
+			if version == nil && i == len(landed)-1 {
+				// all the versions landed, the shard is released with the last one
+				err = db.ShardUpgradeDone(shard.ShardId, v.Version, staleTask)
+			} else {
+				err = db.ShardVersionApplied(shard.ShardId, v.Version, staleTask)
+			}
+			if err != nil {
+				log.Error("cannot advance the shard", "version", v.Version, "error", err)
+				applied = false
+				break
+			}
+			// the attempts of the shard are reset once it is released, the entry keeps its run
+			db.AddOpLogRun(shard.ShardId, v.Version, shard.Attempts, taskName,
+				fmt.Sprintf("reaper: stale task %s, %s, version %d applied",
+					staleTask, reasons[i], v.Version))
+		}
+		if !applied || version == nil {
+			continue
+		}
+
+		if state == ddlUnknown {
+			if err = db.ShardFailed(shard.ShardId, staleTask); err != nil {
+				log.Error("cannot mark the shard as failed", "version", version.Version, "error", err)
+				continue
+			}
+			db.AddOpLog(shard.ShardId, version.Version, taskName,
+				fmt.Sprintf("reaper: stale task %s, %s, cannot tell if version %d was applied, "+
+					"shard marked as failed", staleTask, reason, version.Version), "", "")
+		} else if int(shard.Attempts) >= policy.MaxAttempts {
+			if err = db.ShardFailed(shard.ShardId, staleTask); err != nil {
+				log.Error("cannot mark the shard as failed", "version", version.Version, "error", err)
+				continue
+			}
+			db.AddOpLog(shard.ShardId, version.Version, taskName,
+				fmt.Sprintf("reaper: stale task %s, %s, attempt %d of %d, shard marked as failed",
+					staleTask, reason, shard.Attempts, policy.MaxAttempts), "", "")
+		} else {
+			// the crashed run keeps counting as an attempt, unlike a plain release
+			if err = db.ShardRetryLater(shard.ShardId, staleTask, 0); err != nil {
+				log.Error("cannot release the shard", "version", version.Version, "error", err)
+				continue
+			}
+			db.AddOpLog(shard.ShardId, version.Version, taskName,
+				fmt.Sprintf("reaper: stale task %s, %s, shard released at version %d",
+					staleTask, reason, shard.Version), "", "")
+		}
+	}
+}
+
+// staleClaim returns true if the heartbeat of the task claiming shardID, other than
+// taskName, is older than timeout: the shard can be released without racing a live task
+func staleClaim(db database.Store, shardID uint32, timeout time.Duration, taskName string) (bool, error) {
+	shards, err := db.GetStaleShards(timeout, taskName)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range shards {
+		if s.ShardId == shardID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ddlLanded checks if version was applied to shard by comparing the definition of the
+// altered table with the one of a shard whose last version on that table is version. The
+// returned string explains the decision.
+func ddlLanded(db database.Store, pool *shardconn.Pool, shard *models.Shard,
+	version *models.Version, versions map[uint32]*models.Version) (ddlState, string, error) {
+
+	reference, err := referenceShard(db, version, versions)
+	if err != nil {
+		return ddlMissing, "", err
+	}
+	if reference == nil {
+		return ddlUnknown, fmt.Sprintf("no shard with table %s at version %d to compare with",
+			version.TableName, version.Version), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	shardDef, err := getTableDefinition(ctx, pool, shard, version.TableName)
+	if err != nil {
+		return ddlMissing, "", err
+	}
+	referenceDef, err := getTableDefinition(ctx, pool, reference, version.TableName)
+	if err != nil {
+		return ddlMissing, "", err
+	}
+
+	if shardDef == referenceDef {
+		return ddlApplied, fmt.Sprintf("table %s matches shardId = %d", version.TableName, reference.ShardId), nil
+	}
+	return ddlMissing, fmt.Sprintf("table %s differs from shardId = %d", version.TableName, reference.ShardId), nil
+}
+
+// referenceShard returns a shard, not claimed by any task, whose last applied version on
+// the table of version is version, like GetReferenceShard. When the version has a target,
+// the shards that skipped it don't have the DDL, the reference is one of the targeted
+// shards. Returns nil if there are none.
+func referenceShard(db database.Store, version *models.Version,
+	versions map[uint32]*models.Version) (*models.Shard, error) {
+	if !version.Target.Valid {
+		return db.GetReferenceShard(version.Version)
+	}
+	target, err := groups.Parse(version.Target.String)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := db.ListShards()
+	if err != nil {
+		return nil, err
+	}
+
+	// the most recently updated one, like GetReferenceShard
+	var reference *models.Shard
+	for _, s := range shards {
+		if s.HasApplied(version.Version) && !s.TaskName.Valid && target.Match(s.Groups) &&
+			!tableAlteredAfter(s, version, versions) &&
+			(reference == nil || s.LastUpdate.Time.After(reference.LastUpdate.Time)) {
+			reference = s
+		}
+	}
+	return reference, nil
+}
+
+// tableAlteredAfter returns true if the shard has applied a version above version on the
+// same table
+func tableAlteredAfter(shard *models.Shard, version *models.Version, versions map[uint32]*models.Version) bool {
+	for v, later := range versions {
+		if v > version.Version && later.TableName == version.TableName && shard.HasApplied(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func getTableDefinition(ctx context.Context, pool *shardconn.Pool, shard *models.Shard, table string) (string, error) {
+	conn, err := pool.Conn(ctx, shard)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	return shardconn.TableDefinition(ctx, conn, table)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/config"
+)
+
+// reload re-reads the config file and applies the settings that can change while
+// running. The other settings are kept and logged as requiring a restart.
+func (d *dispatcher) reload() {
+	Logger.Info("reloading the config file", "file", d.configFile)
+
+	newCfg, err := config.LoadConfig(d.configFile)
+	if err != nil {
+		Logger.Error("cannot reload the config, keeping the current one", "error", err)
+		return
+	}
+
+	// the connection to the metadata database is established at startup
+	if newCfg.Host != d.cfg.Host || newCfg.Port != d.cfg.Port || newCfg.User != d.cfg.User ||
+		newCfg.Password != d.cfg.Password || newCfg.DBName != d.cfg.DBName {
+		Logger.Warn("the database connection settings changed, they require a restart")
+		newCfg.Host = d.cfg.Host
+		newCfg.Port = d.cfg.Port
+		newCfg.User = d.cfg.User
+		newCfg.Password = d.cfg.Password
+		newCfg.DBName = d.cfg.DBName
+	}
+
+	// the HTTP API is started with the dispatcher
+	if newCfg.HTTPListen != d.cfg.HTTPListen || newCfg.HTTPToken != d.cfg.HTTPToken {
+		Logger.Warn("the HTTP API settings changed, they require a restart")
+		newCfg.HTTPListen = d.cfg.HTTPListen
+		newCfg.HTTPToken = d.cfg.HTTPToken
+	}
+
+	// the log output is opened at startup
+	if newCfg.LogLevel != d.cfg.LogLevel || newCfg.LogOutput != d.cfg.LogOutput || newCfg.LogFormat != d.cfg.LogFormat ||
+		newCfg.LogMaxSize != d.cfg.LogMaxSize || newCfg.LogMaxFiles != d.cfg.LogMaxFiles {
+		Logger.Warn("the log settings changed, they require a restart")
+		newCfg.LogLevel = d.cfg.LogLevel
+		newCfg.LogOutput = d.cfg.LogOutput
+		newCfg.LogFormat = d.cfg.LogFormat
+		newCfg.LogMaxSize = d.cfg.LogMaxSize
+		newCfg.LogMaxFiles = d.cfg.LogMaxFiles
+	}
+
+	// the workers get the heartbeat interval when they start
+	if newCfg.HeartbeatInterval != d.cfg.HeartbeatInterval {
+		Logger.Warn("heartbeatInterval changed, it requires a restart", "heartbeatInterval", newCfg.HeartbeatInterval)
+		newCfg.HeartbeatInterval = d.cfg.HeartbeatInterval
+	}
+
+	if newCfg.MaxConcurrentDDL != d.cfg.MaxConcurrentDDL {
+		Logger.Info("maxConcurrentDDL changed", "from", d.cfg.MaxConcurrentDDL, "to", newCfg.MaxConcurrentDDL)
+	}
+	if newCfg.ThrottlingFile != d.cfg.ThrottlingFile {
+		Logger.Info("throttlingFile changed", "from", d.cfg.ThrottlingFile, "to", newCfg.ThrottlingFile)
+	}
+	if newCfg.MaxConcurrentDDLPerHost != d.cfg.MaxConcurrentDDLPerHost {
+		Logger.Info("maxConcurrentDDLPerHost changed", "from", d.cfg.MaxConcurrentDDLPerHost,
+			"to", newCfg.MaxConcurrentDDLPerHost)
+	}
+	if newThresholds(newCfg) != newThresholds(d.cfg) || newCfg.ThrottleCheckInterval != d.cfg.ThrottleCheckInterval {
+		Logger.Info("throttle thresholds changed", "from", fmt.Sprintf("%+v", newThresholds(d.cfg)),
+			"to", fmt.Sprintf("%+v", newThresholds(newCfg)), "checkInterval", newCfg.ThrottleCheckInterval)
+	}
+	if len(newCfg.Windows) != len(d.cfg.Windows) {
+		Logger.Info("maintenance windows changed", "from", len(d.cfg.Windows), "to", len(newCfg.Windows))
+	}
+	if newCfg.PollInterval != d.cfg.PollInterval {
+		Logger.Info("pollInterval changed", "from", d.cfg.PollInterval, "to", newCfg.PollInterval)
+	}
+
+	d.cfg = newCfg
+	d.policy = newRetryPolicy(d.cfg)
+	d.monitor.SetThresholds(newThresholds(d.cfg), d.cfg.ThrottleCheckInterval)
+	d.resizeWorkers(d.cfg.MaxConcurrentDDL)
+	d.pool.SetMaxConnPerHost(d.cfg.MaxConcurrentDDL + 1)
+
+	// the task limit is capped by the number of workers
+	if d.taskLimit > d.cfg.MaxConcurrentDDL {
+		d.taskLimit = d.cfg.MaxConcurrentDDL
+	}
+}
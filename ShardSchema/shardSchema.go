@@ -1,27 +1,30 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"container/list"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
-	"os/exec"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
 	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/config"
 	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/logging"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/migrate"
 	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/shardconn"
 )
 
-var buf bytes.Buffer
-var Logger = log.New(&buf, "shardSchema: ", log.Lshortfile)
+// Logger is the logger of ShardSchema, it only reports the warnings on stderr until the
+// dispatcher configures it from the config file
+var Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
 
 type Task struct {
 	name    string
@@ -29,39 +32,72 @@ type Task struct {
 	version *models.Version // Version to apply
 }
 
+// logger returns Logger with the fields of the task
+func (t *Task) logger() *slog.Logger {
+	return Logger.With("shardId", t.shard.ShardId, "version", t.version.Version, "task", t.name)
+}
+
+// key returns the key of the task, a shard may run several tasks applying different versions
+func (t *Task) key() taskKey {
+	return taskKey{shardID: t.shard.ShardId, version: t.version.Version}
+}
+
+// taskKey identifies a task of the dispatcher
+type taskKey struct {
+	shardID uint32
+	version uint32
+}
+
 func (t *Task) String() string {
 	return fmt.Sprintf("%s, %v", t.name, t.version)
 }
 
 type MsgToWorker struct {
-	msgType uint8 // message type, 1=new task, 2=status, 3=abort (only new task is implemented)
+	msgType uint8 // message type, 1=new task, 2=status, 3=abort, 4=stop, 5=throttle, 6=resume (status is not implemented)
 	task    Task
 }
 
 type MsgFromWorker struct {
-	msgType uint8 // message type, 0 = idle, 1=running, 2=done, 3=failed
-	task    Task
+	msgType  uint8 // message type, 0 = idle, 1=running, 2=done, 3=failed, 4=cancelled, 5=stopped
+	task     Task
+	workerID int    // id of the worker sending the message
+	progress string // progress information of a running task
+	errClass string // class of the error of a failed task, see the retry package
 }
 
 func main() {
-	Logger.Println("main started")
+	Logger.Debug("main started")
 
-	if len(os.Args) < 2 {
-		fmt.Println("must indicate the config file name")
-		os.Exit(1)
-	}
-	configFile := os.Args[1] // only support one argument which is the configuration file
+	os.Exit(runCLI(os.Args[1:], os.Stdout))
+}
 
+// runDispatcher runs the dispatcher until it is stopped by a signal and returns the exit status
+func runDispatcher(configFile string) int {
 	cfg, err := config.LoadConfig(configFile)
 	if err != nil {
-		log.Printf("cannot load config: %s", err)
-		os.Exit(1)
+		Logger.Error("cannot load config", "error", err)
+		return 1
+	}
+
+	logger, logCloser, err := logging.New(logging.Options{Level: cfg.LogLevel, Output: cfg.LogOutput,
+		Format: cfg.LogFormat, MaxSize: int64(cfg.LogMaxSize) << 20, MaxFiles: cfg.LogMaxFiles})
+	if err != nil {
+		Logger.Error("cannot open the log output", "error", err)
+		return 1
 	}
+	defer logCloser.Close()
+	// the database logs through the default logger
+	Logger = logger
+	slog.SetDefault(logger)
 
 	conn, err := getDBConnection(cfg)
 	if err != nil {
-		log.Printf("cannot connect to the db: %s", err)
-		os.Exit(1)
+		Logger.Error("cannot connect to the db", "error", err)
+		return 1
+	}
+	if err = migrate.Check(conn); err != nil {
+		Logger.Error("cannot use the metadata schema", "error", err)
+		return 1
 	}
 	db := database.NewDatabase(conn)
 
@@ -69,263 +105,55 @@ func main() {
 	hostname, _ := os.Hostname()
 	taskName := fmt.Sprintf("%s:%06d", hostname, os.Getpid())
 
-	// Create the list on ongoing task
-	onGoing := list.New()
+	// For the signals, a second signal forces the exit
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	// Create the channels to and from the workers
-	submitMsg := make(chan MsgToWorker, 5)  // do we need buffering?
-	replyMsg := make(chan MsgFromWorker, 5) // do we need buffering?
+	// SIGHUP reloads the config file
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
 
-	// For the signals
-	//sigs := make(chan os.Signal, 1)
+	// The connections to the shards are pooled per host, one extra connection
+	// per host in case a ddl is stuck on a lock
+	pool := shardconn.NewPool(cfg.MaxConcurrentDDL + 1)
 
-	numWorkers := cfg.MaxConcurrentDDL
+	d := newDispatcher(configFile, cfg, db, pool, taskName)
 
-	// Inspired from: https://gobyexample.com/worker-pools
-	// Starting the workers
-	for w := 1; w <= numWorkers; w++ {
-		go worker(db, w, submitMsg, replyMsg)
-	}
-
-	taskLimit := numWorkers
-	newTaskLimit := numWorkers
-	iteration := 0
-	for {
-		// just a generic loop counter
-		iteration++
-
-		// Let's read if the throttling file is present
-		if _, err := os.Stat(cfg.ThrottlingFile); !os.IsNotExist(err) {
-			Logger.Println("throttlingFile exists")
-
-			// Let's open it
-			file, err := os.Open(cfg.ThrottlingFile)
-			if err != nil {
-				break
-			}
-
-			Logger.Println("throttling file opened")
-
-			// Let's read the first line and try to convert to int
-			scanner := bufio.NewScanner(file)
-			if scanner.Scan() {
-				newTaskLimit, err = strconv.Atoi(scanner.Text())
-				if err != nil {
-					taskLimit = newTaskLimit
-				}
-			}
-			file.Close()
+	// the HTTP API talks to the dispatcher loop, it is stopped when the loop exits
+	if cfg.HTTPListen != "" {
+		ln, err := net.Listen("tcp", cfg.HTTPListen)
+		if err != nil {
+			Logger.Error("cannot listen for the HTTP API", "address", cfg.HTTPListen, "error", err)
+			return 1
 		}
+		srv := &http.Server{Handler: newAPIHandler(d, cfg.HTTPToken), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				Logger.Error("the HTTP API stopped", "error", err)
+			}
+		}()
+		defer srv.Close()
+	}
 
-		if newTaskLimit > numWorkers {
-			Logger.Printf("taskLimit set to %d. capping to numWorkers: %d\n", newTaskLimit, numWorkers)
-			newTaskLimit = numWorkers
-		}
-
-		if newTaskLimit < 0 {
-			Logger.Println("taskLimit can't be negative, setting it to 0")
-			newTaskLimit = 0
-		}
-
-		taskLimit = newTaskLimit
-
-		// Can we submit jobs?
-		if onGoing.Len() < taskLimit {
-
-			//Yes, first we need the current highest version
-			maxVersion, _ := db.GetMaxVersion()
-
-			//then let's try to find a shard needing work
-			shardToUpgrade, _ := db.GetShardToUpgrade(maxVersion, taskName)
-
-			if shardToUpgrade != nil {
-				// we have a shard!!!
-				Logger.Printf("Found shardId = %d needing work\n", shardToUpgrade.ShardId)
-
-				// What is the next version?
-				nextVersion, err := db.GetNextVersion(shardToUpgrade.Version)
-				if err != nil {
-					// TODO handle the error
-				}
-
-				newTask := Task{name: taskName, shard: shardToUpgrade, version: nextVersion}
-
-				onGoing.PushFront(newTask)
-
-				// Now, build and send a message to the workers
-				// this should never block since we never go beyond taskLimit
-				submitMsg <- MsgToWorker{msgType: 1, task: newTask}
+	d.resizeWorkers(cfg.MaxConcurrentDDL)
+	status := d.run(sigs, hups)
 
-			}
-		}
+	pool.Close()
+	return status
+}
 
-		// listen and process messages
-		gotTimeout := 0
-		for gotTimeout < 1 { // use gotTimeout to read all messages
-			select {
-			case rmsg := <-replyMsg:
-				{
-					switch rmsg.msgType {
-					case 0:
-						{ //idle  (no impleted yet)
-							Logger.Println("Received idle message")
-						}
-					case 1:
-						{ // running (no impleted yet)
-							// Update the Heartbeat field of shards
-							Logger.Println("Received running message")
-							db.UpdateShardTaskHeartbeat(rmsg.task.shard.ShardId, taskName)
-
-						}
-					case 2:
-						{ // task done
-							// the task is done, update the shards table
-							db.ShardUpgradeDone(rmsg.task.shard.ShardId,
-								rmsg.task.version.Version, taskName)
-
-							// and remove the task from the onGoing list
-							for e := onGoing.Front(); e != nil; e = e.Next() {
-								if e.Value.(models.Shard).ShardId == rmsg.task.shard.ShardId &&
-									e.Value.(models.Shard).Version == rmsg.task.version.Version {
-									onGoing.Remove(e)
-								}
-							}
-
-						}
-					case 3:
-						{ // task failed
-							Logger.Printf("Update of shard: %d to version %d failed. Look at the log table for more details",
-								rmsg.task.shard.ShardId, rmsg.task.version.Version)
-
-							// and remove the task from the onGoing list
-							for e := onGoing.Front(); e != nil; e = e.Next() {
-								if e.Value.(models.Shard).ShardId == rmsg.task.shard.ShardId &&
-									e.Value.(models.Shard).Version == rmsg.task.version.Version {
-									onGoing.Remove(e)
-								}
-							}
-						}
-
-					}
-				}
-			case <-time.After(time.Second * 1):
-				{
-					gotTimeout = 1
-				}
-			}
-		}
+// openDatabase loads the config file and connects to the ShardSchema database
+func openDatabase(configFile string) (*config.Config, database.Store, error) {
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot load config")
 	}
-}
 
-func worker(db *database.Database, id int, MsgIn <-chan MsgToWorker, MsgOut chan<- MsgFromWorker) {
-
-	for {
-		select {
-		case rmsg := <-MsgIn:
-			{
-				switch rmsg.msgType {
-				case 1:
-					{ // new task, only type implemented so far
-						Logger.Printf("Received a task: %+v\n", rmsg.task)
-
-						// start the work
-						switch rmsg.task.version.CmdType {
-						case "sql":
-							{
-
-								sqlddl := "alter table `" + rmsg.task.version.TableName + "` " + rmsg.task.version.Command
-								db.AddOpLog(rmsg.task.shard.ShardId, rmsg.task.version.Version, rmsg.task.name,
-									"starting SQL command: '"+sqlddl+"'", "", "")
-
-								//dbddl, err := sql.Open("mysql", t.shard.shardDSN+"/"+t.shard.schemaName)
-								//if err != nil {
-								//	addOpLog(t.shard.shardId, t.version.version, t.name,
-								//		"Error: shard db connection", "", err)
-
-								//	MsgOut <- MsgFromWorker{msgType: 3, task: rmsg.task}
-								//} else {
-								//	res, err := dbddl.Exec(sqlddl)
-								//	if err != nil {
-								//		addOpLog(t.shard.shardId, t.version.version, t.name,
-								//			"Error: ddl error", "", err)
-
-								//		MsgOut <- MsgFromWorker{msgType: 3, task: rmsg.task}
-								//	} else {
-								//		addOpLog(t.shard.shardId, t.version.version, t.name,
-								//			"Completed OK", "", "")
-
-								//		MsgOut <- MsgFromWorker{msgType: 2, task: rmsg.task}
-								//	}
-								//}
-							}
-
-						case "pt-osc":
-							{
-								mysqlDSN, err := mysql.ParseDSN(rmsg.task.shard.ShardDSN)
-								if err != nil {
-									db.AddOpLog(rmsg.task.shard.ShardId, rmsg.task.version.Version, rmsg.task.name,
-										"Error parsing the shard DSN: '"+rmsg.task.shard.ShardDSN+"'", "", err.Error())
-
-									MsgOut <- MsgFromWorker{msgType: 3, task: rmsg.task}
-								} else {
-
-									cmdName := "pt-online-schema-change"
-									cmdArgs := []string{"--execute", "--alter", "rmsg.task.version.command",
-										"u=" + mysqlDSN.User + ",p=" + mysqlDSN.Passwd + ",D=" +
-											rmsg.task.shard.SchemaName + ",t=" + rmsg.task.version.TableName}
-
-									cmd := exec.Command(cmdName, cmdArgs...)
-									cmdOut, err := cmd.StdoutPipe()
-									cmdErr, err := cmd.StderrPipe()
-
-									var bout bytes.Buffer
-									var berr bytes.Buffer
-
-									go func() {
-										bout.ReadFrom(cmdOut)
-									}()
-
-									go func() {
-										berr.ReadFrom(cmdErr)
-									}()
-
-									db.AddOpLog(rmsg.task.shard.ShardId, rmsg.task.version.Version, rmsg.task.name,
-										"starting pt-osc command: "+cmdName+" with args: "+
-											strings.Join(cmdArgs, " "), "", "")
-
-									err = cmd.Start()
-									if err != nil {
-										db.AddOpLog(rmsg.task.shard.ShardId, rmsg.task.version.Version, rmsg.task.name,
-											"Error: command: "+cmdName+" with args: ["+
-												strings.Join(cmdArgs, " ")+"] failed to start", "", "")
-
-										MsgOut <- MsgFromWorker{msgType: 3, task: rmsg.task}
-
-									} else {
-
-										err = cmd.Wait()
-										if err != nil {
-											db.AddOpLog(rmsg.task.shard.ShardId, rmsg.task.version.Version, rmsg.task.name,
-												"Error: command: "+cmdName+" with args: ["+
-													strings.Join(cmdArgs, " ")+"] failed", bout.String(), berr.String())
-
-											MsgOut <- MsgFromWorker{msgType: 3, task: rmsg.task}
-
-										} else {
-											db.AddOpLog(rmsg.task.shard.ShardId, rmsg.task.version.Version, rmsg.task.name,
-												"Completed OK", bout.String(), berr.String())
-
-											MsgOut <- MsgFromWorker{msgType: 2, task: rmsg.task}
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
+	conn, err := getDBConnection(cfg)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot connect to the db")
 	}
+	return cfg, database.NewDatabase(conn), nil
 }
 
 func getDBConnection(cfg *config.Config) (*sql.DB, error) {
@@ -355,6 +183,23 @@ func getDBConnection(cfg *config.Config) (*sql.DB, error) {
 	return db, nil
 }
 
+// createDatabase creates the ShardSchema database of the config if it doesn't exist
+func createDatabase(cfg *config.Config) error {
+	serverCfg := *cfg
+	serverCfg.DBName = ""
+	conn, err := getDBConnection(&serverCfg)
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to the server")
+	}
+	defer conn.Close()
+
+	name := strings.Replace(cfg.DBName, "`", "``", -1)
+	if _, err = conn.Exec("CREATE DATABASE IF NOT EXISTS `" + name + "`"); err != nil {
+		return errors.Wrap(err, "cannot create the database "+cfg.DBName)
+	}
+	return nil
+}
+
 func buildDSN(cfg *config.Config) string {
 	dsnCfg := mysql.NewConfig() // Load defaults from mysql pkg
 
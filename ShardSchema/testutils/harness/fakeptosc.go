@@ -0,0 +1,77 @@
+package harness
+
+// fakePtosc is the fake pt-online-schema-change installed in the PATH. The dry runs always
+// succeed, each --execute run of a shard evaluates the next line of the script of its table,
+// scripts/<schema>.<table>, or else of its schema, scripts/<schema>, and succeeds once the
+// script is exhausted. Every run is recorded in calls/<schema>, one line of arguments per run
+// followed by the events of the run.
+const fakePtosc = `#!/bin/sh
+dir=$(dirname "$(dirname "$0")")
+
+execute=0
+pause=
+db=
+table=
+args="$*"
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--execute) execute=1 ;;
+	--pause-file) shift; pause="$1" ;;
+	*D=*)
+		db=$(echo "$1" | sed -n 's/.*D=\([^,]*\).*/\1/p')
+		table=$(echo "$1" | sed -n 's/.*t=\([^,]*\).*/\1/p')
+		;;
+	esac
+	shift
+done
+
+calls="$dir/calls/$db"
+echo "run: $args" >> "$calls"
+[ "$execute" = 1 ] || exit 0
+
+# the line of the script for this run
+script="$dir/scripts/$db.$table"
+[ -e "$script" ] || script="$dir/scripts/$db"
+runs="$script.runs"
+run=$(( $(cat "$runs" 2>/dev/null || echo 0) + 1 ))
+echo "$run" > "$runs"
+line=$(sed -n "${run}p" "$script" 2>/dev/null)
+
+event() { echo "$*" >> "$calls"; }
+
+# progress <percent> reports the progress like pt-osc
+progress() { echo "Copying \` + "`" + `$db\` + "`" + `.\` + "`" + `$table\` + "`" + `:  $1% 00:10 remain" >&2; }
+
+# copy <seconds> copies rows for seconds, the time spent paused by the pause file isn't counted
+copy() {
+	ticks=$(( $1 * 10 ))
+	paused=0
+	while [ "$ticks" -gt 0 ]; do
+		if [ -n "$pause" ] && [ -e "$pause" ]; then
+			[ "$paused" = 1 ] || event paused
+			paused=1
+		else
+			[ "$paused" = 0 ] || event resumed
+			paused=0
+			ticks=$(( ticks - 1 ))
+		fi
+		sleep 0.1
+	done
+}
+
+# fail <status> <message> exits with the status of pt-osc after writing message on stderr
+fail() { status=$1; shift; echo "$*" >&2; event "failed $status"; exit "$status"; }
+
+# hang runs until pt-osc is stopped
+hang() { trap 'event stopped; exit 143' TERM; while :; do sleep 0.1; done; }
+
+# crash is killed like by the OOM killer
+crash() { event crashed; kill -KILL $$; }
+
+ok() { exit 0; }
+
+trap 'event stopped; exit 143' TERM
+eval "$line"
+event completed
+exit 0
+`
@@ -0,0 +1,210 @@
+// Package harness helps writing the end-to-end tests of ShardSchema: it seeds the versions
+// and the shards of a store, puts a scriptable fake pt-online-schema-change in the PATH and
+// checks the resulting versions and oplog.
+package harness
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+// DSN is the server of the seeded shards, the fake pt-online-schema-change never connects to it
+const DSN = "user:pass@tcp(10.2.2.1:3306)"
+
+// Harness is an end-to-end test environment around a store
+type Harness struct {
+	Store database.Store
+	// Dir holds the fake pt-online-schema-change, its scripts and the recorded runs. It is
+	// also the TMPDIR of the test, for the pause and defaults files.
+	Dir string
+
+	tb testing.TB
+}
+
+// New creates the harness of store and installs the fake pt-online-schema-change in the PATH
+// for the duration of the test
+func New(tb testing.TB, store database.Store) *Harness {
+	h := &Harness{Store: store, Dir: tb.TempDir(), tb: tb}
+	for _, dir := range []string{"bin", "scripts", "calls", "tmp"} {
+		tu.Ok(tb, os.Mkdir(filepath.Join(h.Dir, dir), 0755))
+	}
+	tu.Ok(tb, ioutil.WriteFile(filepath.Join(h.Dir, "bin", "pt-online-schema-change"), []byte(fakePtosc), 0755))
+
+	tb.Setenv("PATH", filepath.Join(h.Dir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"))
+	tb.Setenv("TMPDIR", filepath.Join(h.Dir, "tmp"))
+	return h
+}
+
+// AddVersion adds a pt-osc version altering table, returns its number
+func (h *Harness) AddVersion(table string, alter string) uint32 {
+	version, err := h.Store.AddVersion(&models.Version{Command: alter, TableName: table, CmdType: "pt-osc"})
+	tu.Ok(h.tb, err)
+	return version
+}
+
+// AddTargetedVersion adds a pt-osc version altering table on the shards matching target,
+// returns its number
+func (h *Harness) AddTargetedVersion(table string, alter string, target string) uint32 {
+	version, err := h.Store.AddVersion(&models.Version{Command: alter, TableName: table, CmdType: "pt-osc",
+		Target: sql.NullString{String: target, Valid: true}})
+	tu.Ok(h.tb, err)
+	return version
+}
+
+// SetGroups sets the groups of a shard
+func (h *Harness) SetGroups(shardID uint32, groups ...string) {
+	tu.Ok(h.tb, h.Store.SetShardGroups(shardID, groups))
+}
+
+// AddShards adds n shards at version, named shard_<shardId>. Returns their ids.
+func (h *Harness) AddShards(n int, version uint32) []uint32 {
+	shards, err := h.Store.ListShards()
+	tu.Ok(h.tb, err)
+
+	ids := []uint32{}
+	for i := 1; i <= n; i++ {
+		// the ids of a fresh table follow the number of rows
+		want := uint32(len(shards) + i)
+		id, err := h.Store.AddShard(fmt.Sprintf("shard_%d", want), DSN, version)
+		tu.Ok(h.tb, err)
+		tu.Assert(h.tb, id == want, "shard_%d got the shardId %d, the shards table must be fresh", want, id)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ClaimStale claims shardID to upgrade it to version as taskName, a dispatcher whose last
+// heartbeat is age old
+func (h *Harness) ClaimStale(version uint32, shardID uint32, taskName string, age time.Duration) {
+	if store, ok := h.Store.(*database.MemoryStore); ok {
+		store.Now = func() time.Time { return time.Now().Add(-age) }
+		defer func() { store.Now = time.Now }()
+	}
+	claimed, err := h.Store.ClaimShards(version, taskName, 1, []uint32{shardID})
+	tu.Ok(h.tb, err)
+	tu.Equals(h.tb, 1, len(claimed))
+
+	if db, ok := h.Store.(*database.Database); ok {
+		_, err = db.Conn.Exec("UPDATE shards SET lastTaskHb = NOW() - INTERVAL ? SECOND WHERE shardId = ?",
+			int(age.Seconds()), shardID)
+		tu.Ok(h.tb, err)
+	}
+}
+
+// Script sets what the --execute runs of the fake pt-online-schema-change do on a schema,
+// or on a table with "<schema>.<table>", one line per run, the runs after the last line
+// succeed. A line is a sequence of commands separated by ";":
+//
+//	progress <percent>    reports the progress on stderr
+//	copy <seconds>        copies rows for seconds, the pause file suspends the copy
+//	fail <status> <text>  exits with the pt-osc status, text is written on stderr
+//	hang                  runs until stopped
+//	crash                 gets killed with SIGKILL
+//	ok                    succeeds
+func (h *Harness) Script(schema string, runs ...string) {
+	data := strings.Join(runs, "\n") + "\n"
+	tu.Ok(h.tb, ioutil.WriteFile(filepath.Join(h.Dir, "scripts", schema), []byte(data), 0644))
+}
+
+// Calls returns the recorded runs of the fake pt-online-schema-change on a schema: a
+// "run: <args>" line per run, followed by the events of the run, like "paused" or
+// "completed"
+func (h *Harness) Calls(schema string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, "calls", schema))
+	if os.IsNotExist(err) {
+		return []string{}
+	}
+	tu.Ok(h.tb, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// HasCall returns true if one of the recorded lines of schema starts with prefix
+func (h *Harness) HasCall(schema string, prefix string) bool {
+	for _, line := range h.Calls(schema) {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitFor waits up to timeout for cond to be true, the test fails otherwise
+func (h *Harness) WaitFor(timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.tb.Fatalf("timeout after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Shard returns a shard of the store
+func (h *Harness) Shard(shardID uint32) *models.Shard {
+	shard, err := h.Store.GetShard(shardID)
+	tu.Ok(h.tb, err)
+	return shard
+}
+
+// Versions returns the version of every shard, by shardId
+func (h *Harness) Versions() map[uint32]uint32 {
+	shards, err := h.Store.ListShards()
+	tu.Ok(h.tb, err)
+	versions := map[uint32]uint32{}
+	for _, s := range shards {
+		versions[s.ShardId] = s.Version
+	}
+	return versions
+}
+
+// AtVersion returns true if all the shards are at version and released
+func (h *Harness) AtVersion(version uint32) bool {
+	shards, err := h.Store.ListShards()
+	tu.Ok(h.tb, err)
+	for _, s := range shards {
+		if s.Version != version || s.TaskName.Valid {
+			return false
+		}
+	}
+	return true
+}
+
+// AssertVersions fails the test if the versions of the shards aren't want
+func (h *Harness) AssertVersions(want map[uint32]uint32) {
+	tu.Equals(h.tb, want, h.Versions())
+}
+
+// OpLog returns the messages of the oplog of a shard for a version
+func (h *Harness) OpLog(shardID uint32, version uint32) []string {
+	entries, err := h.Store.GetOpLog(shardID, version, false)
+	tu.Ok(h.tb, err)
+	messages := []string{}
+	for _, e := range entries {
+		messages = append(messages, e.Message.String)
+	}
+	return messages
+}
+
+// AssertOpLog fails the test if the oplog messages of a shard for a version don't start,
+// in order, with the prefixes
+func (h *Harness) AssertOpLog(shardID uint32, version uint32, prefixes ...string) {
+	messages := h.OpLog(shardID, version)
+	ok := len(messages) == len(prefixes)
+	for i := 0; ok && i < len(prefixes); i++ {
+		ok = strings.HasPrefix(messages[i], prefixes[i])
+	}
+	if !ok {
+		h.tb.Fatalf("unexpected oplog of shardId = %d, version %d\n\texp: %q\n\tgot: %q", shardID, version,
+			prefixes, messages)
+	}
+}
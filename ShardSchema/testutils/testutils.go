@@ -66,6 +66,39 @@ func GetMySQLConnection(tb testing.TB) *sql.DB {
 	return db
 }
 
+// OpenMySQLDatabase drops and creates the database name on the test server and returns a
+// connection to it
+func OpenMySQLDatabase(tb testing.TB, name string) *sql.DB {
+	conn := GetMySQLConnection(tb)
+	if _, err := conn.Exec("DROP DATABASE IF EXISTS `" + name + "`"); err != nil {
+		fmt.Printf("%s cannot drop the database %s: %s\n", caller(), name, err)
+		tb.FailNow()
+	}
+	if _, err := conn.Exec("CREATE DATABASE `" + name + "`"); err != nil {
+		fmt.Printf("%s cannot create the database %s: %s\n", caller(), name, err)
+		tb.FailNow()
+	}
+
+	dsn := os.Getenv("SHARDSCHEMA_TEST_DSN")
+	if dsn == "" {
+		dsn = "root:@tcp(127.0.0.1:3306)/shardschema"
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		fmt.Printf("%s cannot parse DSN %q: %s", caller(), dsn, err)
+		tb.FailNow()
+	}
+	cfg.DBName = name
+	cfg.ParseTime = true
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		fmt.Printf("%s cannot connect to the db %s: %s\n", caller(), name, err)
+		tb.FailNow()
+	}
+	return db
+}
+
 func LoadQueriesFromFile(tb testing.TB, filename string) {
 	conn := GetMySQLConnection(tb)
 	file := filepath.Join("testdata", filename)
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/depgraph"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/groups"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/migrate"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+)
+
+// The views are the JSON representations of the models, they are also used to build
+// the rows of the table output.
+
+const timeFormat = "2006-01-02 15:04:05"
+
+type versionView struct {
+	Version          uint32    `json:"version"`
+	Command          string    `json:"command"`
+	TableName        string    `json:"tableName"`
+	CmdType          string    `json:"cmdType"`
+	ValidationQuery  string    `json:"validationQuery,omitempty"`
+	ValidationAnswer string    `json:"validationAnswer,omitempty"`
+	Options          string    `json:"options,omitempty"`
+	DependsOn        []uint32  `json:"dependsOn"`
+	Target           string    `json:"target,omitempty"`
+	LastUpdate       time.Time `json:"lastUpdate"`
+}
+
+// newVersionView returns the view of v, deps are its resolved dependencies
+func newVersionView(v *models.Version, deps []uint32) versionView {
+	return versionView{
+		Version:          v.Version,
+		Command:          v.Command,
+		TableName:        v.TableName,
+		CmdType:          v.CmdType,
+		ValidationQuery:  v.ValidationQuery.String,
+		ValidationAnswer: v.ValidationAnswer.String,
+		Options:          v.Options.String,
+		DependsOn:        deps,
+		Target:           v.Target.String,
+		LastUpdate:       v.LastUpdate,
+	}
+}
+
+func (v versionView) row() []string {
+	validation := ""
+	if v.ValidationQuery != "" {
+		validation = v.ValidationQuery + " = " + strconv.Quote(v.ValidationAnswer)
+	}
+	return []string{strconv.FormatUint(uint64(v.Version), 10), v.TableName, depgraph.FormatDependsOn(v.DependsOn),
+		v.Target, v.CmdType, v.Command, v.Options, validation, v.LastUpdate.Format(timeFormat)}
+}
+
+var versionHeaders = []string{"VERSION", "TABLE", "DEPENDS ON", "TARGET", "TYPE", "COMMAND", "OPTIONS",
+	"VALIDATION", "LAST UPDATE"}
+
+type shardView struct {
+	ShardID        uint32     `json:"shardId"`
+	SchemaName     string     `json:"schemaName"`
+	ShardDSN       string     `json:"shardDSN"`
+	Groups         []string   `json:"groups"`
+	Version        uint32     `json:"version"`
+	Applied        []uint32   `json:"applied,omitempty"` // versions above version already applied
+	TaskName       string     `json:"taskName,omitempty"`
+	LastTaskHb     *time.Time `json:"lastTaskHb,omitempty"`
+	TaskProgress   string     `json:"taskProgress,omitempty"`
+	AbortRequested bool       `json:"abortRequested"`
+	Attempts       uint8      `json:"attempts"`
+	RetryAfter     *time.Time `json:"retryAfter,omitempty"`
+	Failed         bool       `json:"failed"`
+	LastUpdate     *time.Time `json:"lastUpdate,omitempty"`
+}
+
+func newShardView(s *models.Shard) shardView {
+	return shardView{
+		ShardID:        s.ShardId,
+		SchemaName:     s.SchemaName,
+		ShardDSN:       redactDSN(s.ShardDSN),
+		Groups:         s.Groups,
+		Version:        s.Version,
+		Applied:        s.Applied,
+		TaskName:       s.TaskName.String,
+		LastTaskHb:     nullTime(s.LastTaskHb),
+		TaskProgress:   s.TaskProgress.String,
+		AbortRequested: s.AbortRequested,
+		Attempts:       s.Attempts,
+		RetryAfter:     nullTime(s.RetryAfter),
+		Failed:         s.Failed,
+		LastUpdate:     nullTime(s.LastUpdate),
+	}
+}
+
+func (s shardView) row() []string {
+	state := ""
+	switch {
+	case s.Failed:
+		state = "failed"
+	case s.RetryAfter != nil:
+		state = "retry after " + formatTime(s.RetryAfter)
+	}
+	version := strconv.FormatUint(uint64(s.Version), 10)
+	if len(s.Applied) > 0 {
+		version += " +" + depgraph.FormatDependsOn(s.Applied)
+	}
+	return []string{strconv.FormatUint(uint64(s.ShardID), 10), s.SchemaName, s.ShardDSN, groups.FormatGroups(s.Groups),
+		version, s.TaskName, formatTime(s.LastTaskHb), s.TaskProgress, strconv.FormatUint(uint64(s.Attempts), 10), state}
+}
+
+var shardHeaders = []string{"SHARD", "SCHEMA", "DSN", "GROUPS", "VERSION", "TASK", "LAST HEARTBEAT", "PROGRESS",
+	"ATTEMPTS", "STATE"}
+
+type opLogView struct {
+	ShardID    uint32     `json:"shardId"`
+	Version    uint32     `json:"version"`
+	Seq        uint32     `json:"seq"`
+	Run        uint8      `json:"run"`
+	TaskName   string     `json:"taskName,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	Output     string     `json:"output,omitempty"`
+	Err        string     `json:"err,omitempty"`
+	LastUpdate *time.Time `json:"lastUpdate,omitempty"`
+}
+
+func newOpLogView(o *models.OpLog) opLogView {
+	return opLogView{
+		ShardID:    o.ShardId,
+		Version:    o.Version,
+		Seq:        o.Seq,
+		Run:        o.Run,
+		TaskName:   o.TaskName.String,
+		Message:    o.Message.String,
+		Output:     o.Output.String,
+		Err:        o.Err.String,
+		LastUpdate: nullTime(o.LastUpdate),
+	}
+}
+
+// the output of the commands can be long, the table only shows the message
+func (o opLogView) row() []string {
+	return []string{strconv.FormatUint(uint64(o.Version), 10), strconv.FormatUint(uint64(o.Seq), 10),
+		strconv.FormatUint(uint64(o.Run), 10), formatTime(o.LastUpdate), o.TaskName, o.Message}
+}
+
+var opLogHeaders = []string{"VERSION", "SEQ", "RUN", "TIME", "TASK", "MESSAGE"}
+
+type migrationView struct {
+	Version   uint32     `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+func newMigrationView(s migrate.Status) migrationView {
+	return migrationView{Version: s.Version, Name: s.Name, AppliedAt: s.AppliedAt}
+}
+
+func (m migrationView) row() []string {
+	applied := "pending"
+	if m.AppliedAt != nil {
+		applied = formatTime(m.AppliedAt)
+	}
+	return []string{strconv.FormatUint(uint64(m.Version), 10), m.Name, applied}
+}
+
+var migrationHeaders = []string{"VERSION", "NAME", "APPLIED"}
+
+func nullTime(nt models.NullTime) *time.Time {
+	if !nt.Valid {
+		return nil
+	}
+	t := nt.Time
+	return &t
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(timeFormat)
+}
+
+// redactDSN hides the password of a shard DSN
+func redactDSN(dsn string) string {
+	at := strings.LastIndex(dsn, "@")
+	if at < 0 {
+		return dsn
+	}
+	if colon := strings.Index(dsn[:at], ":"); colon >= 0 {
+		return dsn[:colon+1] + "xxx" + dsn[at:]
+	}
+	return dsn
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/database"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/ghost"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/ptosc"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/retry"
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/shardconn"
+)
+
+// progress holds the last progress information of a running task, it is read by
+// the worker when sending a heartbeat
+type progress struct {
+	mu  sync.Mutex
+	msg string
+}
+
+func (p *progress) set(msg string) {
+	p.mu.Lock()
+	p.msg = msg
+	p.mu.Unlock()
+}
+
+func (p *progress) get() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.msg
+}
+
+// taskThrottle holds the throttling state requested by the dispatcher for a running task. gh-ost
+// is throttled through its socket and pt-osc through its pause file, a sql task waits before
+// starting its ddl since a running ddl can't be slowed down.
+type taskThrottle struct {
+	mu        sync.Mutex
+	throttled bool
+}
+
+func (t *taskThrottle) set(throttled bool) {
+	t.mu.Lock()
+	t.throttled = throttled
+	t.mu.Unlock()
+}
+
+func (t *taskThrottle) get() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.throttled
+}
+
+// pt-osc reports its progress on stderr with lines like:
+// Copying `shard_1`.`t1`:  45% 00:30 remain
+var ptoscProgressRe = regexp.MustCompile(`Copying .*%.*`)
+
+// progressWriter scans the output of a command, line by line, for progress information
+type progressWriter struct {
+	re   *regexp.Regexp
+	prog *progress
+	line []byte
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c == '\n' || c == '\r' {
+			if m := w.re.Find(w.line); m != nil {
+				w.prog.set(string(m))
+			}
+			w.line = w.line[:0]
+			continue
+		}
+		w.line = append(w.line, c)
+	}
+	return len(p), nil
+}
+
+func worker(db database.Store, pool *shardconn.Pool, id int, heartbeat time.Duration,
+	MsgIn <-chan MsgToWorker, ctlIn <-chan MsgToWorker, MsgOut chan<- MsgFromWorker) {
+
+	stopping := false
+	for !stopping {
+		select {
+		case rmsg := <-MsgIn:
+			{
+				switch rmsg.msgType {
+				case 1:
+					{ // new task
+						log := rmsg.task.logger().With("workerId", id)
+						log.Info("worker received a task")
+
+						// run the task in the background and send heartbeats until it completes
+						ctx, cancel := context.WithCancel(context.Background())
+						prog := &progress{msg: "starting"}
+						thr := &taskThrottle{}
+						result := make(chan taskResult, 1)
+						go func() {
+							result <- runTask(ctx, db, pool, rmsg.task, prog, thr)
+						}()
+
+						// let the dispatcher know who is running the task
+						MsgOut <- MsgFromWorker{msgType: 1, task: rmsg.task, workerID: id, progress: prog.get()}
+
+						ticker := time.NewTicker(heartbeat)
+						running := true
+						for running {
+							select {
+							case res := <-result:
+								MsgOut <- MsgFromWorker{msgType: res.msgType, task: rmsg.task, workerID: id,
+									errClass: res.errClass}
+								running = false
+							case <-ticker.C:
+								MsgOut <- MsgFromWorker{msgType: 1, task: rmsg.task, workerID: id, progress: prog.get()}
+							case cmsg := <-ctlIn:
+								switch {
+								case cmsg.msgType == 3 && cmsg.task.key() == rmsg.task.key():
+									log.Info("worker aborting the task")
+									prog.set("aborting")
+									cancel()
+								case (cmsg.msgType == 5 || cmsg.msgType == 6) &&
+									cmsg.task.key() == rmsg.task.key():
+									thr.set(cmsg.msgType == 5)
+								case cmsg.msgType == 4:
+									// exit once the task completes
+									stopping = true
+								}
+							}
+						}
+						ticker.Stop()
+						cancel()
+					}
+				}
+			}
+		case cmsg := <-ctlIn:
+			{
+				// nothing is running, an abort or a throttle is about a task that already completed
+				if cmsg.msgType == 4 {
+					stopping = true
+				}
+			}
+		}
+	}
+
+	Logger.Info("worker stopping", "workerId", id)
+	MsgOut <- MsgFromWorker{msgType: 5, workerID: id}
+}
+
+// taskResult is the outcome of runTask
+type taskResult struct {
+	msgType  uint8  // message type to report to the dispatcher, 2 if done, 3 if failed, 4 if cancelled
+	errClass string // class of the error when failed, see the retry package
+}
+
+// sqlDDL returns the statement applying a sql version
+func sqlDDL(version *models.Version) string {
+	return "alter table " + shardconn.QuoteIdentifier(version.TableName) + " " + version.Command
+}
+
+// ptoscPauseFile returns the pause file of the pt-osc run of the task
+func ptoscPauseFile(task Task) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("ptosc.%d.%d.pause", task.shard.ShardId, task.version.Version))
+}
+
+// ghostFiles returns the files of the gh-ost run of the task
+func ghostFiles(task Task) ghost.Files {
+	return ghost.NewFiles(os.TempDir(), fmt.Sprintf("%d.%d", task.shard.ShardId, task.version.Version))
+}
+
+// runTask applies the version of the task to the shard and validates it, it is cancelled
+// through ctx. The task is "Completed OK" in the oplog only once validated, the durations
+// of the versions count these entries.
+func runTask(ctx context.Context, db database.Store, pool *shardconn.Pool, task Task, prog *progress,
+	thr *taskThrottle) taskResult {
+	if res := applyVersion(ctx, db, pool, task, prog, thr); res.msgType != 2 {
+		return res
+	}
+	res := validateTask(ctx, db, pool, task, prog)
+	if res.msgType == 2 {
+		db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+			"Completed OK", "", "")
+	}
+	return res
+}
+
+// applyVersion runs the command of the version of the task on the shard
+func applyVersion(ctx context.Context, db database.Store, pool *shardconn.Pool, task Task,
+	prog *progress, thr *taskThrottle) taskResult {
+	switch task.version.CmdType {
+	case "sql":
+		{
+			sqlddl := sqlDDL(task.version)
+			if !waitThrottle(ctx, thr, prog) {
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"cancelled while throttled", "", "")
+				return taskResult{msgType: 4}
+			}
+			db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+				"starting SQL command: '"+sqlddl+"'", "", "")
+
+			conn, err := pool.Conn(ctx, task.shard)
+			if err != nil {
+				if ctx.Err() != nil {
+					db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+						"cancelled", "", err.Error())
+					return taskResult{msgType: 4}
+				}
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error: shard db connection", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Classify(err, "")}
+			}
+			defer conn.Close()
+
+			// the connection id allows to follow the ddl in the processlist
+			var connID uint64
+			if err = conn.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&connID); err != nil {
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error: shard db connection", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Classify(err, "")}
+			}
+
+			done := make(chan struct{})
+			defer close(done)
+			go watchSQLProgress(pool, task, connID, prog, done)
+
+			// on abort, the driver only drops the connection, the query must be killed on the server
+			stopKill := context.AfterFunc(ctx, func() {
+				killCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				if err := pool.KillQuery(killCtx, task.shard, connID); err != nil {
+					task.logger().Error("cannot kill the ddl", "error", err)
+				}
+			})
+			defer stopKill()
+
+			if _, err = conn.ExecContext(ctx, sqlddl); err != nil {
+				if ctx.Err() != nil {
+					db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+						"cancelled", "", err.Error())
+					return taskResult{msgType: 4}
+				}
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error: ddl error", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Classify(err, "")}
+			}
+
+			db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+				"DDL OK", "", "")
+			return taskResult{msgType: 2}
+		}
+
+	case "pt-osc":
+		{
+			mysqlDSN, err := shardconn.ParseDSN(task.shard.ShardDSN)
+			if err != nil {
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error parsing the shard DSN: '"+redactDSN(task.shard.ShardDSN)+"'", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Unknown}
+			}
+
+			options, err := ptosc.ParseOptions(task.version.Options.String)
+			if err != nil {
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error: invalid pt-osc options: '"+task.version.Options.String+"'", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Unknown}
+			}
+
+			// the credentials are passed through a file, not on the command line
+			defaultsFile, err := ptosc.WriteDefaultsFile(mysqlDSN.User, mysqlDSN.Passwd)
+			if err != nil {
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error: cannot create the pt-osc defaults file", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Unknown}
+			}
+			defer os.Remove(defaultsFile)
+
+			m := &ptosc.Migration{
+				DSN:          mysqlDSN,
+				Schema:       task.shard.SchemaName,
+				Table:        task.version.TableName,
+				Alter:        task.version.Command,
+				Options:      options,
+				DefaultsFile: defaultsFile,
+				PauseFile:    ptoscPauseFile(task),
+			}
+			defer os.Remove(m.PauseFile)
+
+			done := make(chan struct{})
+			defer close(done)
+			go controlPause(m.PauseFile, prog, thr, done)
+
+			// the dry run checks the alter and the table without changing anything
+			prog.set("dry run")
+			if res := runPtosc(ctx, db, task, m, false, prog); res.msgType != 2 {
+				return res
+			}
+			return runPtosc(ctx, db, task, m, true, prog)
+		}
+
+	case "gh-ost":
+		{
+			mysqlDSN, err := shardconn.ParseDSN(task.shard.ShardDSN)
+			if err != nil {
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error parsing the shard DSN: '"+redactDSN(task.shard.ShardDSN)+"'", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Unknown}
+			}
+
+			files := ghostFiles(task)
+			cmdName := "gh-ost"
+			cmdArgs, err := ghost.Args(mysqlDSN, task.shard.SchemaName, task.version.TableName,
+				task.version.Command, files)
+			if err != nil {
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error: cannot build the gh-ost command", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Unknown}
+			}
+
+			// the credentials are passed through a file, not on the command line
+			if err = files.Create(mysqlDSN.User, mysqlDSN.Passwd); err != nil {
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error: cannot create the gh-ost files", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Unknown}
+			}
+			defer files.Remove()
+
+			var bout bytes.Buffer
+			var berr bytes.Buffer
+
+			cmd := exec.CommandContext(ctx, cmdName, cmdArgs...)
+			// on abort, let gh-ost stop its binlog streaming and exit cleanly
+			cmd.Cancel = func() error {
+				return cmd.Process.Signal(syscall.SIGTERM)
+			}
+			cmd.WaitDelay = time.Minute
+			cmd.Stdout = &bout
+			cmd.Stderr = &berr
+
+			db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+				"starting gh-ost command: "+cmdName+" with args: "+
+					strings.Join(cmdArgs, " "), "", "")
+
+			if err = cmd.Start(); err != nil {
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error: command: "+cmdName+" with args: ["+
+						strings.Join(cmdArgs, " ")+"] failed to start", "", err.Error())
+				return taskResult{msgType: 3, errClass: retry.Classify(err, "")}
+			}
+
+			done := make(chan struct{})
+			go controlGhost(files.Socket, prog, thr, done)
+			err = cmd.Wait()
+			close(done)
+
+			if err != nil {
+				if ctx.Err() != nil {
+					db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+						"cancelled", bout.String(), berr.String())
+					return taskResult{msgType: 4}
+				}
+				db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+					"Error: command: "+cmdName+" with args: ["+
+						strings.Join(cmdArgs, " ")+"] failed", bout.String(), berr.String())
+				return taskResult{msgType: 3, errClass: retry.Classify(err, berr.String())}
+			}
+
+			db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+				"DDL OK", bout.String(), berr.String())
+			return taskResult{msgType: 2}
+		}
+	}
+
+	db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+		"Error: unknown cmdType '"+task.version.CmdType+"'", "", "")
+	return taskResult{msgType: 3, errClass: retry.Unknown}
+}
+
+// runPtosc runs pt-osc for the migration m, with --execute if execute is true or with
+// --dry-run otherwise
+func runPtosc(ctx context.Context, db database.Store, task Task, m *ptosc.Migration, execute bool,
+	prog *progress) taskResult {
+
+	cmdName := ptosc.Command
+	cmdArgs := m.Args(execute)
+
+	var bout bytes.Buffer
+	var berr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, cmdName, cmdArgs...)
+	// on abort, let pt-osc clean up its triggers and new table before killing it
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = time.Minute
+	cmd.Stdout = &bout
+	// pt-osc reports its progress on stderr
+	cmd.Stderr = io.MultiWriter(&berr, &progressWriter{re: ptoscProgressRe, prog: prog})
+
+	db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+		"starting pt-osc command: "+cmdName+" with args: "+
+			strings.Join(cmdArgs, " "), "", "")
+
+	if err := cmd.Start(); err != nil {
+		db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+			"Error: command: "+cmdName+" with args: ["+
+				strings.Join(cmdArgs, " ")+"] failed to start", "", err.Error())
+		return taskResult{msgType: 3, errClass: retry.Classify(err, "")}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+				"cancelled", bout.String(), berr.String())
+			return taskResult{msgType: 4}
+		}
+
+		err = ptosc.ExitError(err)
+		db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+			"Error: command: "+cmdName+" with args: ["+
+				strings.Join(cmdArgs, " ")+"] failed: "+err.Error(), bout.String(), berr.String())
+
+		class := retry.Classify(err, berr.String())
+		if perr, ok := err.(*ptosc.Error); ok && perr.Connection() {
+			class = retry.Connection
+		}
+		return taskResult{msgType: 3, errClass: class}
+	}
+
+	message := "DDL OK"
+	if !execute {
+		message = "Dry run OK"
+	}
+	db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+		message, bout.String(), berr.String())
+	return taskResult{msgType: 2}
+}
+
+// validateTask runs the validation query of the version, if any, on the shard once the
+// command succeeded. The task is done only if the result matches the expected answer.
+func validateTask(ctx context.Context, db database.Store, pool *shardconn.Pool, task Task,
+	prog *progress) taskResult {
+	if !task.version.ValidationQuery.Valid || task.version.ValidationQuery.String == "" {
+		return taskResult{msgType: 2}
+	}
+	query := task.version.ValidationQuery.String
+
+	prog.set("validating")
+
+	conn, err := pool.Conn(ctx, task.shard)
+	if err != nil {
+		if ctx.Err() != nil {
+			db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+				"cancelled during the validation", "", err.Error())
+			return taskResult{msgType: 4}
+		}
+		db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+			"Error: shard db connection", "", err.Error())
+		return taskResult{msgType: 3, errClass: retry.Classify(err, "")}
+	}
+	defer conn.Close()
+
+	result, err := shardconn.QueryResult(ctx, conn, query)
+	if err != nil {
+		if ctx.Err() != nil {
+			db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+				"cancelled during the validation", "", err.Error())
+			return taskResult{msgType: 4}
+		}
+		db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+			"Error: validation query: '"+query+"'", "", err.Error())
+		return taskResult{msgType: 3, errClass: retry.Classify(err, "")}
+	}
+
+	if !shardconn.SameResult(result, task.version.ValidationAnswer.String) {
+		db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+			"Error: validation failed, query: '"+query+"' expected: '"+
+				task.version.ValidationAnswer.String+"'", result, "")
+		return taskResult{msgType: 3, errClass: retry.Validation}
+	}
+
+	db.AddOpLog(task.shard.ShardId, task.version.Version, task.name,
+		"Validation OK", result, "")
+	return taskResult{msgType: 2}
+}
+
+// controlGhost drives gh-ost through its interactive socket until done is closed. It
+// updates prog with the status of gh-ost, applies the throttling requested by the
+// dispatcher and lets gh-ost cut over once the copy is complete, unless throttled.
+func controlGhost(socket string, prog *progress, thr *taskThrottle, done <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	throttled := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			status, err := ghost.SendCommand(socket, ghost.Status, 10*time.Second)
+			if err != nil {
+				// gh-ost serves the socket once it inspected the table
+				continue
+			}
+			current, postponing := ghost.ParseStatus(status)
+			if current != "" {
+				prog.set(current)
+			}
+
+			if want := thr.get(); want != throttled {
+				command := ghost.NoThrottle
+				if want {
+					command = ghost.Throttle
+				}
+				if _, err = ghost.SendCommand(socket, command, 10*time.Second); err != nil {
+					Logger.Warn("cannot send a command to gh-ost", "command", command, "socket", socket, "error", err)
+					continue
+				}
+				throttled = want
+			}
+
+			if postponing && !throttled {
+				if _, err = ghost.SendCommand(socket, ghost.Unpostpone, 10*time.Second); err != nil {
+					Logger.Warn("cannot send a command to gh-ost", "command", ghost.Unpostpone, "socket", socket,
+						"error", err)
+				}
+			}
+		}
+	}
+}
+
+// controlPause creates the pause file of pt-osc while the task is throttled, and removes it
+// otherwise, until done is closed
+func controlPause(pauseFile string, prog *progress, thr *taskThrottle, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	paused := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			want := thr.get()
+			if want == paused {
+				continue
+			}
+			var err error
+			if want {
+				var f *os.File
+				if f, err = os.Create(pauseFile); err == nil {
+					err = f.Close()
+				}
+			} else {
+				err = os.Remove(pauseFile)
+			}
+			if err != nil && !os.IsNotExist(err) {
+				Logger.Warn("cannot change the pt-osc pause file", "file", pauseFile, "error", err)
+				continue
+			}
+			paused = want
+			if paused {
+				prog.set("paused, throttled")
+			}
+		}
+	}
+}
+
+// waitThrottle waits until the task is not throttled anymore, returns false if ctx is
+// cancelled first
+func waitThrottle(ctx context.Context, thr *taskThrottle, prog *progress) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for thr.get() {
+		prog.set("waiting, throttled")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// watchSQLProgress updates prog with the state of the ddl connection in the processlist
+// until done is closed
+func watchSQLProgress(pool *shardconn.Pool, task Task, connID uint64, prog *progress, done <-chan struct{}) {
+	start := time.Now()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	prog.set("executing")
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			state, err := pool.QueryState(context.Background(), task.shard, connID)
+			if err != nil || state == "" {
+				state = "executing"
+			}
+			prog.set(fmt.Sprintf("%s, running for %s", state, time.Since(start).Round(time.Second)))
+		}
+	}
+}
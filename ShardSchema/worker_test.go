@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/y-trudeau/Mysql-tools/ShardSchema/internal/models"
+	tu "github.com/y-trudeau/Mysql-tools/ShardSchema/testutils"
+)
+
+func TestPtoscProgress(t *testing.T) {
+	prog := &progress{}
+	w := &progressWriter{re: ptoscProgressRe, prog: prog}
+
+	fmt.Fprint(w, "Creating new table...\nCopying `shard_1`.`t1`:  12% 01:23 remain\n")
+	tu.Equals(t, "Copying `shard_1`.`t1`:  12% 01:23 remain", prog.get())
+
+	// partial lines are only considered once complete
+	fmt.Fprint(w, "Copying `shard_1`.`t1`:  45%")
+	tu.Equals(t, "Copying `shard_1`.`t1`:  12% 01:23 remain", prog.get())
+	fmt.Fprint(w, " 00:30 remain\nSwapping tables...\n")
+	tu.Equals(t, "Copying `shard_1`.`t1`:  45% 00:30 remain", prog.get())
+}
+
+func TestSQLDDL(t *testing.T) {
+	tests := []struct {
+		table string
+		ddl   string
+	}{
+		{"t1", "alter table `t1` ADD COLUMN c2 INT"},
+		{"my`table", "alter table `my``table` ADD COLUMN c2 INT"},
+	}
+
+	for _, test := range tests {
+		v := &models.Version{TableName: test.table, CmdType: "sql", Command: "ADD COLUMN c2 INT"}
+		tu.Equals(t, test.ddl, sqlDDL(v))
+	}
+}